@@ -29,13 +29,19 @@ import (
 	"github.com/coreos/rkt/pkg/multicall"
 	"github.com/spf13/cobra"
 
+	"github.com/appc/acbuild/engine"
 	"github.com/appc/acbuild/lib"
+	"github.com/appc/acbuild/registry"
 	"github.com/appc/acbuild/util"
 )
 
 const (
 	cliName = "acbuild"
 
+	// timeoutExitCode is the exit code for a run command that timed out,
+	// the same as timeout(1) uses
+	timeoutExitCode = 124
+
 	commandUsage = `\
 NAME:
 {{printf "\t%s - %s" .Name .Short}}
@@ -66,10 +72,12 @@ OPTIONS:
 )
 
 var (
-	debug          bool
-	contextpath    string
-	aciToModify    string
-	disableHistory bool
+	debug            bool
+	contextpath      string
+	aciToModify      string
+	disableHistory   bool
+	sharedStore      bool
+	fetchConcurrency int
 
 	cmdExitCode int
 
@@ -98,18 +106,45 @@ func init() {
 	cmdAcbuild.PersistentFlags().StringVar(&contextpath, "work-path", ".", "Path to place working files in")
 	cmdAcbuild.PersistentFlags().StringVar(&aciToModify, "modify", "", "Path to an ACI to modify (ignores build context)")
 	cmdAcbuild.PersistentFlags().BoolVar(&disableHistory, "no-history", false, "Don't add annotations with the command that was run")
+	cmdAcbuild.PersistentFlags().IntVar(&fetchConcurrency, "fetch-concurrency", registry.DefaultConcurrency, "Number of dependencies to download at once")
+	cmdAcbuild.PersistentFlags().BoolVar(&sharedStore, "shared-store", os.Getenv("ACBUILD_SHARED_STORE") != "", "Keep fetched dependencies in a store shared between builds (defaults to true if $ACBUILD_SHARED_STORE is set)")
 
 	cobra.EnablePrefixMatching = true
 }
 
 func newACBuild() *lib.ACBuild {
-	return lib.NewACBuild(contextpath, debug)
+	var a *lib.ACBuild
+	if scriptACBuild != nil {
+		acb := *scriptACBuild
+		a = &acb
+	} else {
+		a = lib.NewACBuild(contextpath, debug)
+	}
+	if sharedStore {
+		a.UseSharedStore()
+	}
+	a.FetchConcurrency = fetchConcurrency
+	return a
+}
+
+// exitCodeError is returned for a command that failed with the given exit
+// code, without an error of its own to return.
+type exitCodeError int
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
 }
 
 func getErrorCode(err error) int {
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		return exitErr.Sys().(syscall.WaitStatus).ExitStatus()
 	}
+	if code, ok := err.(exitCodeError); ok {
+		return int(code)
+	}
+	if _, ok := err.(*engine.TimeoutError); ok {
+		return timeoutExitCode
+	}
 	switch err {
 	case lib.ErrNotFound:
 		return 2
@@ -122,18 +157,34 @@ func getErrorCode(err error) int {
 	}
 }
 
+// readOnlySubcommands are the subcommands, by their full name, that don't
+// modify the ACI even though the top level command they belong to does.
+var readOnlySubcommands = map[string]bool{
+	"dependency tree": true,
+}
+
 // runWrapper return a func(cmd *cobra.Command, args []string) that internally
 // will add command function return code and the reinsertion of the "--" flag
 // terminator.
 func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd *cobra.Command, args []string) {
 	return func(cmd *cobra.Command, args []string) {
+		// Subcommands are treated like the top level command they belong to
+		name := cmd.Name()
+		fullName := name
+		for parent := cmd.Parent(); parent != cmdAcbuild; parent = parent.Parent() {
+			name = parent.Name()
+			fullName = name + " " + fullName
+		}
+		// Subcommands that only read the ACI aren't part of its history
+		readOnly := readOnlySubcommands[fullName]
+
 		if aciToModify == "" {
 			cmdExitCode = cf(cmd, args)
-			switch cmd.Name() {
-			case "cat-manifest", "begin", "write", "end", "version", "gen-man-pages", "script":
+			switch name {
+			case "cat-manifest", "begin", "write", "end", "version", "gen-man-pages", "script", "trust", "convert-dockerfile", "cache":
 				return
 			}
-			if cmdExitCode == 0 && !disableHistory {
+			if cmdExitCode == 0 && !disableHistory && !readOnly {
 				err := addACBuildAnnotation(cmd, args)
 				if err != nil {
 					stderr("%v", err)
@@ -144,12 +195,12 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 			return
 		}
 
-		switch cmd.Name() {
+		switch name {
 		case "cat-manifest":
 			cmdExitCode = runCatOnACI(aciToModify)
 			return
-		case "begin", "write", "end", "version", "gen-man-pages", "script":
-			stderr("Can't use the --modify flag with %s.", cmd.Name())
+		case "begin", "write", "end", "version", "gen-man-pages", "script", "trust", "convert-dockerfile", "cache":
+			stderr("Can't use the --modify flag with %s.", name)
 			cmdExitCode = 1
 			return
 		}
@@ -212,6 +263,9 @@ func runWrapper(cf func(cmd *cobra.Command, args []string) (exit int)) func(cmd
 		}()
 
 		cmdExitCode = cf(cmd, args)
+		if readOnly {
+			return
+		}
 
 		if cmdExitCode == 0 && !disableHistory {
 			err := addACBuildAnnotation(cmd, args)
@@ -0,0 +1,162 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/registry"
+	"github.com/appc/acbuild/util"
+)
+
+var (
+	pruneAll       bool
+	pruneUnusedFor time.Duration
+	pruneMaxSize   string
+	cmdCache       = &cobra.Command{
+		Use:   "cache [command]",
+		Short: "Manage the store of dependencies shared between builds",
+	}
+	cmdCacheList = &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the images in the shared store",
+		Example: "acbuild cache list",
+		Run:     runWrapper(runCacheList),
+	}
+	cmdCachePrune = &cobra.Command{
+		Use:     "prune",
+		Short:   "Remove images from the shared store",
+		Long:    "Removes the images that haven't been used for a while, or the least recently used images until the store is small enough",
+		Example: "acbuild cache prune --unused-for 720h --max-size 10G",
+		Run:     runWrapper(runCachePrune),
+	}
+	cmdCacheGC = &cobra.Command{
+		Use:     "gc",
+		Short:   "Remove leftovers of interrupted fetches from the shared store",
+		Example: "acbuild cache gc",
+		Run:     runWrapper(runCacheGC),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdCache)
+	cmdCache.AddCommand(cmdCacheList)
+	cmdCache.AddCommand(cmdCachePrune)
+	cmdCache.AddCommand(cmdCacheGC)
+
+	cmdCachePrune.Flags().BoolVar(&pruneAll, "all", false, "Remove every image")
+	cmdCachePrune.Flags().DurationVar(&pruneUnusedFor, "unused-for", 0, "Remove the images that haven't been used for this long")
+	cmdCachePrune.Flags().StringVar(&pruneMaxSize, "max-size", "", "Remove the least recently used images until the store is at most this big, such as 10G")
+}
+
+func runCacheList(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("cache list: incorrect number of arguments")
+		return 1
+	}
+
+	entries, err := newACBuild().CachedImages()
+
+	if err != nil {
+		stderr("cache list: %v", err)
+		return getErrorCode(err)
+	}
+
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	tabOut.Write([]byte("KEY\tNAME\tLABELS\tSIZE\tLAST USED\n"))
+	for _, entry := range entries {
+		var labels []string
+		for _, l := range entry.Labels {
+			labels = append(labels, fmt.Sprintf("%s=%s", l.Name, l.Value))
+		}
+		fmt.Fprintf(tabOut, "%s\t%s\t%s\t%s\t%s\n", shortKey(entry.Key), entry.Name,
+			strings.Join(labels, ","), util.FormatSize(entry.Size), entry.LastUsed.Format("2006-01-02 15:04:05"))
+	}
+	tabOut.Flush()
+
+	return 0
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("cache prune: incorrect number of arguments")
+		return 1
+	}
+	if !pruneAll && pruneUnusedFor == 0 && pruneMaxSize == "" {
+		stderr("cache prune: one of --all, --unused-for and --max-size must be given")
+		return 1
+	}
+
+	opts := registry.PruneOptions{
+		All:       pruneAll,
+		UnusedFor: pruneUnusedFor,
+	}
+	if pruneMaxSize != "" {
+		size, err := util.ParseSize(pruneMaxSize)
+		if err != nil {
+			stderr("cache prune: %v", err)
+			return 1
+		}
+		opts.MaxSize = size
+	}
+
+	removed, err := newACBuild().PruneCache(opts)
+
+	for _, entry := range removed {
+		stdout("Removed %s %s", shortKey(entry.Key), entry.Name)
+	}
+	if err != nil {
+		stderr("cache prune: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+func runCacheGC(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("cache gc: incorrect number of arguments")
+		return 1
+	}
+
+	removed, err := newACBuild().GCCache()
+
+	for _, p := range removed {
+		stdout("Removed %s", p)
+	}
+	if err != nil {
+		stderr("cache gc: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+// shortKey abbreviates an image key for display.
+func shortKey(key string) string {
+	const shortKeyLen = len("sha512-") + 12
+	if len(key) > shortKeyLen {
+		return key[:shortKeyLen]
+	}
+	return key
+}
@@ -0,0 +1,657 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/spf13/cobra"
+)
+
+var (
+	convertName          string
+	convertOutput        string
+	cmdConvertDockerfile = &cobra.Command{
+		Use:     "convert-dockerfile DOCKERFILE",
+		Short:   "Convert a Dockerfile into an acbuild script",
+		Long:    "Translates the instructions in a Dockerfile into an equivalent acbuild script, which is printed to stdout. Instructions that can't be translated are reported on stderr, and left as comments in the script.",
+		Example: "acbuild convert-dockerfile --name example.com/myapp --write myapp.aci Dockerfile > build.acb",
+		Run:     runWrapper(runConvertDockerfile),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdConvertDockerfile)
+
+	cmdConvertDockerfile.Flags().StringVar(&convertName, "name", "", "name to give the image in the script")
+	cmdConvertDockerfile.Flags().StringVar(&convertOutput, "write", "", "path the script should write the ACI to")
+}
+
+func runConvertDockerfile(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("convert-dockerfile: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Converting %s", args[0])
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		stderr("convert-dockerfile: %v", err)
+		return getErrorCode(err)
+	}
+	defer f.Close()
+
+	instructions, err := parseDockerfile(f)
+	if err != nil {
+		stderr("convert-dockerfile: %v", err)
+		return getErrorCode(err)
+	}
+
+	script, problems, err := convertDockerfile(instructions, convertName, convertOutput)
+	if err != nil {
+		stderr("convert-dockerfile: %v", err)
+		return getErrorCode(err)
+	}
+
+	for _, p := range problems {
+		stderr("convert-dockerfile: %s", p)
+	}
+	for _, line := range script {
+		fmt.Println(line)
+	}
+
+	return 0
+}
+
+// dockerfileInstruction is a single instruction in a Dockerfile, with any
+// continuation lines joined.
+type dockerfileInstruction struct {
+	line int
+	cmd  string
+	args string
+}
+
+// dockerfileProblem is an instruction that couldn't be translated.
+type dockerfileProblem struct {
+	line int
+	msg  string
+}
+
+func (p dockerfileProblem) String() string {
+	return fmt.Sprintf("line %d: %s", p.line, p.msg)
+}
+
+// parseDockerfile splits the Dockerfile read from r into its instructions,
+// dropping comments and honouring the escape parser directive.
+func parseDockerfile(r io.Reader) ([]dockerfileInstruction, error) {
+	var instructions []dockerfileInstruction
+	escape := `\`
+	inDirectives := true
+	var current *dockerfileInstruction
+
+	s := bufio.NewScanner(r)
+	for lineNum := 1; s.Scan(); lineNum++ {
+		line := strings.TrimSpace(s.Text())
+
+		if inDirectives {
+			directive := strings.ToLower(strings.Replace(strings.TrimPrefix(line, "#"), " ", "", -1))
+			switch {
+			case strings.HasPrefix(line, "#") && strings.HasPrefix(directive, "escape="):
+				escape = strings.TrimPrefix(directive, "escape=")
+				if escape != `\` && escape != "`" {
+					return nil, fmt.Errorf("line %d: invalid escape character %q", lineNum, escape)
+				}
+				continue
+			case strings.HasPrefix(line, "#") && strings.Contains(directive, "="):
+				continue
+			}
+			inDirectives = false
+		}
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if current == nil {
+			parts := strings.SplitN(line, " ", 2)
+			current = &dockerfileInstruction{
+				line: lineNum,
+				cmd:  strings.ToUpper(strings.TrimSpace(parts[0])),
+			}
+			line = ""
+			if len(parts) == 2 {
+				line = strings.TrimSpace(parts[1])
+			}
+		}
+
+		if strings.HasSuffix(line, escape) {
+			current.args += strings.TrimSuffix(line, escape)
+			continue
+		}
+		current.args = strings.TrimSpace(current.args + line)
+		instructions = append(instructions, *current)
+		current = nil
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	if current != nil {
+		current.args = strings.TrimSpace(current.args)
+		instructions = append(instructions, *current)
+	}
+	return instructions, nil
+}
+
+// dockerfileConverter holds the state of the translation of a Dockerfile.
+type dockerfileConverter struct {
+	script     []string
+	problems   []dockerfileProblem
+	workingDir string
+	shell      []string
+	entrypoint []string
+	cmd        []string
+	// env holds the values of the ENV instructions seen so far
+	env map[string]string
+
+	shellEntrypoint bool
+	begun           bool
+	skipping        bool
+}
+
+// convertDockerfile translates the given instructions into an acbuild script.
+// If name is set the script names the image, and if output is set the script
+// writes the image to it. The instructions that couldn't be translated are
+// returned alongside the script, and are left in it as comments.
+func convertDockerfile(instructions []dockerfileInstruction, name, output string) ([]string, []dockerfileProblem, error) {
+	c := &dockerfileConverter{
+		workingDir: "/",
+		shell:      []string{"/bin/sh", "-c"},
+		env:        make(map[string]string),
+	}
+	c.script = []string{"# Converted from a Dockerfile by acbuild convert-dockerfile"}
+
+	for _, inst := range instructions {
+		if c.skipping {
+			continue
+		}
+		if !c.begun && inst.cmd != "FROM" && inst.cmd != "ARG" {
+			return nil, nil, fmt.Errorf("line %d: the first instruction must be FROM", inst.line)
+		}
+		var err error
+		switch inst.cmd {
+		case "FROM":
+			err = c.from(inst, name)
+		case "RUN":
+			err = c.run(inst)
+		case "COPY", "ADD":
+			err = c.copy(inst)
+		case "ENV":
+			err = c.keyValues(inst, "environment", "add")
+		case "LABEL":
+			err = c.keyValues(inst, "label", "add")
+		case "MAINTAINER":
+			c.emit("annotation", "add", "authors", inst.args)
+		case "EXPOSE":
+			err = c.expose(inst)
+		case "VOLUME":
+			err = c.volume(inst)
+		case "USER":
+			err = c.user(inst)
+		case "WORKDIR":
+			c.workingDir = c.resolvePath(inst.args)
+			c.emit("set-working-directory", c.workingDir)
+		case "ENTRYPOINT":
+			c.entrypoint = c.commandArgs(inst.args)
+			c.shellEntrypoint = !isJSONForm(inst.args)
+		case "CMD":
+			c.cmd = c.commandArgs(inst.args)
+		case "SHELL":
+			var shell []string
+			if json.Unmarshal([]byte(inst.args), &shell) != nil || len(shell) == 0 {
+				err = fmt.Errorf("SHELL must be given a JSON array")
+			} else {
+				c.shell = shell
+			}
+		default:
+			err = fmt.Errorf("%s can't be translated", inst.cmd)
+		}
+		if err != nil {
+			c.problem(inst, err.Error())
+		}
+	}
+
+	exec := c.entrypoint
+	if !c.shellEntrypoint {
+		// The shell form of ENTRYPOINT ignores CMD
+		exec = append(exec, c.cmd...)
+	}
+	if len(exec) != 0 {
+		c.emit(append([]string{"set-exec", "--"}, exec...)...)
+	}
+	if output != "" {
+		c.emit("write", "--overwrite", output)
+	}
+	return c.script, c.problems, nil
+}
+
+// emit adds a line to the script made of the given tokens, quoted so that
+// acbuild script reads them back unchanged.
+func (c *dockerfileConverter) emit(tokens ...string) {
+	quoted := make([]string, len(tokens))
+	for i, tok := range tokens {
+		quoted[i] = quoteScriptToken(tok)
+	}
+	c.script = append(c.script, strings.Join(quoted, " "))
+}
+
+func (c *dockerfileConverter) problem(inst dockerfileInstruction, msg string) {
+	p := dockerfileProblem{inst.line, msg}
+	c.problems = append(c.problems, p)
+	c.script = append(c.script, "# "+p.String()+": "+inst.cmd+" "+inst.args)
+}
+
+// quoteScriptToken quotes tok if needed, so that tokenizeLine turns it back
+// into a single token. Single quotes are used so that nothing in the token is
+// expanded.
+func quoteScriptToken(tok string) string {
+	if tok != "" && !strings.ContainsAny(tok, " \t'\"\\#$") {
+		return tok
+	}
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(tok) + "'"
+}
+
+func isJSONForm(args string) bool {
+	var list []string
+	return strings.HasPrefix(args, "[") && json.Unmarshal([]byte(args), &list) == nil
+}
+
+// commandArgs returns the command given to RUN, CMD or ENTRYPOINT, running it
+// with the shell if it's in the shell form.
+func (c *dockerfileConverter) commandArgs(args string) []string {
+	var list []string
+	if isJSONForm(args) {
+		json.Unmarshal([]byte(args), &list)
+		return list
+	}
+	return append(append([]string{}, c.shell...), args)
+}
+
+// splitFlags splits the leading --flag=value words from the rest of args.
+func splitFlags(args string) ([]string, string) {
+	var flags []string
+	for strings.HasPrefix(args, "--") {
+		parts := strings.SplitN(args, " ", 2)
+		flags = append(flags, parts[0])
+		args = ""
+		if len(parts) == 2 {
+			args = strings.TrimSpace(parts[1])
+		}
+	}
+	return flags, args
+}
+
+// resolvePath makes p absolute, relative to the current working directory.
+func (c *dockerfileConverter) resolvePath(p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	resolved := path.Join(c.workingDir, p)
+	if strings.HasSuffix(p, "/") {
+		resolved += "/"
+	}
+	return resolved
+}
+
+func (c *dockerfileConverter) from(inst dockerfileInstruction, name string) error {
+	if c.begun {
+		c.skipping = true
+		return fmt.Errorf("only the first stage of a multi-stage build is translated")
+	}
+	c.begun = true
+
+	flags, args := splitFlags(inst.args)
+	image := strings.Fields(args)
+	if len(flags) != 0 || len(image) == 0 || strings.Contains(image[0], "$") {
+		return fmt.Errorf("FROM can't be translated")
+	}
+	if image[0] == "scratch" {
+		c.emit("begin")
+	} else {
+		c.emit("begin", "docker://"+image[0])
+	}
+	if name != "" {
+		c.emit("set-name", name)
+	}
+	return nil
+}
+
+func (c *dockerfileConverter) run(inst dockerfileInstruction) error {
+	flags, args := splitFlags(inst.args)
+	if len(flags) != 0 {
+		return fmt.Errorf("RUN flags %v can't be translated", flags)
+	}
+	tokens := []string{"run"}
+	// run starts in the root unless told otherwise, while RUN starts in
+	// the WORKDIR
+	if c.workingDir != "/" {
+		tokens = append(tokens, "--working-dir", c.workingDir)
+	}
+	tokens = append(tokens, "--")
+	c.emit(append(tokens, c.commandArgs(args)...)...)
+	return nil
+}
+
+func (c *dockerfileConverter) copy(inst dockerfileInstruction) error {
+	flags, args := splitFlags(inst.args)
+	if len(flags) != 0 {
+		return fmt.Errorf("%s flags %v can't be translated", inst.cmd, flags)
+	}
+
+	var paths []string
+	if !strings.HasPrefix(args, "[") || json.Unmarshal([]byte(args), &paths) != nil {
+		paths = strings.Fields(args)
+	}
+	if len(paths) < 2 {
+		return fmt.Errorf("%s needs a source and a destination", inst.cmd)
+	}
+	srcs, dest := paths[:len(paths)-1], c.resolvePath(paths[len(paths)-1])
+
+	for _, src := range srcs {
+		switch {
+		case strings.ContainsAny(src, "*?[$"):
+			return fmt.Errorf("%s of %q can't be translated, patterns aren't supported", inst.cmd, src)
+		case inst.cmd == "ADD" && strings.Contains(src, "://"):
+			return fmt.Errorf("ADD of the URL %q can't be translated, use copy-url with the file's sha256 digest", src)
+		case inst.cmd == "ADD" && isArchive(src):
+			return fmt.Errorf("ADD of the archive %q can't be translated, as ADD would extract it", src)
+		}
+	}
+
+	if len(srcs) == 1 && !strings.HasSuffix(dest, "/") {
+		c.emit("copy", srcs[0], dest)
+	} else {
+		if dest != "/" {
+			dest = strings.TrimSuffix(dest, "/")
+		}
+		c.emit(append(append([]string{"copy-to-dir"}, srcs...), dest)...)
+	}
+	return nil
+}
+
+func isArchive(p string) bool {
+	for _, ext := range []string{".tar", ".tar.gz", ".tgz", ".tar.bz2", ".tbz2", ".tar.xz", ".txz"} {
+		if strings.HasSuffix(p, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// keyValues translates ENV and LABEL, which take either a single key and a
+// value, or any number of key=value pairs. References to variables set by
+// earlier ENV instructions are expanded.
+func (c *dockerfileConverter) keyValues(inst dockerfileInstruction, subcommand ...string) error {
+	var pairs [][2]string
+	args, err := c.expandVariables(inst.args, true)
+	if err != nil {
+		return err
+	}
+	words, err := splitDockerfileWords(args)
+	if err != nil {
+		return err
+	}
+	if len(words) != 0 && !strings.Contains(words[0], "=") {
+		parts := strings.SplitN(inst.args, " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("%s needs a value", inst.cmd)
+		}
+		value, err := c.expandVariables(strings.TrimSpace(parts[1]), false)
+		if err != nil {
+			return err
+		}
+		pairs = append(pairs, [2]string{parts[0], value})
+	} else {
+		for _, word := range words {
+			kv := strings.SplitN(word, "=", 2)
+			if len(kv) != 2 {
+				return fmt.Errorf("%s needs key=value pairs", inst.cmd)
+			}
+			pairs = append(pairs, [2]string{kv[0], kv[1]})
+		}
+	}
+
+	for _, kv := range pairs {
+		if inst.cmd == "ENV" {
+			c.emit(append(subcommand, kv[0], kv[1])...)
+			c.env[kv[0]] = kv[1]
+			continue
+		}
+		// Arbitrary labels are annotations in appc, only a few well known
+		// labels exist
+		labelName, err := types.SanitizeACIdentifier(kv[0])
+		if err != nil {
+			return fmt.Errorf("label %q can't be translated: %v", kv[0], err)
+		}
+		switch labelName {
+		case "version", "os", "arch":
+			c.emit("label", "add", labelName, kv[1])
+		default:
+			c.emit("annotation", "add", labelName, kv[1])
+		}
+	}
+	return nil
+}
+
+// expandVariables replaces the $VAR and ${VAR} references in s, outside of
+// single quotes, with the values set by earlier ENV instructions. If escape is
+// set, the values are escaped so that splitDockerfileWords keeps each of them
+// in one piece. Variables that aren't set by an earlier ENV could come from
+// the base image or an ARG, so they can't be translated.
+func (c *dockerfileConverter) expandVariables(s string, escape bool) (string, error) {
+	var buf bytes.Buffer
+	var quote rune
+	escaped := false
+	for i := 0; i < len(s); i++ {
+		char := rune(s[i])
+		switch {
+		case escaped:
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote == 0 && (char == '\'' || char == '"'):
+			quote = char
+		case char == '$' && quote != '\'':
+			name, end, err := variableReference(s[i:])
+			if err != nil {
+				return "", err
+			}
+			if name == "" {
+				break
+			}
+			value, ok := c.env[name]
+			if !ok {
+				return "", fmt.Errorf("$%s can't be translated, as it isn't set by an earlier ENV", name)
+			}
+			if escape {
+				value = escapeDockerfileWord(value)
+			}
+			buf.WriteString(value)
+			i += end - 1
+			continue
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String(), nil
+}
+
+// variableReference parses the variable reference that s starts with, and
+// returns the variable's name and the length of the reference. The name is
+// empty if the $ doesn't start a reference.
+func variableReference(s string) (string, int, error) {
+	isNameChar := func(i int, char byte) bool {
+		return char == '_' || 'a' <= char && char <= 'z' || 'A' <= char && char <= 'Z' ||
+			i > 0 && '0' <= char && char <= '9'
+	}
+	if strings.HasPrefix(s, "${") {
+		end := strings.IndexByte(s, '}')
+		if end == -1 {
+			return "", 0, fmt.Errorf("unterminated variable reference")
+		}
+		name := s[2:end]
+		for i := 0; i < len(name); i++ {
+			if !isNameChar(i, name[i]) {
+				return "", 0, fmt.Errorf("%s can't be translated, only $VAR and ${VAR} are supported", s[:end+1])
+			}
+		}
+		if name == "" {
+			return "", 0, fmt.Errorf("empty variable reference")
+		}
+		return name, end + 1, nil
+	}
+	end := 1
+	for end < len(s) && isNameChar(end-1, s[end]) {
+		end++
+	}
+	return s[1:end], end, nil
+}
+
+// escapeDockerfileWord escapes the characters in s that splitDockerfileWords
+// would otherwise treat specially.
+func escapeDockerfileWord(s string) string {
+	var buf bytes.Buffer
+	for _, char := range s {
+		if strings.ContainsRune(" \t'\"\\", char) {
+			buf.WriteByte('\\')
+		}
+		buf.WriteRune(char)
+	}
+	return buf.String()
+}
+
+// splitDockerfileWords splits s into words on whitespace, with quotes and
+// backslashes working as they do in a shell.
+func splitDockerfileWords(s string) ([]string, error) {
+	var words []string
+	var buf bytes.Buffer
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, char := range s {
+		switch {
+		case escaped:
+			buf.WriteRune(char)
+			escaped = false
+		case char == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0 && char == quote:
+			quote = 0
+		case quote != 0:
+			buf.WriteRune(char)
+		case char == '\'' || char == '"':
+			quote = char
+			inWord = true
+		case char == ' ' || char == '\t':
+			if inWord {
+				words = append(words, buf.String())
+				buf.Reset()
+				inWord = false
+			}
+		default:
+			buf.WriteRune(char)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote")
+	}
+	if inWord {
+		words = append(words, buf.String())
+	}
+	return words, nil
+}
+
+func (c *dockerfileConverter) expose(inst dockerfileInstruction) error {
+	for _, port := range strings.Fields(inst.args) {
+		protocol := "tcp"
+		parts := strings.SplitN(port, "/", 2)
+		if len(parts) == 2 {
+			protocol = strings.ToLower(parts[1])
+		}
+		bounds := strings.SplitN(parts[0], "-", 2)
+		start, err := strconv.ParseUint(bounds[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("port %q can't be translated", port)
+		}
+		end := start
+		if len(bounds) == 2 {
+			end, err = strconv.ParseUint(bounds[1], 10, 16)
+			if err != nil || end < start {
+				return fmt.Errorf("port %q can't be translated", port)
+			}
+		}
+		args := []string{"port", "add", fmt.Sprintf("%s-%d", protocol, start), protocol, strconv.FormatUint(start, 10)}
+		if end != start {
+			args = append(args, "--count", strconv.FormatUint(end-start+1, 10))
+		}
+		c.emit(args...)
+	}
+	return nil
+}
+
+func (c *dockerfileConverter) volume(inst dockerfileInstruction) error {
+	var volumes []string
+	if !strings.HasPrefix(inst.args, "[") || json.Unmarshal([]byte(inst.args), &volumes) != nil {
+		volumes = strings.Fields(inst.args)
+	}
+	for _, volume := range volumes {
+		name, err := types.SanitizeACName("volume" + c.resolvePath(volume))
+		if err != nil {
+			return fmt.Errorf("volume %q can't be translated: %v", volume, err)
+		}
+		c.emit("mount", "add", name, c.resolvePath(volume))
+	}
+	return nil
+}
+
+func (c *dockerfileConverter) user(inst dockerfileInstruction) error {
+	if strings.Contains(inst.args, "$") || inst.args == "" {
+		return fmt.Errorf("USER %q can't be translated", inst.args)
+	}
+	parts := strings.SplitN(inst.args, ":", 2)
+	c.emit("set-user", parts[0])
+	if len(parts) == 2 {
+		c.emit("set-group", parts[1])
+	}
+	return nil
+}
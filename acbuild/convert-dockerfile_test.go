@@ -0,0 +1,229 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfile(t *testing.T) {
+	type testcase struct {
+		input  string
+		output []dockerfileInstruction
+	}
+	cases := []testcase{
+		testcase{
+			"FROM alpine\n\n# a comment\nrun echo hi",
+			[]dockerfileInstruction{
+				{1, "FROM", "alpine"},
+				{4, "RUN", "echo hi"},
+			},
+		},
+		testcase{
+			"FROM alpine\nRUN apk update && \\\n    apk add git\nUSER app",
+			[]dockerfileInstruction{
+				{1, "FROM", "alpine"},
+				{2, "RUN", "apk update && apk add git"},
+				{4, "USER", "app"},
+			},
+		},
+		testcase{
+			"# escape=`\nFROM windows\nRUN dir c:\\ `\n  /s",
+			[]dockerfileInstruction{
+				{2, "FROM", "windows"},
+				{3, "RUN", "dir c:\\ /s"},
+			},
+		},
+	}
+	for _, c := range cases {
+		output, err := parseDockerfile(strings.NewReader(c.input))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.input, err)
+			continue
+		}
+		if len(output) != len(c.output) {
+			t.Errorf("instructions, expected:%v actual:%v", c.output, output)
+			continue
+		}
+		for i := range output {
+			if output[i] != c.output[i] {
+				t.Errorf("instruction, expected:%v actual:%v", c.output[i], output[i])
+			}
+		}
+	}
+}
+
+func TestConvertDockerfile(t *testing.T) {
+	type testcase struct {
+		input    string
+		output   []string
+		problems []int
+	}
+	cases := []testcase{
+		testcase{
+			`FROM alpine:3.4
+RUN apk add --no-cache git
+COPY main.go /src/
+ADD a b /opt/
+COPY config.json /etc/app.json
+ENV PATH=/usr/local/bin:/usr/bin
+ENV HOME /root
+EXPOSE 80 53/udp 8000-8002
+VOLUME ["/data"]
+WORKDIR /src
+WORKDIR app
+USER app:staff
+LABEL version="1.0" maintainer="me"
+ENTRYPOINT ["/app"]
+CMD ["--help"]`,
+			[]string{
+				"begin docker://alpine:3.4",
+				"run -- /bin/sh -c 'apk add --no-cache git'",
+				"copy-to-dir main.go /src",
+				"copy-to-dir a b /opt",
+				"copy config.json /etc/app.json",
+				"environment add PATH /usr/local/bin:/usr/bin",
+				"environment add HOME /root",
+				"port add tcp-80 tcp 80",
+				"port add udp-53 udp 53",
+				"port add tcp-8000 tcp 8000 --count 3",
+				"mount add volume-data /data",
+				"set-working-directory /src",
+				"set-working-directory /src/app",
+				"set-user app",
+				"set-group staff",
+				"label add version 1.0",
+				"annotation add maintainer me",
+				"set-exec -- /app --help",
+			},
+			nil,
+		},
+		testcase{
+			`FROM scratch
+COPY app /
+ENTRYPOINT /app $FLAGS
+CMD ["ignored"]`,
+			[]string{
+				"begin",
+				"copy-to-dir app /",
+				"set-exec -- /bin/sh -c '/app $FLAGS'",
+			},
+			nil,
+		},
+		testcase{
+			`FROM golang AS build
+SHELL ["/bin/bash", "-c"]
+RUN echo "it's"
+HEALTHCHECK CMD true
+ADD https://example.com/a.tar.gz /
+COPY *.go /src/
+FROM alpine
+RUN never`,
+			[]string{
+				"begin docker://golang",
+				`run -- /bin/bash -c 'echo "it\'s"'`,
+			},
+			[]int{4, 5, 6, 7},
+		},
+		testcase{
+			`FROM alpine
+WORKDIR /src
+RUN make
+WORKDIR app
+RUN make install
+WORKDIR /
+RUN ls`,
+			[]string{
+				"begin docker://alpine",
+				"set-working-directory /src",
+				"run --working-dir /src -- /bin/sh -c make",
+				"set-working-directory /src/app",
+				"run --working-dir /src/app -- /bin/sh -c 'make install'",
+				"set-working-directory /",
+				"run -- /bin/sh -c ls",
+			},
+			nil,
+		},
+		testcase{
+			`FROM scratch
+ENV A=1 B="two words"
+ENV C=$A:${B} D='$A' E=\$A
+ENV F ${A}x $B
+LABEL version=$A
+ENV G=$UNSET
+LABEL url=${A:-1}`,
+			[]string{
+				"begin",
+				"environment add A 1",
+				"environment add B 'two words'",
+				"environment add C '1:two words'",
+				"environment add D '$A'",
+				"environment add E '$A'",
+				"environment add F '1x two words'",
+				"label add version 1",
+			},
+			[]int{6, 7},
+		},
+	}
+	for _, c := range cases {
+		instructions, err := parseDockerfile(strings.NewReader(c.input))
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.input, err)
+			continue
+		}
+		script, problems, err := convertDockerfile(instructions, "", "")
+		if err != nil {
+			t.Errorf("unexpected error converting %q: %v", c.input, err)
+			continue
+		}
+		var commands []string
+		for _, line := range script {
+			if !strings.HasPrefix(line, "#") {
+				commands = append(commands, line)
+			}
+		}
+		if !equal(commands, c.output) {
+			t.Errorf("script, expected:%q actual:%q", c.output, commands)
+		}
+		var lines []int
+		for _, p := range problems {
+			lines = append(lines, p.line)
+		}
+		if len(lines) != len(c.problems) {
+			t.Errorf("problems, expected lines:%v actual:%v", c.problems, problems)
+			continue
+		}
+		for i := range lines {
+			if lines[i] != c.problems[i] {
+				t.Errorf("problems, expected lines:%v actual:%v", c.problems, problems)
+				break
+			}
+		}
+	}
+}
+
+func TestConvertedScriptTokenizes(t *testing.T) {
+	tokens := []string{"run", "--", "/bin/sh", "-c", `echo "a b" 'c' \d # $HOME`}
+	c := &dockerfileConverter{}
+	c.emit(tokens...)
+	output, err := tokenizeLine(c.script[0], nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !equal(output, tokens) {
+		t.Errorf("tokens, expected:%q actual:%q", tokens, output)
+	}
+}
@@ -32,6 +32,7 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopyToDir)
+	addCopyFlags(cmdCopyToDir)
 }
 
 func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
@@ -46,15 +47,24 @@ func runCopyToDir(cmd *cobra.Command, args []string) (exit int) {
 
 	if debug {
 		logMsg := "Copying "
+		if copyFrom != "" {
+			logMsg += fmt.Sprintf("from %s ", copyFrom)
+		}
 		for i := 0; i < len(args)-1; i++ {
 			logMsg += fmt.Sprintf("%s ", args[i])
 		}
 		logMsg += "to "
 		logMsg += fmt.Sprintf("%s", args[len(args)-1])
-		stderr(logMsg)
+		stderr("%s", logMsg)
+	}
+
+	opts, err := copyOptions()
+	if err != nil {
+		stderr("copy-to-dir: %v", err)
+		return 1
 	}
 
-	err := newACBuild().CopyToDir(args[:len(args)-1], args[len(args)-1])
+	err = newACBuild().CopyToDir(args[:len(args)-1], args[len(args)-1], opts)
 
 	if err != nil {
 		stderr("copy-to-dir: %v", err)
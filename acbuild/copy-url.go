@@ -0,0 +1,81 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/lib"
+)
+
+var (
+	copyURLSHA256  string
+	copyURLExtract bool
+	cmdCopyURL     = &cobra.Command{
+		Use:     "copy-url URL PATH_IN_ACI",
+		Short:   "Download a file into an ACI",
+		Example: "acbuild copy-url --sha256=<digest> https://example.com/app.tar.gz --extract /opt/app",
+		Run:     runWrapper(runCopyURL),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdCopyURL)
+	cmdCopyURL.Flags().StringVar(&copyURLSHA256, "sha256", "", "sha256 digest the downloaded file must have, in hex")
+	cmdCopyURL.Flags().BoolVar(&copyURLExtract, "extract", false, "Extract the downloaded tarball into PATH_IN_ACI")
+	cmdCopyURL.Flags().BoolVar(&insecure, "insecure", false, "Allows downloading over https without verifying the server's certificate")
+	cmdCopyURL.Flags().StringVar(&copyChown, "chown", "", "Owner to give the downloaded file, in the format USER[:GROUP]")
+	cmdCopyURL.Flags().StringVar(&copyChmod, "chmod", "", "Mode to give the downloaded file, in octal")
+}
+
+func runCopyURL(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 2 {
+		stderr("copy-url: incorrect number of arguments")
+		return 1
+	}
+	if copyURLSHA256 == "" {
+		stderr("copy-url: the file's digest must be given with --sha256")
+		return 1
+	}
+
+	if debug {
+		stderr("Downloading %s to aci:%s", args[0], args[1])
+	}
+
+	copyOpts, err := copyOptions()
+	if err != nil {
+		stderr("copy-url: %v", err)
+		return 1
+	}
+
+	err = newACBuild().CopyURL(args[0], args[1], lib.CopyURLOptions{
+		SHA256:   copyURLSHA256,
+		Extract:  copyURLExtract,
+		Insecure: insecure,
+		Chown:    copyOpts.Chown,
+		Chmod:    copyOpts.Chmod,
+	})
+
+	if err != nil {
+		stderr("copy-url: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
@@ -15,11 +15,22 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+
 	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/lib"
 )
 
 var (
-	cmdCopy = &cobra.Command{
+	copyFrom    string
+	copyChown   string
+	copyChmod   string
+	copyExclude stringList
+	copyIgnore  string
+	cmdCopy     = &cobra.Command{
 		Use:     "copy PATH_ON_HOST PATH_IN_ACI",
 		Short:   "Copy a file or directory into an ACI",
 		Example: "acbuild copy nginx.conf /etc/nginx/nginx.conf",
@@ -29,6 +40,47 @@ var (
 
 func init() {
 	cmdAcbuild.AddCommand(cmdCopy)
+	addCopyFlags(cmdCopy)
+}
+
+// addCopyFlags adds the flags shared by copy and copy-to-dir to cmd.
+func addCopyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&copyFrom, "from", "", "ACI, build work path or image name to copy from, instead of the host")
+	cmd.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching the image to copy from over http, and without verifying its signature")
+	cmd.Flags().StringVar(&copyChown, "chown", "", "Owner to give the copied files, in the format USER[:GROUP]")
+	cmd.Flags().StringVar(&copyChmod, "chmod", "", "Mode to give the copied files, in octal")
+	cmd.Flags().Var(&copyExclude, "exclude", "Pattern of files not to copy, can be given multiple times")
+	cmd.Flags().StringVar(&copyIgnore, "ignore-file", "", "File listing the files not to copy, instead of the .acbuildignore of the copied directory")
+}
+
+func copyOptions() (lib.CopyOptions, error) {
+	opts := lib.CopyOptions{
+		From:       copyFrom,
+		Insecure:   insecure,
+		Chown:      copyChown,
+		Exclude:    copyExclude,
+		IgnoreFile: copyIgnore,
+	}
+	if copyChmod != "" {
+		mode, err := strconv.ParseUint(copyChmod, 8, 32)
+		if err != nil || mode&^07777 != 0 {
+			return opts, fmt.Errorf("invalid mode %q", copyChmod)
+		}
+		// os.FileMode has bits of its own for the setuid, setgid and
+		// sticky bits, rather than their octal values
+		fileMode := os.FileMode(mode) & os.ModePerm
+		if mode&04000 != 0 {
+			fileMode |= os.ModeSetuid
+		}
+		if mode&02000 != 0 {
+			fileMode |= os.ModeSetgid
+		}
+		if mode&01000 != 0 {
+			fileMode |= os.ModeSticky
+		}
+		opts.Chmod = &fileMode
+	}
+	return opts, nil
 }
 
 func runCopy(cmd *cobra.Command, args []string) (exit int) {
@@ -42,10 +94,20 @@ func runCopy(cmd *cobra.Command, args []string) (exit int) {
 	}
 
 	if debug {
-		stderr("Copying host:%s to aci:%s", args[0], args[1])
+		if copyFrom != "" {
+			stderr("Copying %s:%s to aci:%s", copyFrom, args[0], args[1])
+		} else {
+			stderr("Copying host:%s to aci:%s", args[0], args[1])
+		}
+	}
+
+	opts, err := copyOptions()
+	if err != nil {
+		stderr("copy: %v", err)
+		return 1
 	}
 
-	err := newACBuild().CopyToTarget(args[0], args[1])
+	err = newACBuild().CopyToTarget(args[0], args[1], opts)
 
 	if err != nil {
 		stderr("copy: %v", err)
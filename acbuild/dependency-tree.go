@@ -0,0 +1,177 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/lib"
+	"github.com/appc/acbuild/util"
+)
+
+var (
+	treeFormat string
+	cmdTreeDep = &cobra.Command{
+		Use:     "tree",
+		Short:   "Print the tree of dependencies",
+		Long:    "Resolves the dependencies of the ACI and of those, fetching them if needed, and prints every image's name, labels, image ID and size as text, JSON, or a Graphviz DOT graph",
+		Example: "acbuild dependency tree --format dot | dot -Tsvg > deps.svg",
+		Run:     runWrapper(runTreeDep),
+	}
+)
+
+func init() {
+	cmdDep.AddCommand(cmdTreeDep)
+
+	cmdTreeDep.Flags().StringVar(&treeFormat, "format", "text", "The format to print the tree in: text, json or dot")
+	cmdTreeDep.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http, and without verifying their signatures")
+}
+
+func runTreeDep(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("dependency tree: incorrect number of arguments")
+		return 1
+	}
+
+	var print func(io.Writer, *lib.DependencyNode) error
+	switch treeFormat {
+	case "text":
+		print = printTreeText
+	case "json":
+		print = printTreeJSON
+	case "dot":
+		print = printTreeDOT
+	default:
+		stderr("dependency tree: unknown format %q", treeFormat)
+		return 1
+	}
+
+	if debug {
+		stderr("Resolving dependencies")
+	}
+
+	root, err := newACBuild().DependencyTree(insecure)
+	if err != nil {
+		stderr("dependency tree: %v", err)
+		return getErrorCode(err)
+	}
+
+	err = print(os.Stdout, root)
+	if err != nil {
+		stderr("dependency tree: %v", err)
+		return 1
+	}
+
+	return 0
+}
+
+// formatImageName formats a name and labels the way image names are given to
+// acbuild, as name[:version][,label=value]...
+func formatImageName(name types.ACIdentifier, labels types.Labels) string {
+	s := string(name)
+	var others []string
+	for _, l := range labels {
+		if l.Name == "version" {
+			s += ":" + l.Value
+		} else {
+			others = append(others, string(l.Name)+"="+l.Value)
+		}
+	}
+	if len(others) != 0 {
+		s += "," + strings.Join(others, ",")
+	}
+	return s
+}
+
+// describeNode returns a one line description of an image in the tree.
+func describeNode(node *lib.DependencyNode) string {
+	desc := formatImageName(node.ImageName, node.Labels)
+	if node.ImageID != "" {
+		desc += " " + shortKey(node.ImageID)
+	}
+	if node.Size != 0 {
+		desc += " " + util.FormatSize(int64(node.Size))
+	}
+	if node.Duplicate {
+		desc += " (duplicate)"
+	}
+	return desc
+}
+
+func printTreeText(w io.Writer, root *lib.DependencyNode) error {
+	_, err := fmt.Fprintln(w, describeNode(root))
+	if err != nil {
+		return err
+	}
+	return printSubtreeText(w, root.Dependencies, "")
+}
+
+func printSubtreeText(w io.Writer, nodes []*lib.DependencyNode, indent string) error {
+	for i, node := range nodes {
+		branch, subindent := "|-- ", "|   "
+		if i == len(nodes)-1 {
+			branch, subindent = "`-- ", "    "
+		}
+		_, err := fmt.Fprintln(w, indent+branch+describeNode(node))
+		if err != nil {
+			return err
+		}
+		err = printSubtreeText(w, node.Dependencies, indent+subindent)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printTreeJSON(w io.Writer, root *lib.DependencyNode) error {
+	blob, err := json.MarshalIndent(root, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(blob))
+	return err
+}
+
+// printTreeDOT prints the tree as a graph, with one vertex per image, so that
+// duplicates show up as images with several incoming edges.
+func printTreeDOT(w io.Writer, root *lib.DependencyNode) error {
+	lines := []string{"digraph dependencies {"}
+	var add func(node *lib.DependencyNode, id string)
+	add = func(node *lib.DependencyNode, id string) {
+		label := formatImageName(node.ImageName, node.Labels)
+		if node.ImageID != "" {
+			label += "\n" + shortKey(node.ImageID)
+		}
+		if !node.Duplicate {
+			lines = append(lines, fmt.Sprintf("\t%q [label=%q];", id, label))
+		}
+		for _, dep := range node.Dependencies {
+			lines = append(lines, fmt.Sprintf("\t%q -> %q;", id, dep.ImageID))
+			add(dep, dep.ImageID)
+		}
+	}
+	add(root, string(root.ImageName))
+	lines = append(lines, "}")
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
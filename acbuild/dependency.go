@@ -46,16 +46,34 @@ var (
 		Example: "acbuild dependency remove example.com/reduce-worker-base",
 		Run:     runWrapper(runRmDep),
 	}
+	cmdLockDep = &cobra.Command{
+		Use:     "lock",
+		Short:   "Pin the dependencies to the images they resolve to",
+		Long:    "Sets the image ID and size of every dependency without an image ID to those of the image it currently resolves to, fetching it if needed",
+		Example: "acbuild dependency lock",
+		Run:     runWrapper(runLockDep),
+	}
+	cmdUpdateDep = &cobra.Command{
+		Use:     "update",
+		Short:   "Pin the dependencies to the latest matching images",
+		Long:    "Fetches the images matching every dependency again, pins the dependencies to them, and reports which ones changed",
+		Example: "acbuild dependency update",
+		Run:     runWrapper(runUpdateDep),
+	}
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdDep)
 	cmdDep.AddCommand(cmdAddDep)
 	cmdDep.AddCommand(cmdRmDep)
+	cmdDep.AddCommand(cmdLockDep)
+	cmdDep.AddCommand(cmdUpdateDep)
 
 	cmdAddDep.Flags().StringVar(&imageId, "image-id", "", "Content hash of the dependency")
 	cmdAddDep.Flags().Var(&labels, "label", "Labels used for dependency matching")
 	cmdAddDep.Flags().UintVar(&size, "size", 0, "The size of the image of the referenced dependency, in bytes")
+	cmdLockDep.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http, and without verifying their signatures")
+	cmdUpdateDep.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http, and without verifying their signatures")
 }
 
 func runAddDep(cmd *cobra.Command, args []string) (exit int) {
@@ -135,6 +153,65 @@ func runRmDep(cmd *cobra.Command, args []string) (exit int) {
 	return 0
 }
 
+func runLockDep(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("dependency lock: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Locking dependencies")
+	}
+
+	changes, err := newACBuild().LockDependencies(insecure)
+
+	if err != nil {
+		stderr("dependency lock: %v", err)
+		return getErrorCode(err)
+	}
+
+	for _, change := range changes {
+		if change.Changed() {
+			stdout("Locked %s to %s", change.ImageName, shortKey(change.ImageID.String()))
+		} else {
+			stdout("%s is already locked to %s", change.ImageName, shortKey(change.ImageID.String()))
+		}
+	}
+
+	return 0
+}
+
+func runUpdateDep(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("dependency update: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Updating dependencies")
+	}
+
+	changes, err := newACBuild().UpdateDependencies(insecure)
+
+	if err != nil {
+		stderr("dependency update: %v", err)
+		return getErrorCode(err)
+	}
+
+	for _, change := range changes {
+		switch {
+		case change.OldImageID == nil:
+			stdout("Locked %s to %s", change.ImageName, shortKey(change.ImageID.String()))
+		case change.Changed():
+			stdout("Updated %s from %s to %s", change.ImageName, shortKey(change.OldImageID.String()), shortKey(change.ImageID.String()))
+		default:
+			stdout("%s is up to date at %s", change.ImageName, shortKey(change.ImageID.String()))
+		}
+	}
+
+	return 0
+}
+
 type labellist []types.Label
 
 func (ls *labellist) String() string {
@@ -164,3 +241,7 @@ func (ls *labellist) Set(input string) error {
 func (ls *labellist) Type() string {
 	return "Labels"
 }
+
+func (ls *labellist) reset() {
+	*ls = nil
+}
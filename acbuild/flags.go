@@ -0,0 +1,100 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// stringList is a flag that can be given multiple times, collecting every
+// value it's given.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, " ")
+}
+
+func (sl *stringList) Set(input string) error {
+	*sl = append(*sl, input)
+	return nil
+}
+
+func (sl *stringList) Type() string {
+	return "strings"
+}
+
+func (sl *stringList) reset() {
+	*sl = nil
+}
+
+// resettableValue is implemented by the flag values that collect every value
+// they're given, and so can't be reset by setting them to their default.
+type resettableValue interface {
+	reset()
+}
+
+// resetFlags puts the flags of cmd back to their defaults. The flags of every
+// command are stored in package variables, so this is needed before running a
+// command more than once in the same process, like a script does.
+func resetFlags(cmd *cobra.Command) error {
+	var err error
+	cmd.NonInheritedFlags().VisitAll(func(f *pflag.Flag) {
+		if !f.Changed || err != nil {
+			return
+		}
+		if v, ok := f.Value.(resettableValue); ok {
+			v.reset()
+		} else {
+			err = f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+	return err
+}
+
+// saveFlags returns a function that puts the given flags back to the values
+// they have now.
+func saveFlags(flags *pflag.FlagSet) func() error {
+	type savedFlag struct {
+		flag    *pflag.Flag
+		value   string
+		changed bool
+	}
+	var saved []savedFlag
+	flags.VisitAll(func(f *pflag.Flag) {
+		saved = append(saved, savedFlag{f, f.Value.String(), f.Changed})
+	})
+	return func() error {
+		var err error
+		for _, s := range saved {
+			if v, ok := s.flag.Value.(resettableValue); ok {
+				v.reset()
+				if s.value != "" {
+					err1 := s.flag.Value.Set(s.value)
+					if err == nil {
+						err = err1
+					}
+				}
+			} else if err1 := s.flag.Value.Set(s.value); err == nil {
+				err = err1
+			}
+			s.flag.Changed = s.changed
+		}
+		return err
+	}
+}
@@ -42,7 +42,7 @@ func runReplaceMan(cmd *cobra.Command, args []string) (exit int) {
 	}
 
 	if debug {
-		stderr("Replacing manifest in ACI with the manifest at ", args[0])
+		stderr("Replacing manifest in ACI with the manifest at %s", args[0])
 	}
 
 	err := newACBuild().ReplaceManifest(args[0])
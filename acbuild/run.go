@@ -17,10 +17,14 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/appc/acbuild/engine"
 	"github.com/appc/acbuild/engine/chroot"
+	"github.com/appc/acbuild/engine/namespaces"
 	"github.com/appc/acbuild/engine/systemdnspawn"
+	"github.com/appc/acbuild/lib"
+	"github.com/appc/acbuild/util"
 
 	"github.com/spf13/cobra"
 )
@@ -29,6 +33,18 @@ var (
 	insecure   = false
 	workingdir = ""
 	engineName = ""
+	rootless   = false
+	layerCache = ""
+	runBinds   stringList
+	runCaches  stringList
+	runSecrets stringList
+	runNetwork = ""
+	runUser    = ""
+	runGroup   = ""
+	asAppUser  = false
+	runTimeout time.Duration
+	runMemory  = ""
+	runCPUs    float64
 	cmdRun     = &cobra.Command{
 		Use:     "run -- CMD [ARGS]",
 		Short:   "Run a command in an ACI",
@@ -40,6 +56,7 @@ var (
 	engines = map[string]engine.Engine{
 		"systemd-nspawn": systemdnspawn.Engine{},
 		"chroot":         chroot.Engine{},
+		"namespaces":     namespaces.Engine{},
 	}
 )
 
@@ -55,6 +72,18 @@ func init() {
 	cmdRun.Flags().BoolVar(&insecure, "insecure", false, "Allows fetching dependencies over http")
 	cmdRun.Flags().StringVar(&workingdir, "working-dir", "", "The working directory inside the container for this command")
 	cmdRun.Flags().StringVar(&engineName, "engine", "systemd-nspawn", "The engine used to run the command. Supported engines: "+engineList)
+	cmdRun.Flags().StringVar(&layerCache, "layer-cache", "", "Directory to cache the results of run commands in, and reuse them from when nothing has changed")
+	cmdRun.Flags().Var(&runBinds, "bind", "Bind mount a host path into the container while the command runs, as HOST_PATH:CONTAINER_PATH[:ro] (can be given more than once)")
+	cmdRun.Flags().Var(&runCaches, "cache", "Mount a named cache directory that persists between runs, as NAME:CONTAINER_PATH. Without --shared-store, end removes it with the build (can be given more than once)")
+	cmdRun.Flags().Var(&runSecrets, "secret", "Mount a secret file from a tmpfs while the command runs, as id=NAME,src=FILE[,target=PATH] (can be given more than once)")
+	cmdRun.Flags().StringVar(&runNetwork, "net", string(engine.NetworkHost), "The network the command is run with: host, none (no network at all) or loopback (only a loopback interface)")
+	cmdRun.Flags().StringVar(&runUser, "user", "", "The user to run the command as, as a name or uid in the ACI")
+	cmdRun.Flags().StringVar(&runGroup, "group", "", "The group to run the command as, as a name or gid in the ACI (defaults to the user's primary group)")
+	cmdRun.Flags().BoolVar(&asAppUser, "as-app-user", false, "Run the command as the user and group set with set-user and set-group")
+	cmdRun.Flags().DurationVar(&runTimeout, "timeout", 0, "Kill the command and every process it started if it runs for longer than this, like 10m")
+	cmdRun.Flags().StringVar(&runMemory, "memory", "", "The memory the command can use, in bytes or with a K, M, G or T suffix")
+	cmdRun.Flags().Float64Var(&runCPUs, "cpus", 0, "The number of CPUs worth of time the command can use, like 1.5")
+	cmdRun.Flags().BoolVar(&rootless, "rootless", false, "Run the command in a user namespace, so root isn't required (implies --engine=namespaces)")
 }
 
 func runRun(cmd *cobra.Command, args []string) (exit int) {
@@ -67,13 +96,98 @@ func runRun(cmd *cobra.Command, args []string) (exit int) {
 		stderr("Running: %v", args)
 	}
 
-	engine, ok := engines[engineName]
+	if rootless && !cmd.Flags().Changed("engine") {
+		engineName = "namespaces"
+	}
+
+	runEngine, ok := engines[engineName]
 	if !ok {
 		stderr("run: no such engine %q", engineName)
 		return 1
 	}
 
-	err := newACBuild().Run(args, workingdir, insecure, engine)
+	if rootless {
+		nsEngine, ok := runEngine.(namespaces.Engine)
+		if !ok {
+			stderr("run: --rootless is only supported by the namespaces engine")
+			return 1
+		}
+		nsEngine.UserNamespace = true
+		runEngine = nsEngine
+	}
+
+	// A script can set the network of the runs that don't choose their own
+	if !cmd.Flags().Changed("net") && scriptNetwork != "" {
+		runNetwork = scriptNetwork
+	}
+	network, err := engine.ParseNetwork(runNetwork)
+	if err != nil {
+		stderr("run: %v", err)
+		return 1
+	}
+	runEngine, err = runEngine.WithNetwork(network)
+	if err != nil {
+		stderr("run: %v", err)
+		return 1
+	}
+
+	if asAppUser && (runUser != "" || runGroup != "") {
+		stderr("run: --as-app-user can't be used with --user or --group")
+		return 1
+	}
+
+	if runTimeout < 0 || runCPUs < 0 {
+		stderr("run: --timeout and --cpus can't be negative")
+		return 1
+	}
+	if runCPUs != 0 && runCPUs < engine.MinCPUs {
+		stderr("run: --cpus can't be less than %g", engine.MinCPUs)
+		return 1
+	}
+
+	opts := lib.RunOptions{
+		User:      runUser,
+		Group:     runGroup,
+		AsAppUser: asAppUser,
+		Timeout:   runTimeout,
+		Limits:    engine.Limits{CPUs: runCPUs},
+	}
+	if runMemory != "" {
+		memory, err := util.ParseSize(runMemory)
+		if err != nil {
+			stderr("run: %v", err)
+			return 1
+		}
+		opts.Limits.Memory = memory
+	}
+	for _, b := range runBinds {
+		m, err := engine.ParseMount(b)
+		if err != nil {
+			stderr("run: %v", err)
+			return 1
+		}
+		opts.Mounts = append(opts.Mounts, m)
+	}
+	for _, c := range runCaches {
+		cache, err := lib.ParseCacheMount(c)
+		if err != nil {
+			stderr("run: %v", err)
+			return 1
+		}
+		opts.Caches = append(opts.Caches, cache)
+	}
+	for _, s := range runSecrets {
+		secret, err := lib.ParseSecret(s)
+		if err != nil {
+			stderr("run: %v", err)
+			return 1
+		}
+		opts.Secrets = append(opts.Secrets, secret)
+	}
+
+	a := newACBuild()
+	a.LayerCachePath = layerCache
+	err = a.Run(args, workingdir, insecure, runEngine, opts)
 
 	if err != nil {
 		stderr("run: %v", err)
@@ -19,30 +19,142 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/exec"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/spf13/cobra"
-)
 
-const (
-	nestedScriptEnvVar = "ACBUILD_NESTED_SCRIPT"
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/acbuild/lib"
 )
 
 var (
 	errSingleQuote = fmt.Errorf("unterminated single quote block")
 	errDoubleQuote = fmt.Errorf("unterminated double quote block")
 	errEscape      = fmt.Errorf("ended with an escape")
+	errVariable    = fmt.Errorf("unterminated variable reference")
+	scriptArgs     stringList
+	scriptNet      = ""
 	cmdScript      = &cobra.Command{
 		Use:     "script SCRIPT_FILE",
 		Short:   "Runs an acbuild script",
-		Example: "acbuild script build-myapp.acb",
+		Example: "acbuild script --arg VERSION=1.2 build-myapp.acb",
 		Run:     runWrapper(runScript),
 	}
+
+	variableNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+	// inScript is set while a script is running, so that the scripts it
+	// calls run in the same build
+	inScript bool
+
+	// scriptNetwork is the network used by the runs in the running script
+	// that don't pass --net
+	scriptNetwork string
+
+	// scriptACBuild holds the lock on the build of the running script, and
+	// is copied by newACBuild so that every command in the script shares it
+	scriptACBuild *lib.ACBuild
 )
 
 func init() {
 	cmdAcbuild.AddCommand(cmdScript)
+
+	cmdScript.Flags().Var(&scriptArgs, "arg", "Build argument to pass to the script, in the format NAME=VALUE")
+	cmdScript.Flags().StringVar(&scriptNet, "net", "", "The network used by every run in the script that doesn't pass --net: host, none or loopback")
+}
+
+// scriptVariables holds the variables that can be referenced from a script.
+type scriptVariables struct {
+	// values maps the name of every defined variable to its value
+	values map[string]string
+	// args holds the build arguments given on the command line, which
+	// override the defaults of the script's arg directives
+	args map[string]string
+	// usedArgs records which build arguments were declared by the script
+	usedArgs map[string]bool
+}
+
+func newScriptVariables(args []string) (*scriptVariables, error) {
+	vars := &scriptVariables{
+		values:   make(map[string]string),
+		args:     make(map[string]string),
+		usedArgs: make(map[string]bool),
+	}
+	for _, arg := range args {
+		parts := strings.SplitN(arg, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("build argument %q must be in the format NAME=VALUE", arg)
+		}
+		if !variableNameRegexp.MatchString(parts[0]) {
+			return nil, fmt.Errorf("invalid build argument name %q", parts[0])
+		}
+		vars.args[parts[0]] = parts[1]
+	}
+	return vars, nil
+}
+
+// define handles the set and arg directives, returning whether tokens was one.
+// Both take a variable name and an optional value, but a value given on the
+// command line takes precedence over the value of an arg directive.
+func (v *scriptVariables) define(tokens []string) (bool, error) {
+	directive := strings.ToLower(tokens[0])
+	if directive != "set" && directive != "arg" {
+		return false, nil
+	}
+	if len(tokens) < 2 || len(tokens) > 3 {
+		return true, fmt.Errorf("%s: expected a variable name and an optional value", directive)
+	}
+	name := tokens[1]
+	if !variableNameRegexp.MatchString(name) {
+		return true, fmt.Errorf("%s: invalid variable name %q", directive, name)
+	}
+
+	var value string
+	if len(tokens) == 3 {
+		value = tokens[2]
+	}
+	if directive == "arg" {
+		v.usedArgs[name] = true
+		if arg, ok := v.args[name]; ok {
+			value = arg
+		} else if len(tokens) == 2 {
+			return true, fmt.Errorf("arg: no value given for build argument %s", name)
+		}
+	}
+	v.values[name] = value
+	return true, nil
+}
+
+// copy returns a copy of v, which variables can be defined in without changing
+// v.
+func (v *scriptVariables) copy() *scriptVariables {
+	c := &scriptVariables{
+		values:   make(map[string]string),
+		args:     v.args,
+		usedArgs: make(map[string]bool),
+	}
+	for name, value := range v.values {
+		c.values[name] = value
+	}
+	for name := range v.usedArgs {
+		c.usedArgs[name] = true
+	}
+	return c
+}
+
+// unusedArgs returns the build arguments that were given on the command line
+// but never declared by the script.
+func (v *scriptVariables) unusedArgs() []string {
+	var unused []string
+	for name := range v.args {
+		if !v.usedArgs[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Strings(unused)
+	return unused
 }
 
 func runScript(cmd *cobra.Command, args []string) (exit int) {
@@ -62,7 +174,26 @@ func runScript(cmd *cobra.Command, args []string) (exit int) {
 		stderr("Running script from %s", scriptName)
 	}
 
-	err = execScript(rawScript)
+	vars, err := newScriptVariables(scriptArgs)
+	if err != nil {
+		stderr("script: %v", err)
+		return 1
+	}
+
+	if cmd.Flags().Changed("net") {
+		if _, err := engine.ParseNetwork(scriptNet); err != nil {
+			stderr("script: %v", err)
+			return 1
+		}
+		// A nested script's default only applies to its own lines
+		savedNetwork := scriptNetwork
+		scriptNetwork = scriptNet
+		defer func() {
+			scriptNetwork = savedNetwork
+		}()
+	}
+
+	err = execScript(rawScript, vars)
 	if err != nil {
 		stderr("script: %v", err)
 		return getErrorCode(err)
@@ -70,38 +201,50 @@ func runScript(cmd *cobra.Command, args []string) (exit int) {
 	return 0
 }
 
-func execScript(rawScript []byte) error {
+func execScript(rawScript []byte, vars *scriptVariables) error {
 	script := strings.Split(string(rawScript), "\n")
 	for i, s := range script {
-		s = strings.TrimSpace(s)
-		script[i] = s
-
-		if strings.HasPrefix(strings.ToLower(s), "run") && os.Geteuid() != 0 {
-			return fmt.Errorf("scripts using the run subcommand must be run as root")
-		}
+		script[i] = strings.TrimSpace(s)
 	}
 	script = joinLines(script)
+	if os.Geteuid() != 0 {
+		// The variables are defined as the script goes, on a copy, so
+		// that flags given through them are seen
+		checkVars := vars.copy()
+		for _, s := range script {
+			if strings.HasPrefix(strings.ToLower(s), "run") && !isRootlessRun(s, checkVars.values) {
+				return fmt.Errorf("scripts using the run subcommand must be run as root, or use run --rootless")
+			}
+			if tokens, err := tokenizeLine(s, checkVars.values); err == nil && len(tokens) != 0 {
+				checkVars.define(tokens)
+			}
+		}
+	}
 
-	var tmpDir string
-	nestedScript := false
-	if inheritedPath := os.Getenv(nestedScriptEnvVar); inheritedPath != "" {
-		tmpDir = inheritedPath
-		nestedScript = true
-	} else {
-		var err error
-		tmpDir, err = ioutil.TempDir("", "acbuild")
+	// Nested scripts run in the build of the script that called them
+	nestedScript := inScript
+	if !nestedScript {
+		tmpDir, err := ioutil.TempDir("", "acbuild")
 		if err != nil {
 			return err
 		}
 		defer os.RemoveAll(tmpDir)
 		contextpath = tmpDir
+		inScript = true
+		defer func() {
+			inScript = false
+			err := updateScriptLock()
+			if err != nil {
+				stderr("script: %v", err)
+			}
+		}()
 	}
 
 	for _, line := range script {
 		if line == "" {
 			continue
 		}
-		err := execACBuild(tmpDir, line)
+		err := execScriptLine(line, vars)
 		if err != nil {
 			if !strings.HasPrefix(line, "begin") && !nestedScript {
 				err1 := newACBuild().End()
@@ -118,6 +261,9 @@ func execScript(rawScript []byte) error {
 			return err
 		}
 	}
+	for _, name := range vars.unusedArgs() {
+		stderr("warning: build argument %s was not declared by the script", name)
+	}
 	if debug {
 		stderr("Script has been completed")
 	}
@@ -125,29 +271,104 @@ func execScript(rawScript []byte) error {
 	return nil
 }
 
-func execACBuild(workPath, line string) error {
-	suppliedArgs, err := tokenizeLine(line)
+// execScriptLine runs the acbuild command on the given line of a script, after
+// expanding the variables in it, or defines a variable if it's a set or arg
+// directive.
+func execScriptLine(line string, vars *scriptVariables) error {
+	suppliedArgs, err := tokenizeLine(line, vars.values)
 	if err != nil {
 		return err
 	}
 	if len(suppliedArgs) == 0 {
 		return nil
 	}
+	if isDirective, err := vars.define(suppliedArgs); isDirective {
+		return err
+	}
+	err = updateScriptLock()
+	if err != nil {
+		return err
+	}
+	return execACBuild(suppliedArgs)
+}
+
+// execACBuild runs the acbuild command given by suppliedArgs in this process,
+// in the same way as if it had been given on the command line with --debug.
+func execACBuild(suppliedArgs []string) error {
 	suppliedArgs[0] = strings.ToLower(suppliedArgs[0])
 	if suppliedArgs[0] == "run" || suppliedArgs[0] == "set-exec" {
 		suppliedArgs = insertRunTacks(suppliedArgs)
 	}
-	args := []string{"--debug", "--work-path=" + workPath}
-	args = append(args, suppliedArgs...)
-	cmd := exec.Command(os.Args[0], args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Env = os.Environ()
-	if suppliedArgs[0] == "script" {
-		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", nestedScriptEnvVar, workPath))
-	}
-	return cmd.Run()
+
+	// The global flags are shared by every command in the script, so put
+	// them back to what the script was given once this one is done
+	restoreGlobalFlags := saveFlags(cmdAcbuild.PersistentFlags())
+	defer restoreGlobalFlags()
+	debug = true
+
+	// Flag variables can also be shared between commands, so they're reset
+	// both before and after the command runs
+	cmd, _, err := cmdAcbuild.Find(suppliedArgs)
+	if err == nil {
+		err = resetFlags(cmd)
+		if err != nil {
+			return err
+		}
+		defer resetFlags(cmd)
+	}
+
+	cmdExitCode = 0
+	cmdAcbuild.SetArgs(suppliedArgs)
+	err = cmdAcbuild.Execute()
+	if cmdExitCode == 0 && err != nil {
+		cmdExitCode = getErrorCode(errCobra)
+	}
+	if cmdExitCode != 0 {
+		return exitCodeError(cmdExitCode)
+	}
+	return nil
+}
+
+// updateScriptLock takes the lock on the script's build once the build has
+// begun, and releases it once the build has ended, so that it's held for as
+// long as the build is in progress rather than once for every command.
+func updateScriptLock() error {
+	a := lib.NewACBuild(contextpath, debug)
+	_, err := os.Stat(a.ContextPath)
+	inProgress := err == nil
+
+	switch {
+	case inProgress && scriptACBuild == nil:
+		err := a.Lock()
+		if err != nil {
+			return err
+		}
+		scriptACBuild = a
+	case !inProgress && scriptACBuild != nil:
+		err := scriptACBuild.Unlock()
+		scriptACBuild = nil
+		return err
+	}
+	return nil
+}
+
+// isRootlessRun returns whether the given run line passes the --rootless flag
+// to acbuild, and so doesn't require root, once the variables in vars are
+// expanded.
+func isRootlessRun(line string, vars map[string]string) bool {
+	tokens, err := tokenizeLine(line, vars)
+	if err != nil {
+		return false
+	}
+	for _, tok := range tokens[1:] {
+		if tok == "--" || tok[0] != '-' {
+			break
+		}
+		if tok == "--rootless" || tok == "--rootless=true" {
+			return true
+		}
+	}
+	return false
 }
 
 func joinLines(script []string) []string {
@@ -161,14 +382,23 @@ func joinLines(script []string) []string {
 	return script
 }
 
-func tokenizeLine(line string) ([]string, error) {
+// tokenizeLine splits line into tokens, in the same way as a shell would.
+// References to the variables in vars, written as ${NAME}, are expanded in
+// everything but single quoted strings. If vars is nil, references are left
+// as they are. Quotes and references make a token even if they leave it
+// empty, so that a variable set to nothing is still passed on.
+func tokenizeLine(line string, vars map[string]string) ([]string, error) {
 	var tokens []string
 	buf := &bytes.Buffer{}
 	inSingleQuoteBlock := false
 	inDoubleQuoteBlock := false
 	isEscaped := false
+	// inToken is whether a token has been started, even if it's empty
+	inToken := false
+	chars := []rune(line)
 lineLoop:
-	for _, char := range line {
+	for i := 0; i < len(chars); i++ {
+		char := chars[i]
 		if isEscaped {
 			buf.WriteRune(char)
 			isEscaped = false
@@ -177,23 +407,41 @@ lineLoop:
 		switch {
 		case char == '\\':
 			isEscaped = true
+			inToken = true
 		case (char == ' ' || char == '	') && !inSingleQuoteBlock && !inDoubleQuoteBlock:
-			if buf.Len() > 0 {
+			if inToken {
 				tokens = append(tokens, buf.String())
 				buf.Reset()
+				inToken = false
 			}
 		case char == '\'' && !inDoubleQuoteBlock:
 			inSingleQuoteBlock = !inSingleQuoteBlock
+			inToken = true
 		case char == '"' && !inSingleQuoteBlock:
 			inDoubleQuoteBlock = !inDoubleQuoteBlock
+			inToken = true
 		case char == '#' && !inSingleQuoteBlock && !inDoubleQuoteBlock:
-			if buf.Len() > 0 {
+			if inToken {
 				tokens = append(tokens, buf.String())
 				buf.Reset()
 			}
 			break lineLoop
+		case char == '$' && vars != nil && !inSingleQuoteBlock && i+1 < len(chars) && chars[i+1] == '{':
+			end := strings.IndexRune(string(chars[i+2:]), '}')
+			if end == -1 {
+				return nil, errVariable
+			}
+			name := string(chars[i+2:])[:end]
+			value, ok := vars[name]
+			if !ok {
+				return nil, fmt.Errorf("undefined variable %q", name)
+			}
+			buf.WriteString(value)
+			inToken = true
+			i += 2 + len([]rune(name))
 		default:
 			buf.WriteRune(char)
+			inToken = true
 		}
 	}
 	if inSingleQuoteBlock {
@@ -205,7 +453,7 @@ lineLoop:
 	if isEscaped {
 		return nil, errEscape
 	}
-	if buf.Len() > 0 {
+	if inToken {
 		tokens = append(tokens, buf.String())
 	}
 	return tokens, nil
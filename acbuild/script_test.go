@@ -237,7 +237,7 @@ func TestTokenizeLine(t *testing.T) {
 	}
 
 	for _, c := range cases {
-		output, err := tokenizeLine(c.input)
+		output, err := tokenizeLine(c.input, nil)
 		if err != c.err {
 			t.Errorf("error, expected:%v actual:%v", c.err, err)
 		}
@@ -247,6 +247,130 @@ func TestTokenizeLine(t *testing.T) {
 	}
 }
 
+func TestTokenizeLineVariables(t *testing.T) {
+	type testcase struct {
+		input  string
+		output []string
+		err    bool
+	}
+	vars := map[string]string{
+		"NAME":    "example.com/app",
+		"VERSION": "1.2",
+		"SPACES":  "a b",
+		"EMPTY":   "",
+	}
+	cases := []testcase{
+		testcase{
+			"set-name ${NAME}",
+			[]string{"set-name", "example.com/app"},
+			false,
+		},
+		testcase{
+			"label add version v${VERSION}-1",
+			[]string{"label", "add", "version", "v1.2-1"},
+			false,
+		},
+		testcase{
+			`annotation add a "${SPACES}" ${SPACES}`,
+			[]string{"annotation", "add", "a", "a b", "a b"},
+			false,
+		},
+		testcase{
+			`set-name '${NAME}'`,
+			[]string{"set-name", "${NAME}"},
+			false,
+		},
+		testcase{
+			`set-name \${NAME}`,
+			[]string{"set-name", "${NAME}"},
+			false,
+		},
+		testcase{
+			"run -- echo $NAME $",
+			[]string{"run", "--", "echo", "$NAME", "$"},
+			false,
+		},
+		testcase{
+			`annotation add a ${EMPTY} "${EMPTY}" ''`,
+			[]string{"annotation", "add", "a", "", "", ""},
+			false,
+		},
+		testcase{
+			"label add a${EMPTY} b",
+			[]string{"label", "add", "a", "b"},
+			false,
+		},
+		testcase{
+			"set-name ${MISSING}",
+			nil,
+			true,
+		},
+		testcase{
+			"set-name ${NAME",
+			nil,
+			true,
+		},
+	}
+	for _, c := range cases {
+		output, err := tokenizeLine(c.input, vars)
+		if (err != nil) != c.err {
+			t.Errorf("error for %q, expected:%v actual:%v", c.input, c.err, err)
+		}
+		if !equal(output, c.output) {
+			t.Errorf("output, expected:%v actual:%v", c.output, output)
+		}
+	}
+}
+
+func TestScriptVariables(t *testing.T) {
+	vars, err := newScriptVariables([]string{"VERSION=2.0", "UNUSED=x"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := [][]string{
+		{"arg", "VERSION", "1.0"},
+		{"ARG", "ARCH", "amd64"},
+		{"set", "NAME", "example.com/app"},
+		{"set", "EMPTY"},
+	}
+	for _, line := range lines {
+		isDirective, err := vars.define(line)
+		if !isDirective || err != nil {
+			t.Fatalf("define %v, expected a directive, got:%v %v", line, isDirective, err)
+		}
+	}
+	expected := map[string]string{
+		"VERSION": "2.0",
+		"ARCH":    "amd64",
+		"NAME":    "example.com/app",
+		"EMPTY":   "",
+	}
+	for name, value := range expected {
+		if vars.values[name] != value {
+			t.Errorf("variable %s, expected:%q actual:%q", name, value, vars.values[name])
+		}
+	}
+	if unused := vars.unusedArgs(); !equal(unused, []string{"UNUSED"}) {
+		t.Errorf("unused args, expected:%v actual:%v", []string{"UNUSED"}, unused)
+	}
+
+	if isDirective, _ := vars.define([]string{"set-name", "foo"}); isDirective {
+		t.Errorf("set-name was treated as a directive")
+	}
+	for _, line := range [][]string{
+		{"set", "1BAD", "x"},
+		{"set", "A", "b", "c"},
+		{"arg", "REQUIRED"},
+	} {
+		if _, err := vars.define(line); err == nil {
+			t.Errorf("define %v, expected an error", line)
+		}
+	}
+	if _, err := newScriptVariables([]string{"NOVALUE"}); err == nil {
+		t.Errorf("expected an error for a build argument without a value")
+	}
+}
+
 func TestInsertRunTacks(t *testing.T) {
 	type testcase struct {
 		input  []string
@@ -286,6 +410,32 @@ func TestInsertRunTacks(t *testing.T) {
 	}
 }
 
+func TestIsRootlessRun(t *testing.T) {
+	type testcase struct {
+		input  string
+		output bool
+	}
+	cases := []testcase{
+		testcase{"run -- apt-get update", false},
+		testcase{"run --rootless -- apt-get update", true},
+		testcase{"run --engine=namespaces --rootless apt-get update", true},
+		testcase{"run --rootless=true -- apt-get update", true},
+		testcase{"run apt-get --rootless", false},
+		testcase{"run -- apt-get --rootless", false},
+		testcase{"run --rootless 'unterminated", false},
+		testcase{"run ${FLAGS} -- apt-get update", true},
+		testcase{"run ${NET} -- apt-get update", false},
+		testcase{"run ${UNDEFINED} -- apt-get update", false},
+	}
+	vars := map[string]string{"FLAGS": "--rootless", "NET": "--net=none"}
+	for _, c := range cases {
+		output := isRootlessRun(c.input, vars)
+		if output != c.output {
+			t.Errorf("output for %q, expected:%v actual:%v", c.input, c.output, output)
+		}
+	}
+}
+
 // no really guys, this language is _great_
 func equal(s1 []string, s2 []string) bool {
 	if len(s1) != len(s2) {
@@ -298,3 +448,21 @@ func equal(s1 []string, s2 []string) bool {
 	}
 	return true
 }
+
+func TestExecACBuildFlags(t *testing.T) {
+	savedSharedStore, savedFetchConcurrency := sharedStore, fetchConcurrency
+
+	err := execACBuild([]string{"--shared-store", "--fetch-concurrency", "7", "--no-history", "version"})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if sharedStore != savedSharedStore || fetchConcurrency != savedFetchConcurrency || disableHistory {
+		t.Errorf("the global flags of a line weren't reset: --shared-store %v, --fetch-concurrency %d, --no-history %v",
+			sharedStore, fetchConcurrency, disableHistory)
+	}
+	for _, name := range []string{"shared-store", "fetch-concurrency", "no-history"} {
+		if cmdAcbuild.PersistentFlags().Lookup(name).Changed {
+			t.Errorf("--%s is still marked as given", name)
+		}
+	}
+}
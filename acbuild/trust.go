@@ -0,0 +1,149 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	trustPrefix string
+	trustRoot   bool
+	cmdTrust    = &cobra.Command{
+		Use:   "trust [command]",
+		Short: "Manage the keys trusted to sign fetched images",
+	}
+	cmdTrustAdd = &cobra.Command{
+		Use:     "add PUBKEY_FILE",
+		Short:   "Trust a public key",
+		Long:    "Adds the ASCII armored public key to the trust store, trusting it to sign images whose names start with the given prefix",
+		Example: "acbuild trust add --prefix example.com/myapp pubkeys.gpg",
+		Run:     runWrapper(runTrustAdd),
+	}
+	cmdTrustRm = &cobra.Command{
+		Use:     "remove FINGERPRINT",
+		Aliases: []string{"rm"},
+		Short:   "Stop trusting a public key",
+		Long:    "Removes the key with the given fingerprint from the trust store",
+		Example: "acbuild trust remove BFF313CDAA560B16A8987B8F72ABF5F6799D33BC",
+		Run:     runWrapper(runTrustRm),
+	}
+	cmdTrustList = &cobra.Command{
+		Use:     "list",
+		Aliases: []string{"ls"},
+		Short:   "List the trusted public keys",
+		Example: "acbuild trust list",
+		Run:     runWrapper(runTrustList),
+	}
+)
+
+func init() {
+	cmdAcbuild.AddCommand(cmdTrust)
+	cmdTrust.AddCommand(cmdTrustAdd)
+	cmdTrust.AddCommand(cmdTrustRm)
+	cmdTrust.AddCommand(cmdTrustList)
+
+	cmdTrustAdd.Flags().StringVar(&trustPrefix, "prefix", "", "Image name prefix the key is trusted for")
+	cmdTrustAdd.Flags().BoolVar(&trustRoot, "root", false, "Trust the key for all images")
+}
+
+func runTrustAdd(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("trust add: incorrect number of arguments")
+		return 1
+	}
+	if (trustPrefix == "") == !trustRoot {
+		stderr("trust add: exactly one of --prefix and --root must be given")
+		return 1
+	}
+
+	if debug {
+		stderr("Trusting key %s", args[0])
+	}
+
+	fingerprint, err := newACBuild().TrustKey(trustPrefix, args[0])
+
+	if err != nil {
+		stderr("trust add: %v", err)
+		return getErrorCode(err)
+	}
+
+	if trustRoot {
+		stdout("Added root key %s", fingerprint)
+	} else {
+		stdout("Added key %s for prefix %s", fingerprint, trustPrefix)
+	}
+
+	return 0
+}
+
+func runTrustRm(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) == 0 {
+		cmd.Usage()
+		return 1
+	}
+	if len(args) != 1 {
+		stderr("trust remove: incorrect number of arguments")
+		return 1
+	}
+
+	if debug {
+		stderr("Removing key %s", args[0])
+	}
+
+	err := newACBuild().UntrustKey(args[0])
+
+	if err != nil {
+		stderr("trust remove: %v", err)
+		return getErrorCode(err)
+	}
+
+	return 0
+}
+
+func runTrustList(cmd *cobra.Command, args []string) (exit int) {
+	if len(args) != 0 {
+		stderr("trust list: incorrect number of arguments")
+		return 1
+	}
+
+	keys, err := newACBuild().TrustedKeys()
+
+	if err != nil {
+		stderr("trust list: %v", err)
+		return getErrorCode(err)
+	}
+
+	tabOut := new(tabwriter.Writer)
+	tabOut.Init(os.Stdout, 0, 8, 1, '\t', 0)
+	tabOut.Write([]byte("PREFIX\tFINGERPRINT\n"))
+	for _, key := range keys {
+		prefix := key.Prefix
+		if prefix == "" {
+			prefix = "*"
+		}
+		tabOut.Write([]byte(prefix + "\t" + key.Fingerprint + "\n"))
+	}
+	tabOut.Flush()
+
+	return 0
+}
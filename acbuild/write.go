@@ -15,16 +15,26 @@
 package main
 
 import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
 	"github.com/spf13/cobra"
 )
 
 var (
-	overwrite = false
-	sign      = false
-	cmdWrite  = &cobra.Command{
+	overwrite   = false
+	sign        = false
+	squash      = false
+	writeFormat = "aci"
+
+	reproducible    = false
+	sourceDateEpoch int64
+	cmdWrite        = &cobra.Command{
 		Use:     "write ACI_PATH",
 		Short:   "Write the ACI to a file",
-		Long:    "Writes the ACI resulting from the current build context to a file",
+		Long:    "Writes the ACI resulting from the current build context to a file, or to an OCI image layout or runtime bundle",
 		Example: "acbuild write --sign mynewapp.aci -- --no-default-keyring --keyring ./rkt.gpg",
 		Run:     runWrapper(runWrite),
 	}
@@ -35,6 +45,33 @@ func init() {
 
 	cmdWrite.Flags().BoolVar(&overwrite, "overwrite", false, "overwrite the resulting ACI")
 	cmdWrite.Flags().BoolVar(&sign, "sign", false, "sign the resulting ACI")
+	cmdWrite.Flags().BoolVar(&squash, "squash", false, "merge the dependencies into the resulting ACI, and remove them from its manifest")
+	cmdWrite.Flags().BoolVar(&insecure, "insecure", false, "allows fetching dependencies over http, and without verifying their signatures, when squashing")
+	cmdWrite.Flags().StringVar(&writeFormat, "format", "aci", "format to write the image in: aci, oci or oci-bundle")
+	cmdWrite.Flags().BoolVar(&reproducible, "reproducible", false, "write the same image every time the same build is written")
+	cmdWrite.Flags().Int64Var(&sourceDateEpoch, "source-date-epoch", 0, "timestamp to clamp the times in a reproducible image to, in seconds since the epoch (defaults to $SOURCE_DATE_EPOCH, or 0)")
+}
+
+// getSourceDateEpoch returns the time written images should be reproducible
+// at, or nil if they needn't be reproducible. Setting either --source-date-epoch
+// or $SOURCE_DATE_EPOCH implies --reproducible.
+func getSourceDateEpoch(cmd *cobra.Command) (*time.Time, error) {
+	epoch := sourceDateEpoch
+	if !cmd.Flags().Changed("source-date-epoch") {
+		env := os.Getenv("SOURCE_DATE_EPOCH")
+		if env == "" && !reproducible {
+			return nil, nil
+		}
+		if env != "" {
+			var err error
+			epoch, err = strconv.ParseInt(env, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid $SOURCE_DATE_EPOCH %q", env)
+			}
+		}
+	}
+	t := time.Unix(epoch, 0).UTC()
+	return &t, nil
 }
 
 func runWrite(cmd *cobra.Command, args []string) (exit int) {
@@ -43,11 +80,41 @@ func runWrite(cmd *cobra.Command, args []string) (exit int) {
 		return 1
 	}
 
+	if sign && writeFormat != "aci" {
+		stderr("write: only ACIs can be signed")
+		return 1
+	}
+	if squash && writeFormat != "aci" {
+		stderr("write: only ACIs can be squashed")
+		return 1
+	}
+
 	if debug {
-		stderr("Writing ACI to %s", args[0])
+		stderr("Writing %s to %s", writeFormat, args[0])
+	}
+
+	a := newACBuild()
+	epoch, err := getSourceDateEpoch(cmd)
+	if err != nil {
+		stderr("write: %v", err)
+		return 1
 	}
+	a.SourceDateEpoch = epoch
 
-	err := newACBuild().Write(args[0], overwrite, sign, args[1:])
+	switch writeFormat {
+	case "aci":
+		if squash {
+			err = a.WriteSquashed(args[0], overwrite, sign, insecure, args[1:])
+		} else {
+			err = a.Write(args[0], overwrite, sign, args[1:])
+		}
+	case "oci":
+		err = a.WriteOCI(args[0], overwrite)
+	case "oci-bundle":
+		err = a.WriteOCIBundle(args[0], overwrite)
+	default:
+		err = fmt.Errorf("unknown format %q", writeFormat)
+	}
 
 	if err != nil {
 		stderr("write: %v", err)
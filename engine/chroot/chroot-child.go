@@ -16,6 +16,7 @@ package chroot
 
 import (
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"runtime"
@@ -23,6 +24,8 @@ import (
 	"syscall"
 
 	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/engine"
 )
 
 func init() {
@@ -31,6 +34,10 @@ func init() {
 	cmdACBuildChroot.PersistentFlags().StringSliceVar(&flagEnv, "env", nil, "environment for the command")
 	cmdACBuildChroot.PersistentFlags().StringVar(&flagChroot, "chroot", "", "dir to chroot into")
 	cmdACBuildChroot.PersistentFlags().StringVar(&flagWorkingDir, "working-dir", "", "working directory for the command")
+	cmdACBuildChroot.PersistentFlags().StringVar(&flagNet, "net", "", "network to run the command with, none or loopback, instead of the host's")
+	cmdACBuildChroot.PersistentFlags().StringVar(&flagUser, "user", "", "user to run the command as, as UID:GID[:GIDS]")
+	cmdACBuildChroot.PersistentFlags().Var(&flagBinds, "bind", "host path to bind mount into the chroot, as HOST_PATH:CONTAINER_PATH[:ro]")
+	cmdACBuildChroot.PersistentFlags().BoolVar(&flagWait, "wait", false, "wait for fd 3 to be closed before starting")
 }
 
 var (
@@ -39,6 +46,10 @@ var (
 	flagEnv          []string
 	flagChroot       string
 	flagWorkingDir   string
+	flagNet          string
+	flagBinds        engine.MountList
+	flagUser         string
+	flagWait         bool
 	cmdACBuildChroot = &cobra.Command{
 		Use: "",
 		Run: runChroot,
@@ -57,6 +68,29 @@ func errAndExit(format string, a ...interface{}) {
 
 func runChroot(cmd *cobra.Command, args []string) {
 	runtime.LockOSThread()
+	if flagWait {
+		// The parent closes its end of the pipe once this process has
+		// been moved to the cgroup that limits the command
+		syncPipe := os.NewFile(3, "sync")
+		_, err := ioutil.ReadAll(syncPipe)
+		if err != nil {
+			errAndExit("couldn't wait for the cgroup: %v", err)
+		}
+		syncPipe.Close()
+	}
+	if flagNet != "" {
+		err := unshareNetwork(engine.Network(flagNet))
+		if err != nil {
+			errAndExit("couldn't set up the network: %v", err)
+		}
+	}
+	if len(flagBinds) != 0 {
+		err := bindMounts(flagChroot, flagBinds)
+		if err != nil {
+			errAndExit("couldn't set up the mounts: %v", err)
+		}
+	}
+
 	err := syscall.Chroot(flagChroot)
 	if err != nil {
 		errAndExit("couldn't chroot: %v", err)
@@ -74,6 +108,17 @@ func runChroot(cmd *cobra.Command, args []string) {
 	}
 
 	execCmd := exec.Command(flagCmd, flagArgs...)
+	if flagUser != "" {
+		user, err := engine.ParseUser(flagUser)
+		if err != nil {
+			errAndExit("%v", err)
+		}
+		cred, err := user.Credential()
+		if err != nil {
+			errAndExit("%v", err)
+		}
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 	execCmd.Env = flagEnv
 	execCmd.Stdin = os.Stdin
 	execCmd.Stdout = os.Stdout
@@ -87,3 +132,37 @@ func runChroot(cmd *cobra.Command, args []string) {
 		errAndExit("%v", err)
 	}
 }
+
+// bindMounts sets up the given mounts in the chroot, in a new mount namespace
+// so that they don't outlive the command.
+func bindMounts(chroot string, mounts []engine.Mount) error {
+	err := syscall.Unshare(syscall.CLONE_NEWNS)
+	if err != nil {
+		return err
+	}
+	// Don't let any of the mounts propagate back to the host
+	err = syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+	for _, m := range mounts {
+		err := engine.BindMount(chroot, m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// unshareNetwork moves the process into a new network namespace, bringing its
+// loopback interface up for engine.NetworkLoopback.
+func unshareNetwork(network engine.Network) error {
+	err := syscall.Unshare(syscall.CLONE_NEWNET)
+	if err != nil {
+		return err
+	}
+	if network == engine.NetworkLoopback {
+		return engine.SetUpLoopback()
+	}
+	return nil
+}
@@ -15,6 +15,7 @@
 package chroot
 
 import (
+	"context"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -26,28 +27,66 @@ import (
 	"github.com/coreos/rkt/pkg/user"
 )
 
-type Engine struct{}
+// Engine runs commands in a chroot. The command shares everything but the root
+// filesystem with the host, unless it's given a network of its own.
+type Engine struct {
+	// Network is the network the command is run with. Unless it's
+	// engine.NetworkHost, or empty, the command is run in a new network
+	// namespace, cutting it off from the host's network.
+	Network engine.Network
+	// User is the user the command is run as. If it's nil, the command is
+	// run as root.
+	User *engine.User
+	// Limits are the resources the command can use.
+	Limits engine.Limits
+}
 
 func init() {
 	multicall.Add("acbuild-chroot", cmdACBuildChroot.Execute)
 }
 
-func (e Engine) Run(command string, args []string, environment types.Environment, chroot, workingDir string) error {
-	resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
-	_, err := os.Stat(resolvConfFile)
-	switch {
-	case os.IsNotExist(err):
-		err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
-		if err != nil {
-			return err
-		}
-		err = fileutil.CopyTree("/etc/resolv.conf", resolvConfFile, user.NewBlankUidRange())
-		if err != nil {
+// WithNetwork returns a copy of e that runs commands with the given network.
+func (e Engine) WithNetwork(network engine.Network) (engine.Engine, error) {
+	e.Network = network
+	return e, nil
+}
+
+// WithUser returns a copy of e that runs commands as the given user.
+func (e Engine) WithUser(user *engine.User) (engine.Engine, error) {
+	e.User = user
+	return e, nil
+}
+
+// WithLimits returns a copy of e that limits the resources of commands.
+func (e Engine) WithLimits(limits engine.Limits) (engine.Engine, error) {
+	e.Limits = limits
+	return e, nil
+}
+
+func (e Engine) Run(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string) error {
+	return e.RunWithMounts(ctx, command, args, environment, chroot, workingDir, nil)
+}
+
+// RunWithMounts is like Run, with the given mounts set up in a mount namespace
+// of the command's own.
+func (e Engine) RunWithMounts(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string, mounts []engine.Mount) error {
+	if !e.Network.Private() {
+		resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
+		_, err := os.Stat(resolvConfFile)
+		switch {
+		case os.IsNotExist(err):
+			err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
+			if err != nil {
+				return err
+			}
+			err = fileutil.CopyTree("/etc/resolv.conf", resolvConfFile, user.NewBlankUidRange())
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(resolvConfFile)
+		case err != nil:
 			return err
 		}
-		defer os.RemoveAll(resolvConfFile)
-	case err != nil:
-		return err
 	}
 	var serializedArgs string
 	for _, arg := range args {
@@ -81,10 +120,61 @@ func (e Engine) Run(command string, args []string, environment types.Environment
 	if len(serializedEnv) > 0 {
 		chrootArgs = append(chrootArgs, "--env", serializedEnv)
 	}
+	if e.Network.Private() {
+		chrootArgs = append(chrootArgs, "--net", string(e.Network))
+	}
+	if e.User != nil {
+		chrootArgs = append(chrootArgs, "--user", e.User.String())
+	}
+	for _, m := range mounts {
+		chrootArgs = append(chrootArgs, "--bind", m.String())
+	}
+	var cg *engine.Cgroup
+	if !e.Limits.IsZero() {
+		var err error
+		cg, err = engine.NewCgroup(e.Limits)
+		if err != nil {
+			return err
+		}
+		defer cg.Remove()
+		chrootArgs = append(chrootArgs, "--wait")
+	}
 	cmd := exec.Command("acbuild-chroot", chrootArgs...)
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = []string{path}
-	return cmd.Run()
+
+	if cg == nil {
+		err := cmd.Start()
+		if err != nil {
+			return err
+		}
+		return engine.Wait(ctx, cmd, nil)
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	// The child blocks on reading fd 3 until it's been moved to the cgroup
+	cmd.ExtraFiles = []*os.File{r}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	err = cg.Attach(cmd.Process.Pid)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return engine.Wait(ctx, cmd, cg)
 }
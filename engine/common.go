@@ -15,6 +15,8 @@
 package engine
 
 import (
+	"context"
+
 	"github.com/appc/spec/schema/types"
 )
 
@@ -30,6 +32,20 @@ type Engine interface {
 	// binary, chroot is the path on the host where the container's root
 	// filesystem exists, and workingDir specifies the path inside the
 	// container that should be the current working directory for the binary.
-	// If workingDir is "", the default should be "/".
-	Run(command string, args []string, environment types.Environment, chroot, workingDir string) error
+	// If workingDir is "", the default should be "/". If ctx is done before
+	// the command finishes, the command is killed along with every process it
+	// started, and a *TimeoutError is returned if ctx's deadline was
+	// exceeded.
+	Run(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string) error
+	// WithNetwork returns a copy of the engine that runs commands with the
+	// given network, or an error if the engine can't isolate commands from
+	// the network in that way.
+	WithNetwork(network Network) (Engine, error)
+	// WithUser returns a copy of the engine that runs commands as the given
+	// user, or as root if it's nil, or an error if the engine can't run
+	// commands as that user.
+	WithUser(user *User) (Engine, error)
+	// WithLimits returns a copy of the engine that limits the resources
+	// commands can use, or an error if the engine can't limit them.
+	WithLimits(limits Limits) (Engine, error)
 }
@@ -0,0 +1,175 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// RootlessEngine is implemented by engines that are able to run commands
+// without acbuild being run as root, by mapping the invoking user to root
+// inside of a user namespace.
+type RootlessEngine interface {
+	Engine
+	// IDMappings returns the mappings the engine will use for the user
+	// namespace, or nil if the engine will not create a user namespace.
+	IDMappings() (*IDMappings, error)
+}
+
+// IDMap maps a contiguous range of IDs inside of a user namespace onto a
+// range of IDs on the host.
+type IDMap struct {
+	ContainerID int `json:"containerID"`
+	HostID      int `json:"hostID"`
+	Size        int `json:"size"`
+}
+
+// IDMappings holds the uid and gid mappings for a user namespace.
+type IDMappings struct {
+	UIDs []IDMap `json:"uids"`
+	GIDs []IDMap `json:"gids"`
+}
+
+// NewIDMappings returns the mappings for a user namespace in which the current
+// user is root. If the current user has subordinate ids allocated in
+// /etc/subuid and /etc/subgid and the newuidmap and newgidmap helpers are
+// installed, the subordinate ids are mapped to the ids starting at 1.
+func NewIDMappings() (*IDMappings, error) {
+	u, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+
+	uid, gid := os.Getuid(), os.Getgid()
+	m := &IDMappings{
+		UIDs: []IDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GIDs: []IDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+	}
+
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := exec.LookPath(helper); err != nil {
+			return m, nil
+		}
+	}
+
+	subuid, err := getSubIDRange("/etc/subuid", u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	subgid, err := getSubIDRange("/etc/subgid", u.Username, uid)
+	if err != nil {
+		return nil, err
+	}
+	if subuid != nil && subgid != nil {
+		m.UIDs = append(m.UIDs, *subuid)
+		m.GIDs = append(m.GIDs, *subgid)
+	}
+	return m, nil
+}
+
+// HasSubIDs returns whether or not the mappings contain more than a single
+// id, in which case the setuid newuidmap and newgidmap helpers are needed to
+// set them up.
+func (m *IDMappings) HasSubIDs() bool {
+	return len(m.UIDs) > 1 || len(m.GIDs) > 1
+}
+
+// HostToContainer translates the given uid and gid on the host into the
+// corresponding ids inside of the user namespace. IDs that are not mapped are
+// returned unchanged.
+func (m *IDMappings) HostToContainer(uid, gid int) (int, int) {
+	return hostToContainer(m.UIDs, uid), hostToContainer(m.GIDs, gid)
+}
+
+func hostToContainer(maps []IDMap, id int) int {
+	for _, m := range maps {
+		if id >= m.HostID && id < m.HostID+m.Size {
+			return id - m.HostID + m.ContainerID
+		}
+	}
+	return id
+}
+
+// ReadIDMappings reads the mappings saved at path. If nothing has been saved
+// there, nil is returned.
+func ReadIDMappings(path string) (*IDMappings, error) {
+	blob, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	m := &IDMappings{}
+	err = json.Unmarshal(blob, m)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Save writes the mappings to path, so that they can later be used to
+// translate the ownership of files written inside of the user namespace.
+func (m *IDMappings) Save(path string) error {
+	blob, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, blob, 0644)
+}
+
+// getSubIDRange finds the first range allocated to the user with the given name
+// or uid in the subordinate id file at path, which has lines of the form
+// "name:start:count". If the file doesn't exist or has no range for the user,
+// nil is returned.
+func getSubIDRange(path, name string, uid int) (*IDMap, error) {
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		parts := strings.Split(strings.TrimSpace(s.Text()), ":")
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] != name && parts[0] != strconv.Itoa(uid) {
+			continue
+		}
+		start, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range start in %s: %q", path, parts[1])
+		}
+		count, err := strconv.Atoi(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("invalid range size in %s: %q", path, parts[2])
+		}
+		return &IDMap{ContainerID: 1, HostID: start, Size: count}, nil
+	}
+	return nil, s.Err()
+}
@@ -0,0 +1,234 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// cpuPeriod is the period, in microseconds, that CPU time is limited over.
+const cpuPeriod = 100000
+
+// MinCPUs is the smallest CPU limit, as the kernel won't limit a command to
+// less than 1ms of CPU time per period.
+const MinCPUs = 1000.0 / cpuPeriod
+
+// Limits are the resources a command can use.
+type Limits struct {
+	// Memory is the maximum number of bytes of memory, or 0 for no limit
+	Memory int64
+	// CPUs is the number of CPUs worth of time the command can use, or 0
+	// for no limit
+	CPUs float64
+}
+
+// IsZero returns whether the limits don't limit anything.
+func (l Limits) IsZero() bool {
+	return l.Memory == 0 && l.CPUs == 0
+}
+
+// Cgroup is the cgroup v2 that a command is run in to limit its resources.
+// It's either a transient scope created through systemd, or a child of the
+// cgroup named by DelegatedCgroupEnv.
+type Cgroup struct {
+	limits Limits
+	// path is the cgroup's directory, for a child of a delegated cgroup
+	path string
+	// unit is the name of the scope, for a systemd transient scope
+	unit string
+	// user is whether the scope belongs to the user's systemd instance
+	user bool
+}
+
+// DelegatedCgroupEnv is the environment variable naming the directory of a
+// cgroup v2 that has been delegated to acbuild, with the controllers the
+// limits need enabled for its children. When it's set, commands are run in
+// cgroups created below it instead of in systemd transient scopes.
+const DelegatedCgroupEnv = "ACBUILD_CGROUP"
+
+// NewCgroup prepares a cgroup with the given limits. Commands are only moved
+// into it by Attach, and processes that acbuild didn't start are never moved,
+// nor are the controllers of any existing cgroup changed.
+func NewCgroup(limits Limits) (*Cgroup, error) {
+	if delegated := os.Getenv(DelegatedCgroupEnv); delegated != "" {
+		return newDelegatedCgroup(delegated, limits)
+	}
+	if systemdBooted() {
+		if _, err := exec.LookPath("busctl"); err == nil {
+			return &Cgroup{limits: limits, user: os.Geteuid() != 0}, nil
+		}
+	}
+	return nil, fmt.Errorf("resource limits need either systemd, to run the command in a transient scope, or a cgroup v2 delegated to acbuild with $%s", DelegatedCgroupEnv)
+}
+
+// newDelegatedCgroup creates a cgroup with the given limits below the
+// delegated cgroup at parent.
+func newDelegatedCgroup(parent string, limits Limits) (*Cgroup, error) {
+	enabled, err := ioutil.ReadFile(filepath.Join(parent, "cgroup.subtree_control"))
+	if err != nil {
+		return nil, fmt.Errorf("$%s isn't a cgroup v2: %v", DelegatedCgroupEnv, err)
+	}
+	settings := make(map[string]string)
+	var controllers []string
+	if limits.Memory != 0 {
+		controllers = append(controllers, "memory")
+		settings["memory.max"] = strconv.FormatInt(limits.Memory, 10)
+	}
+	if limits.CPUs != 0 {
+		controllers = append(controllers, "cpu")
+		settings["cpu.max"] = fmt.Sprintf("%d %d", int64(limits.CPUs*cpuPeriod), cpuPeriod)
+	}
+	for _, controller := range controllers {
+		if !strings.Contains(" "+strings.TrimSpace(string(enabled))+" ", " "+controller+" ") {
+			return nil, fmt.Errorf("the %s controller isn't enabled for the children of %s", controller, parent)
+		}
+	}
+
+	path, err := ioutil.TempDir(parent, "acbuild-run-")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cgroup{limits: limits, path: path}
+	for file, value := range settings {
+		err := ioutil.WriteFile(filepath.Join(path, file), []byte(value), 0644)
+		if err != nil {
+			c.Remove()
+			return nil, fmt.Errorf("couldn't set %s: %v", file, err)
+		}
+	}
+	return c, nil
+}
+
+// systemdBooted returns whether systemd is the init system, the same way
+// sd_booted(3) does.
+func systemdBooted() bool {
+	fi, err := os.Lstat("/run/systemd/system")
+	return err == nil && fi.IsDir()
+}
+
+// Attach moves the process with the given pid into the cgroup. The process
+// must not have started running the command yet, so that none of the
+// command's processes escape the limits.
+func (c *Cgroup) Attach(pid int) error {
+	if c.path != "" {
+		return ioutil.WriteFile(filepath.Join(c.path, "cgroup.procs"), []byte(strconv.Itoa(pid)), 0644)
+	}
+
+	c.unit = fmt.Sprintf("acbuild-run-%d.scope", pid)
+	args := []string{
+		"StartTransientUnit", "ssa(sv)a(sa(sv))", c.unit, "fail",
+	}
+	props := [][]string{
+		{"Description", "s", "acbuild run"},
+		{"PIDs", "au", "1", strconv.Itoa(pid)},
+	}
+	if c.limits.Memory != 0 {
+		props = append(props, []string{"MemoryMax", "t", strconv.FormatInt(c.limits.Memory, 10)})
+	}
+	if c.limits.CPUs != 0 {
+		// The quota is given in microseconds of CPU time per second
+		props = append(props, []string{"CPUQuotaPerSecUSec", "t", strconv.FormatInt(int64(c.limits.CPUs*1000000), 10)})
+	}
+	args = append(args, strconv.Itoa(len(props)))
+	for _, prop := range props {
+		args = append(args, prop...)
+	}
+	// No auxiliary units
+	args = append(args, "0")
+	err := c.callSystemd(args...)
+	if err != nil {
+		return fmt.Errorf("couldn't create a transient scope: %v", err)
+	}
+
+	// The scope is started by a job that the call only queues, so the
+	// process isn't necessarily in it yet
+	for i := 0; i < 500; i++ {
+		cgroup, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(cgroup), "/"+c.unit+"\n") {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("timed out waiting for systemd to start %s", c.unit)
+}
+
+// callSystemd calls the given method of the systemd manager with busctl.
+func (c *Cgroup) callSystemd(args ...string) error {
+	busctlArgs := []string{"call"}
+	if c.user {
+		busctlArgs = append(busctlArgs, "--user")
+	}
+	busctlArgs = append(busctlArgs, "org.freedesktop.systemd1", "/org/freedesktop/systemd1", "org.freedesktop.systemd1.Manager")
+	output, err := exec.Command("busctl", append(busctlArgs, args...)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Kill kills every process in the cgroup.
+func (c *Cgroup) Kill() error {
+	if c.path == "" {
+		if c.unit == "" {
+			return nil
+		}
+		return c.callSystemd("KillUnit", "ssi", c.unit, "all", strconv.Itoa(int(syscall.SIGKILL)))
+	}
+	err := ioutil.WriteFile(filepath.Join(c.path, "cgroup.kill"), []byte("1"), 0644)
+	if err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	// cgroup.kill needs Linux 5.14
+	procs, err := ioutil.ReadFile(filepath.Join(c.path, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	for _, p := range strings.Fields(string(procs)) {
+		if pid, err := strconv.Atoi(p); err == nil {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+	}
+	return nil
+}
+
+// Remove removes the cgroup, once the processes in it are gone. systemd
+// removes transient scopes by itself once they're empty.
+func (c *Cgroup) Remove() error {
+	if c.path == "" {
+		return nil
+	}
+	var err error
+	for i := 0; i < 100; i++ {
+		err = os.Remove(c.path)
+		if err == nil || os.IsNotExist(err) {
+			return nil
+		}
+		// The processes of a cgroup can take a moment to leave it after
+		// they've exited
+		time.Sleep(10 * time.Millisecond)
+	}
+	return err
+}
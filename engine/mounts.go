@@ -0,0 +1,136 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/util"
+)
+
+// Mount is a file or directory on the host that is bind mounted into the
+// container while a command runs.
+type Mount struct {
+	// Source is the path on the host
+	Source string `json:"source"`
+	// Target is the path inside of the container
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"readOnly,omitempty"`
+}
+
+// MountingEngine is implemented by engines that can bind mount files and
+// directories from the host into the container.
+type MountingEngine interface {
+	Engine
+	// RunWithMounts is like Run, except that the given mounts are set up
+	// in the container for as long as the command runs. Their targets
+	// already exist in the container's root filesystem.
+	RunWithMounts(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string, mounts []Mount) error
+}
+
+// ParseMount parses a mount given as HOST_PATH:CONTAINER_PATH, optionally
+// followed by :ro to make it read-only.
+func ParseMount(s string) (Mount, error) {
+	parts := strings.Split(s, ":")
+	readOnly := len(parts) == 3 && parts[2] == "ro"
+	if readOnly {
+		parts = parts[:2]
+	}
+	if len(parts) != 2 {
+		return Mount{}, fmt.Errorf("invalid mount %q, must be HOST_PATH:CONTAINER_PATH[:ro]", s)
+	}
+	if parts[0] == "" || !filepath.IsAbs(parts[1]) {
+		return Mount{}, fmt.Errorf("invalid mount %q, the container path must be absolute", s)
+	}
+	return Mount{
+		Source:   parts[0],
+		Target:   filepath.Clean(parts[1]),
+		ReadOnly: readOnly,
+	}, nil
+}
+
+// String returns the mount in the form accepted by ParseMount.
+func (m Mount) String() string {
+	s := m.Source + ":" + m.Target
+	if m.ReadOnly {
+		s += ":ro"
+	}
+	return s
+}
+
+// MountList is a flag collecting the mounts given to it, in the form accepted
+// by ParseMount.
+type MountList []Mount
+
+func (ml *MountList) String() string {
+	var mounts []string
+	for _, m := range *ml {
+		mounts = append(mounts, m.String())
+	}
+	return strings.Join(mounts, " ")
+}
+
+func (ml *MountList) Set(input string) error {
+	m, err := ParseMount(input)
+	if err != nil {
+		return err
+	}
+	*ml = append(*ml, m)
+	return nil
+}
+
+func (ml *MountList) Type() string {
+	return "mounts"
+}
+
+// remountFlags are the flags of a mount that can't be cleared when it's
+// remounted inside of a user namespace.
+const remountFlags = syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC |
+	syscall.MS_NOATIME | syscall.MS_NODIRATIME | syscall.MS_RELATIME
+
+// BindMount mounts m at its target inside of root. It's meant to be called in
+// a mount namespace of its own, so that the mount disappears with it.
+func BindMount(root string, m Mount) error {
+	target, err := util.ResolveInRoot(root, m.Target)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount(m.Source, target, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return fmt.Errorf("couldn't mount %s: %v", m.Source, err)
+	}
+	if !m.ReadOnly {
+		return nil
+	}
+
+	// A bind mount can only be made read-only by remounting it
+	var st syscall.Statfs_t
+	err = syscall.Statfs(target, &st)
+	if err != nil {
+		return err
+	}
+	flags := uintptr(st.Flags) & remountFlags
+	err = syscall.Mount("", target, "", syscall.MS_BIND|syscall.MS_REMOUNT|syscall.MS_RDONLY|flags, "")
+	if err != nil {
+		return fmt.Errorf("couldn't make %s read-only: %v", m.Target, err)
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespaces
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+
+	"github.com/appc/acbuild/engine"
+)
+
+const hostname = "acbuild"
+
+func init() {
+	cmdACBuildNamespaces.PersistentFlags().StringVar(&flagChroot, "chroot", "", "dir to use as the root filesystem")
+	cmdACBuildNamespaces.PersistentFlags().StringVar(&flagWorkingDir, "working-dir", "", "working directory for the command")
+	cmdACBuildNamespaces.PersistentFlags().BoolVar(&flagWait, "wait", false, "wait for fd 3 to be closed before starting")
+	cmdACBuildNamespaces.PersistentFlags().BoolVar(&flagLoopback, "loopback", false, "bring the loopback interface up")
+	cmdACBuildNamespaces.PersistentFlags().StringVar(&flagUser, "user", "", "user to run the command as, as UID:GID[:GIDS]")
+	cmdACBuildNamespaces.PersistentFlags().Var(&flagBinds, "bind", "host path to bind mount into the rootfs, as HOST_PATH:CONTAINER_PATH[:ro]")
+}
+
+var (
+	flagChroot           string
+	flagWorkingDir       string
+	flagWait             bool
+	flagLoopback         bool
+	flagBinds            engine.MountList
+	flagUser             string
+	cmdACBuildNamespaces = &cobra.Command{
+		Use: "",
+		Run: runNamespaces,
+	}
+
+	// devices are bind mounted from the host into the container's /dev
+	devices = []string{"null", "zero", "full", "random", "urandom", "tty"}
+
+	// devSymlinks are created in the container's /dev, mapping the link name
+	// to its target
+	devSymlinks = map[string]string{
+		"fd":     "/proc/self/fd",
+		"stdin":  "/proc/self/fd/0",
+		"stdout": "/proc/self/fd/1",
+		"stderr": "/proc/self/fd/2",
+		"ptmx":   "pts/ptmx",
+	}
+)
+
+func stderr(format string, a ...interface{}) {
+	out := fmt.Sprintf(format, a...)
+	fmt.Fprintln(os.Stderr, strings.TrimSuffix(out, "\n"))
+}
+
+func errAndExit(format string, a ...interface{}) {
+	stderr(format, a...)
+	os.Exit(1)
+}
+
+func runNamespaces(cmd *cobra.Command, args []string) {
+	runtime.LockOSThread()
+
+	if len(args) == 0 {
+		errAndExit("no command to run")
+	}
+
+	if flagWait {
+		// The parent closes its end of the pipe once our uid and gid
+		// mappings have been written and we've been moved to the cgroup
+		// that limits the command
+		syncPipe := os.NewFile(3, "sync")
+		_, err := ioutil.ReadAll(syncPipe)
+		if err != nil {
+			errAndExit("couldn't wait for the parent: %v", err)
+		}
+		syncPipe.Close()
+	}
+
+	err := setupRootfs(flagChroot)
+	if err != nil {
+		errAndExit("couldn't set up the rootfs: %v", err)
+	}
+
+	for _, m := range flagBinds {
+		err := engine.BindMount(flagChroot, m)
+		if err != nil {
+			errAndExit("%v", err)
+		}
+	}
+
+	if flagLoopback {
+		err := engine.SetUpLoopback()
+		if err != nil {
+			errAndExit("%v", err)
+		}
+	}
+
+	err = syscall.Sethostname([]byte(hostname))
+	if err != nil {
+		errAndExit("couldn't set the hostname: %v", err)
+	}
+
+	err = pivotRoot(flagChroot)
+	if err != nil {
+		errAndExit("couldn't pivot_root: %v", err)
+	}
+
+	if flagWorkingDir != "" {
+		err = os.Chdir(flagWorkingDir)
+		if err != nil {
+			errAndExit("couldn't cd: %v", err)
+		}
+	}
+
+	execCmd := exec.Command(args[0], args[1:]...)
+	if flagUser != "" {
+		user, err := engine.ParseUser(flagUser)
+		if err != nil {
+			errAndExit("%v", err)
+		}
+		cred, err := user.Credential()
+		if err != nil {
+			errAndExit("%v", err)
+		}
+		execCmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
+	execCmd.Env = os.Environ()
+	execCmd.Stdin = os.Stdin
+	execCmd.Stdout = os.Stdout
+	execCmd.Stderr = os.Stderr
+	err = execCmd.Run()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
+			os.Exit(code)
+		}
+		errAndExit("%v", err)
+	}
+}
+
+// setupRootfs makes root a mount point and mounts fresh proc, dev and sys
+// filesystems into it. The mounts only exist in this process's mount
+// namespace, and so disappear once the command finishes.
+func setupRootfs(root string) error {
+	// Don't let any of the following mounts propagate back to the host
+	err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, "")
+	if err != nil {
+		return err
+	}
+
+	// pivot_root requires the new root to be a mount point
+	err = syscall.Mount(root, root, "", syscall.MS_BIND|syscall.MS_REC, "")
+	if err != nil {
+		return err
+	}
+
+	err = syscall.Mount("proc", filepath.Join(root, "proc"), "proc",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV, "")
+	if err != nil {
+		return err
+	}
+
+	sys := filepath.Join(root, "sys")
+	err = syscall.Mount("sysfs", sys, "sysfs",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV|syscall.MS_RDONLY, "")
+	if err == syscall.EPERM {
+		// Inside of a user namespace sysfs can only be mounted when the
+		// network namespace is owned by it, so fall back to the host's
+		err = syscall.Mount("/sys", sys, "", syscall.MS_BIND|syscall.MS_REC, "")
+	}
+	if err != nil {
+		return err
+	}
+
+	return setupDev(filepath.Join(root, "dev"))
+}
+
+func setupDev(dev string) error {
+	err := syscall.Mount("tmpfs", dev, "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_STRICTATIME, "mode=755")
+	if err != nil {
+		return err
+	}
+
+	for _, d := range devices {
+		target := filepath.Join(dev, d)
+		f, err := os.Create(target)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		err = syscall.Mount(filepath.Join("/dev", d), target, "", syscall.MS_BIND, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	for name, target := range devSymlinks {
+		err := os.Symlink(target, filepath.Join(dev, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	pts := filepath.Join(dev, "pts")
+	err = os.Mkdir(pts, 0755)
+	if err != nil {
+		return err
+	}
+	err = syscall.Mount("devpts", pts, "devpts", syscall.MS_NOSUID|syscall.MS_NOEXEC,
+		"newinstance,ptmxmode=0666,mode=0620")
+	if err != nil {
+		return err
+	}
+
+	shm := filepath.Join(dev, "shm")
+	err = os.Mkdir(shm, 01777)
+	if err != nil {
+		return err
+	}
+	return syscall.Mount("shm", shm, "tmpfs",
+		syscall.MS_NOSUID|syscall.MS_NOEXEC|syscall.MS_NODEV, "mode=1777")
+}
+
+// pivotRoot makes root the root filesystem of this mount namespace, and
+// detaches the host's root filesystem from it.
+func pivotRoot(root string) error {
+	oldRoot, err := ioutil.TempDir(root, ".pivot-root")
+	if err != nil {
+		return err
+	}
+
+	err = syscall.PivotRoot(root, oldRoot)
+	if err != nil {
+		os.Remove(oldRoot)
+		return err
+	}
+
+	err = os.Chdir("/")
+	if err != nil {
+		return err
+	}
+
+	oldRoot = filepath.Join("/", filepath.Base(oldRoot))
+	err = syscall.Unmount(oldRoot, syscall.MNT_DETACH)
+	if err != nil {
+		return err
+	}
+	return os.Remove(oldRoot)
+}
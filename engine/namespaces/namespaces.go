@@ -0,0 +1,294 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package namespaces
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/spec/schema/types"
+	"github.com/coreos/rkt/pkg/multicall"
+)
+
+// mountPoints are the directories inside of the rootfs that the child mounts
+// fresh filesystems on to.
+var mountPoints = []string{"/proc", "/dev", "/sys"}
+
+var entrypoint multicall.Entrypoint
+
+func init() {
+	entrypoint = multicall.Add("acbuild-namespaces", cmdACBuildNamespaces.Execute)
+}
+
+// Engine runs commands in new mount, PID, UTS and IPC namespaces, and
+// optionally a new network namespace, without relying on any tool outside of
+// the acbuild binary.
+type Engine struct {
+	// Network is the network the command is run with. Unless it's
+	// engine.NetworkHost, or empty, the command is run in a new network
+	// namespace, cutting it off from the host's network.
+	Network engine.Network
+	// User is the user the command is run as. If it's nil, the command is
+	// run as root.
+	User *engine.User
+	// Limits are the resources the command can use.
+	Limits engine.Limits
+	// UserNamespace causes the command to be run in a new user namespace, in
+	// which the invoking user is root. This allows commands to be run without
+	// acbuild being run as root.
+	UserNamespace bool
+}
+
+// IDMappings returns the uid and gid mappings that will be used for the user
+// namespace, or nil if e.UserNamespace isn't set.
+func (e Engine) IDMappings() (*engine.IDMappings, error) {
+	if !e.UserNamespace {
+		return nil, nil
+	}
+	return engine.NewIDMappings()
+}
+
+// WithNetwork returns a copy of e that runs commands with the given network.
+func (e Engine) WithNetwork(network engine.Network) (engine.Engine, error) {
+	e.Network = network
+	return e, nil
+}
+
+// WithUser returns a copy of e that runs commands as the given user.
+func (e Engine) WithUser(user *engine.User) (engine.Engine, error) {
+	e.User = user
+	return e, nil
+}
+
+// WithLimits returns a copy of e that limits the resources of commands.
+func (e Engine) WithLimits(limits engine.Limits) (engine.Engine, error) {
+	e.Limits = limits
+	return e, nil
+}
+
+func (e Engine) Run(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string) error {
+	return e.RunWithMounts(ctx, command, args, environment, chroot, workingDir, nil)
+}
+
+// RunWithMounts is like Run, with the given mounts set up in the command's
+// mount namespace.
+func (e Engine) RunWithMounts(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string, mounts []engine.Mount) error {
+	if !e.Network.Private() {
+		resolvConfFile := filepath.Join(chroot, "/etc/resolv.conf")
+		_, err := os.Stat(resolvConfFile)
+		switch {
+		case os.IsNotExist(err):
+			err := os.MkdirAll(filepath.Dir(resolvConfFile), 0755)
+			if err != nil {
+				return err
+			}
+			// Only the contents are copied, as preserving the host file's
+			// ownership isn't possible without root
+			defer os.RemoveAll(resolvConfFile)
+			resolvConf, err := ioutil.ReadFile("/etc/resolv.conf")
+			if err != nil {
+				return err
+			}
+			err = ioutil.WriteFile(resolvConfFile, resolvConf, 0644)
+			if err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		}
+	}
+
+	for _, mp := range mountPoints {
+		mpPath := filepath.Join(chroot, mp)
+		_, err := os.Stat(mpPath)
+		switch {
+		case os.IsNotExist(err):
+			err := os.Mkdir(mpPath, 0755)
+			if err != nil {
+				return err
+			}
+			// Only removes the directory if nothing was left in it
+			defer os.Remove(mpPath)
+		case err != nil:
+			return err
+		}
+	}
+
+	path := "PATH=" + strings.Join(engine.Pathlist, ":")
+	env := []string{path}
+	for _, envvar := range environment {
+		env = append(env, envvar.Name+"="+envvar.Value)
+	}
+
+	idmaps, err := e.IDMappings()
+	if err != nil {
+		return err
+	}
+
+	var cg *engine.Cgroup
+	if !e.Limits.IsZero() {
+		cg, err = engine.NewCgroup(e.Limits)
+		if err != nil {
+			return err
+		}
+		defer cg.Remove()
+	}
+
+	// Mappings that need the helpers, and moving the child to its cgroup,
+	// have to be done after it's started, and before it runs anything
+	var helperMaps *engine.IDMappings
+	if idmaps != nil && idmaps.HasSubIDs() {
+		helperMaps = idmaps
+	}
+
+	childArgs := []string{
+		"--chroot", chroot,
+		"--working-dir", workingDir,
+	}
+	if helperMaps != nil || cg != nil {
+		childArgs = append(childArgs, "--wait")
+	}
+	if e.Network == engine.NetworkLoopback {
+		childArgs = append(childArgs, "--loopback")
+	}
+	if e.User != nil {
+		childArgs = append(childArgs, "--user", e.User.String())
+	}
+	for _, m := range mounts {
+		childArgs = append(childArgs, "--bind", m.String())
+	}
+	childArgs = append(childArgs, "--", command)
+	childArgs = append(childArgs, args...)
+
+	cloneflags := syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+		syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+	if e.Network.Private() {
+		cloneflags |= syscall.CLONE_NEWNET
+	}
+
+	cmd := entrypoint.Cmd(childArgs...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = env
+
+	if idmaps != nil {
+		cloneflags |= syscall.CLONE_NEWUSER
+		if helperMaps == nil {
+			// A single id can be mapped by an unprivileged process
+			// itself
+			cmd.SysProcAttr.UidMappings = sysProcIDMap(idmaps.UIDs)
+			cmd.SysProcAttr.GidMappings = sysProcIDMap(idmaps.GIDs)
+			cmd.SysProcAttr.GidMappingsEnableSetgroups = false
+		}
+	}
+	cmd.SysProcAttr.Cloneflags = uintptr(cloneflags)
+
+	if helperMaps == nil && cg == nil {
+		err := cmd.Start()
+		if err != nil {
+			return err
+		}
+		return engine.Wait(ctx, cmd, nil)
+	}
+	return startBlocked(ctx, cmd, cg, helperMaps)
+}
+
+// startBlocked starts cmd, which blocks on reading fd 3 until the setuid
+// newuidmap and newgidmap helpers have written the given id mappings, if
+// they're not nil, and it's been moved to cg, if it's not nil. It then lets
+// cmd continue and waits for it to finish, killing it once ctx is done.
+func startBlocked(ctx context.Context, cmd *exec.Cmd, cg *engine.Cgroup, idmaps *engine.IDMappings) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	defer w.Close()
+
+	cmd.ExtraFiles = []*os.File{r}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	err = writeIDMappings(cmd.Process.Pid, idmaps)
+	if err == nil && cg != nil {
+		err = cg.Attach(cmd.Process.Pid)
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return engine.Wait(ctx, cmd, cg)
+}
+
+// writeIDMappings uses the setuid newuidmap and newgidmap helpers to write the
+// id mappings of the process with the given pid, if idmaps isn't nil.
+func writeIDMappings(pid int, idmaps *engine.IDMappings) error {
+	if idmaps == nil {
+		return nil
+	}
+	for _, helper := range []struct {
+		Name string
+		Maps []engine.IDMap
+	}{
+		{"newuidmap", idmaps.UIDs},
+		{"newgidmap", idmaps.GIDs},
+	} {
+		output, err := exec.Command(helper.Name, append([]string{strconv.Itoa(pid)}, idMapArgs(helper.Maps)...)...).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("%s failed: %v: %s", helper.Name, err, strings.TrimSpace(string(output)))
+		}
+	}
+	return nil
+}
+
+func sysProcIDMap(maps []engine.IDMap) []syscall.SysProcIDMap {
+	var sysMaps []syscall.SysProcIDMap
+	for _, m := range maps {
+		sysMaps = append(sysMaps, syscall.SysProcIDMap{
+			ContainerID: m.ContainerID,
+			HostID:      m.HostID,
+			Size:        m.Size,
+		})
+	}
+	return sysMaps
+}
+
+// idMapArgs returns the mappings in the form expected on the command line of
+// newuidmap and newgidmap.
+func idMapArgs(maps []engine.IDMap) []string {
+	var args []string
+	for _, m := range maps {
+		args = append(args, strconv.Itoa(m.ContainerID),
+			strconv.Itoa(m.HostID), strconv.Itoa(m.Size))
+	}
+	return args
+}
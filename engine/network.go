@@ -0,0 +1,82 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Network is how much of the network a command run by an engine can use.
+type Network string
+
+const (
+	// NetworkHost shares the host's network with the command. It's what
+	// engines do by default.
+	NetworkHost Network = "host"
+	// NetworkNone runs the command in a network namespace of its own
+	// without any network interface that is up, not even loopback.
+	NetworkNone Network = "none"
+	// NetworkLoopback runs the command in a network namespace of its own
+	// with only a loopback interface.
+	NetworkLoopback Network = "loopback"
+)
+
+// ParseNetwork parses the name of a network mode.
+func ParseNetwork(s string) (Network, error) {
+	switch n := Network(s); n {
+	case NetworkHost, NetworkNone, NetworkLoopback:
+		return n, nil
+	}
+	return "", fmt.Errorf("invalid network %q, must be one of host, none or loopback", s)
+}
+
+// Private returns whether the network is cut off from the host's network,
+// treating the zero value as NetworkHost.
+func (n Network) Private() bool {
+	return n != "" && n != NetworkHost
+}
+
+// ifreqFlags is the layout of struct ifreq used to get and set an interface's
+// flags.
+type ifreqFlags struct {
+	Name  [syscall.IFNAMSIZ]byte
+	Flags uint16
+	_     [22]byte
+}
+
+// SetUpLoopback brings the loopback interface of the current network namespace
+// up.
+func SetUpLoopback() error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var ifr ifreqFlags
+	copy(ifr.Name[:], "lo")
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("couldn't get the flags of the loopback interface: %v", errno)
+	}
+	ifr.Flags |= syscall.IFF_UP
+	_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return fmt.Errorf("couldn't bring the loopback interface up: %v", errno)
+	}
+	return nil
+}
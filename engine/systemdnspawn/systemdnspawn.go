@@ -15,6 +15,7 @@
 package systemdnspawn
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
@@ -26,9 +27,53 @@ import (
 	"github.com/appc/spec/schema/types"
 )
 
-type Engine struct{}
+// Engine runs commands with systemd-nspawn.
+type Engine struct {
+	// Network is the network the command is run with. systemd-nspawn always
+	// brings the loopback interface of a private network up, so
+	// engine.NetworkNone isn't supported.
+	Network engine.Network
+	// User is the user the command is run as. If it's nil, the command is
+	// run as root.
+	User *engine.User
+	// Limits are the resources the command can use.
+	Limits engine.Limits
+}
+
+// WithNetwork returns a copy of e that runs commands with the given network.
+func (e Engine) WithNetwork(network engine.Network) (engine.Engine, error) {
+	if network == engine.NetworkNone {
+		return nil, fmt.Errorf("the systemd-nspawn engine doesn't support the network %q, use %q instead", network, engine.NetworkLoopback)
+	}
+	e.Network = network
+	return e, nil
+}
+
+// WithUser returns a copy of e that runs commands as the given user.
+// systemd-nspawn looks users up by name and gives them the groups they have in
+// the container, so only users in the container's /etc/passwd with their own
+// groups are supported.
+func (e Engine) WithUser(user *engine.User) (engine.Engine, error) {
+	if user != nil && (user.Name == "" || !user.DefaultGroups) {
+		return nil, fmt.Errorf("the systemd-nspawn engine can only run commands as users in the rootfs's /etc/passwd, with their own groups")
+	}
+	e.User = user
+	return e, nil
+}
+
+// WithLimits returns a copy of e that limits the resources of commands.
+func (e Engine) WithLimits(limits engine.Limits) (engine.Engine, error) {
+	e.Limits = limits
+	return e, nil
+}
+
+func (e Engine) Run(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string) error {
+	return e.RunWithMounts(ctx, command, args, environment, chroot, workingDir, nil)
+}
 
-func (e Engine) Run(command string, args []string, environment types.Environment, chroot, workingDir string) error {
+// RunWithMounts is like Run, with the given mounts passed on to
+// systemd-nspawn.
+func (e Engine) RunWithMounts(ctx context.Context, command string, args []string, environment types.Environment, chroot, workingDir string, mounts []engine.Mount) error {
 	nspawncmd := []string{"systemd-nspawn", "-D", chroot}
 
 	systemdVersion, err := getSystemdVersion()
@@ -65,10 +110,31 @@ func (e Engine) Run(command string, args []string, environment types.Environment
 		}
 	}
 
+	if e.Network.Private() {
+		nspawncmd = append(nspawncmd, "--private-network")
+	}
+	if e.User != nil {
+		nspawncmd = append(nspawncmd, "--user="+e.User.Name)
+	}
+	if e.Limits.Memory != 0 {
+		nspawncmd = append(nspawncmd, fmt.Sprintf("--property=MemoryMax=%d", e.Limits.Memory))
+	}
+	if e.Limits.CPUs != 0 {
+		nspawncmd = append(nspawncmd, fmt.Sprintf("--property=CPUQuota=%d%%", int64(e.Limits.CPUs*100)))
+	}
+
 	for _, envVar := range environment {
 		nspawncmd = append(nspawncmd, "--setenv", envVar.Name+"="+envVar.Value)
 	}
 
+	for _, m := range mounts {
+		bindFlag := "--bind="
+		if m.ReadOnly {
+			bindFlag = "--bind-ro="
+		}
+		nspawncmd = append(nspawncmd, bindFlag+m.Source+":"+m.Target)
+	}
+
 	nspawncmd = append(nspawncmd, "--setenv", "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin")
 
 	abscmd, err := findCmdInPath(engine.Pathlist, command, chroot)
@@ -97,7 +163,10 @@ func (e Engine) Run(command string, args []string, environment types.Environment
 	execCmd.Stderr = os.Stderr
 	execCmd.Env = []string{"SYSTEMD_LOG_LEVEL=err"}
 
-	err = execCmd.Run()
+	err = execCmd.Start()
+	if err == nil {
+		err = engine.Wait(ctx, execCmd, nil)
+	}
 	if err == exec.ErrNotFound {
 		return fmt.Errorf("systemd-nspawn is required but not found")
 	}
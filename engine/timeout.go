@@ -0,0 +1,118 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// TimeoutError is returned by engines when a command ran for longer than its
+// context allowed, and was killed along with every process it started.
+type TimeoutError struct{}
+
+func (e *TimeoutError) Error() string {
+	return "the command timed out and was killed"
+}
+
+// Wait waits for the started cmd to finish. If ctx is done first, cmd and
+// every process it started are killed, along with every process in cg if it
+// isn't nil, and a *TimeoutError is returned if the context's deadline was
+// exceeded, or the context's error otherwise.
+func Wait(ctx context.Context, cmd *exec.Cmd, cg *Cgroup) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	killProcessTree(cmd.Process.Pid)
+	if cg != nil {
+		cg.Kill()
+	}
+	<-done
+	if ctx.Err() == context.DeadlineExceeded {
+		return &TimeoutError{}
+	}
+	return ctx.Err()
+}
+
+// killProcessTree kills the process with the given pid and all of its
+// descendants. They are all stopped first, so that none of them can start
+// new processes or be reparented to init before they're killed.
+func killProcessTree(pid int) {
+	stopped := make(map[int]bool)
+	for {
+		var tree []int
+		children := processChildren()
+		for todo := []int{pid}; len(todo) != 0; {
+			p := todo[0]
+			todo = append(todo[1:], children[p]...)
+			tree = append(tree, p)
+		}
+
+		stoppedAny := false
+		for _, p := range tree {
+			if !stopped[p] {
+				syscall.Kill(p, syscall.SIGSTOP)
+				stopped[p] = true
+				stoppedAny = true
+			}
+		}
+		if !stoppedAny {
+			break
+		}
+	}
+	for p := range stopped {
+		syscall.Kill(p, syscall.SIGKILL)
+	}
+}
+
+// processChildren returns the pids of the children of every process, by the
+// pid of their parent.
+func processChildren() map[int][]int {
+	children := make(map[int][]int)
+	stats, _ := filepath.Glob("/proc/[0-9]*/stat")
+	for _, stat := range stats {
+		blob, err := ioutil.ReadFile(stat)
+		if err != nil {
+			continue
+		}
+		// The command name can contain anything, so the fields are
+		// found after the closing parenthesis around it
+		s := string(blob)
+		fields := strings.Fields(s[strings.LastIndex(s, ")")+1:])
+		if len(fields) < 2 {
+			continue
+		}
+		pid, err1 := strconv.Atoi(filepath.Base(filepath.Dir(stat)))
+		ppid, err2 := strconv.Atoi(fields[1])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], pid)
+	}
+	return children
+}
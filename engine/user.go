@@ -0,0 +1,104 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package engine
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// User is the user a command is run as.
+type User struct {
+	// Name is the user's name in the container's /etc/passwd, if it has
+	// an entry there
+	Name string `json:"name,omitempty"`
+	UID  int    `json:"uid"`
+	GID  int    `json:"gid"`
+	// AdditionalGIDs are the user's supplementary groups
+	AdditionalGIDs []int `json:"additionalGIDs,omitempty"`
+	// DefaultGroups is set when GID and AdditionalGIDs are the groups the
+	// user has according to the container's /etc/passwd and /etc/group
+	DefaultGroups bool `json:"defaultGroups,omitempty"`
+}
+
+// ParseUser parses a user given in the form returned by User.String, as
+// UID:GID, optionally followed by a colon and a comma separated list of
+// supplementary gids.
+func ParseUser(s string) (*User, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 && len(parts) != 3 {
+		return nil, fmt.Errorf("invalid user %q, must be UID:GID[:GIDS]", s)
+	}
+	var u User
+	var err error
+	u.UID, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid uid %q", parts[0])
+	}
+	u.GID, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid gid %q", parts[1])
+	}
+	if len(parts) == 3 && parts[2] != "" {
+		for _, g := range strings.Split(parts[2], ",") {
+			gid, err := strconv.Atoi(g)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid %q", g)
+			}
+			u.AdditionalGIDs = append(u.AdditionalGIDs, gid)
+		}
+	}
+	return &u, nil
+}
+
+// String returns the user's ids, in the form accepted by ParseUser.
+func (u *User) String() string {
+	s := fmt.Sprintf("%d:%d", u.UID, u.GID)
+	if len(u.AdditionalGIDs) != 0 {
+		var gids []string
+		for _, gid := range u.AdditionalGIDs {
+			gids = append(gids, strconv.Itoa(gid))
+		}
+		s += ":" + strings.Join(gids, ",")
+	}
+	return s
+}
+
+// Credential returns the credential that runs a process as the user. In a
+// user namespace in which setgroups is denied, which is the case when its gid
+// mapping wasn't written by newgidmap, the process keeps the supplementary
+// groups it has, and so the user must have none.
+func (u *User) Credential() (*syscall.Credential, error) {
+	cred := &syscall.Credential{
+		Uid:    uint32(u.UID),
+		Gid:    uint32(u.GID),
+		Groups: []uint32{},
+	}
+	for _, gid := range u.AdditionalGIDs {
+		cred.Groups = append(cred.Groups, uint32(gid))
+	}
+
+	setgroups, err := ioutil.ReadFile("/proc/self/setgroups")
+	if err == nil && strings.TrimSpace(string(setgroups)) == "deny" {
+		if len(u.AdditionalGIDs) != 0 {
+			return nil, fmt.Errorf("supplementary groups can't be set in this user namespace")
+		}
+		cred.NoSetGroups = true
+	}
+	return cred, nil
+}
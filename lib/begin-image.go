@@ -0,0 +1,495 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/oci"
+	"github.com/appc/acbuild/util"
+)
+
+const (
+	ociLayoutPrefix     = "oci-layout:"
+	dockerArchivePrefix = "docker-archive:"
+
+	// whiteoutPrefix marks a file in a layer that deletes the file with the
+	// rest of its name from the layers beneath it
+	whiteoutPrefix = ".wh."
+	// whiteoutOpaqueDir marks a directory in a layer whose contents hide the
+	// contents of the same directory in the layers beneath it
+	whiteoutOpaqueDir = ".wh..wh..opq"
+
+	mediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+)
+
+// dockerArchiveManifest is an entry in the manifest.json of a tarball produced
+// by docker save.
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// splitImageRef splits the argument of an oci-layout: or docker-archive:
+// start into the path of the image and the reference naming the image in it.
+func splitImageRef(start string) (string, string) {
+	parts := strings.SplitN(start, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// beginFromOCILayout begins the build with the image in the OCI image layout
+// described by start, which has the form PATH[:REF]. The layout can be a
+// directory or a tarball. REF is the name the image is tagged with in the
+// layout, and may be omitted if the layout only holds one image.
+func (a *ACBuild) beginFromOCILayout(start string) error {
+	layoutPath, ref := splitImageRef(start)
+
+	finfo, err := os.Stat(layoutPath)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("no such file or directory: %s", layoutPath)
+	case err != nil:
+		return err
+	case !finfo.IsDir():
+		tmpLayoutPath, err := ioutil.TempDir("", "acbuild-oci-layout")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(tmpLayoutPath)
+		err = util.ExtractImage(layoutPath, tmpLayoutPath, nil)
+		if err != nil {
+			return err
+		}
+		layoutPath = tmpLayoutPath
+	}
+
+	layout, err := oci.OpenLayout(layoutPath)
+	if err != nil {
+		return err
+	}
+	manifest, err := findOCIManifest(layout, ref)
+	if err != nil {
+		return err
+	}
+
+	var image oci.Image
+	err = layout.ReadJSONBlob(manifest.Config, &image)
+	if err != nil {
+		return err
+	}
+
+	var layers []string
+	for _, layer := range manifest.Layers {
+		layers = append(layers, layout.BlobPath(layer.Digest))
+	}
+	return a.beginFromLayers(image, layers)
+}
+
+// findOCIManifest finds the manifest of the image tagged with ref in layout. If
+// ref is empty the layout must only hold one image.
+func findOCIManifest(layout oci.Layout, ref string) (*oci.Manifest, error) {
+	index, err := layout.ReadIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var descs []oci.Descriptor
+	for _, desc := range index.Manifests {
+		if ref == "" || desc.Annotations[oci.AnnotationRefName] == ref {
+			descs = append(descs, desc)
+		}
+	}
+	desc, err := chooseOCIManifest(descs)
+	switch {
+	case err != nil && ref == "":
+		return nil, fmt.Errorf("%v in %s, one must be chosen with %sPATH:REF", err, layout.Path, ociLayoutPrefix)
+	case err != nil:
+		return nil, fmt.Errorf("%v tagged %q in %s", err, ref, layout.Path)
+	}
+
+	// An image built for several platforms is referenced through an index of
+	// its manifests
+	for desc.MediaType == oci.MediaTypeImageIndex || desc.MediaType == mediaTypeDockerManifestList {
+		var nested oci.Index
+		err := layout.ReadJSONBlob(desc, &nested)
+		if err != nil {
+			return nil, err
+		}
+		indexDigest := desc.Digest
+		desc, err = chooseOCIManifest(nested.Manifests)
+		if err != nil {
+			return nil, fmt.Errorf("%v in the index %s", err, indexDigest)
+		}
+	}
+
+	if desc.MediaType != oci.MediaTypeImageManifest && desc.MediaType != mediaTypeDockerManifest {
+		return nil, fmt.Errorf("unsupported manifest media type %q", desc.MediaType)
+	}
+	var manifest oci.Manifest
+	err = layout.ReadJSONBlob(desc, &manifest)
+	if err != nil {
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+// chooseOCIManifest returns the only one of descs, or if there are several, the
+// only one for the platform acbuild is running on.
+func chooseOCIManifest(descs []oci.Descriptor) (oci.Descriptor, error) {
+	if len(descs) == 1 {
+		return descs[0], nil
+	}
+	if len(descs) == 0 {
+		return oci.Descriptor{}, fmt.Errorf("no images")
+	}
+	var matching []oci.Descriptor
+	for _, desc := range descs {
+		if desc.Platform != nil && desc.Platform.OS == runtime.GOOS && desc.Platform.Architecture == runtime.GOARCH {
+			matching = append(matching, desc)
+		}
+	}
+	if len(matching) != 1 {
+		return oci.Descriptor{}, fmt.Errorf("%d images", len(descs))
+	}
+	return matching[0], nil
+}
+
+// beginFromDockerArchive begins the build with the image in the docker save
+// tarball described by start, which has the form PATH[:REPO:TAG]. REPO:TAG may
+// be omitted if the tarball only holds one image.
+func (a *ACBuild) beginFromDockerArchive(start string) error {
+	archivePath, ref := splitImageRef(start)
+	if ref != "" && !strings.Contains(ref, ":") {
+		ref += ":latest"
+	}
+
+	tmpArchivePath, err := ioutil.TempDir("", "acbuild-docker-archive")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpArchivePath)
+	err = util.ExtractImage(archivePath, tmpArchivePath, nil)
+	if err != nil {
+		return err
+	}
+	archiveFile := func(p string) string {
+		return filepath.Join(tmpArchivePath, filepath.Clean("/"+p))
+	}
+
+	blob, err := ioutil.ReadFile(archiveFile("manifest.json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s has no manifest.json, it must be produced by docker save from docker 1.10 or newer", archivePath)
+	}
+	if err != nil {
+		return err
+	}
+	var manifests []dockerArchiveManifest
+	err = json.Unmarshal(blob, &manifests)
+	if err != nil {
+		return fmt.Errorf("invalid manifest.json: %v", err)
+	}
+
+	var manifest *dockerArchiveManifest
+	for i, m := range manifests {
+		if ref == "" && len(manifests) == 1 {
+			manifest = &manifests[i]
+		}
+		for _, tag := range m.RepoTags {
+			if tag == ref {
+				manifest = &manifests[i]
+			}
+		}
+	}
+	switch {
+	case manifest == nil && ref == "":
+		return fmt.Errorf("%d images in %s, one must be chosen with %sPATH:REPO:TAG", len(manifests), archivePath, dockerArchivePrefix)
+	case manifest == nil:
+		return fmt.Errorf("no image tagged %q in %s", ref, archivePath)
+	}
+
+	var image oci.Image
+	blob, err = ioutil.ReadFile(archiveFile(manifest.Config))
+	if err != nil {
+		return err
+	}
+	err = json.Unmarshal(blob, &image)
+	if err != nil {
+		return fmt.Errorf("invalid image config: %v", err)
+	}
+
+	var layers []string
+	for _, layer := range manifest.Layers {
+		layers = append(layers, archiveFile(layer))
+	}
+	return a.beginFromLayers(image, layers)
+}
+
+// beginFromLayers begins the build with the rootfs produced by applying each
+// of the layer tarballs at the given paths in order, and a manifest translated
+// from the image config.
+func (a *ACBuild) beginFromLayers(image oci.Image, layers []string) error {
+	err := a.beginWithEmptyACI()
+	if err != nil {
+		return err
+	}
+
+	rootfs := path.Join(a.CurrentACIPath, aci.RootfsDir)
+	for _, layer := range layers {
+		err := applyLayer(layer, rootfs)
+		if err != nil {
+			return err
+		}
+	}
+
+	return util.ModifyManifest(func(man *schema.ImageManifest) error {
+		return seedManifest(man, image)
+	}, a.CurrentACIPath)
+}
+
+// applyLayer extracts the possibly compressed layer tarball at layerPath onto
+// rootfs, deleting the files its whiteouts mark as deleted.
+func applyLayer(layerPath, rootfs string) error {
+	// Whiteouts only apply to the layers beneath this one, so they're
+	// applied before any of this layer's files are extracted
+	fileMap, err := applyWhiteouts(layerPath, rootfs)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	dr, err := aci.NewCompressedReader(file)
+	if err != nil {
+		return fmt.Errorf("error decompressing layer: %v", err)
+	}
+	defer dr.Close()
+	return util.ExtractTar(dr, rootfs, fileMap)
+}
+
+// applyWhiteouts deletes the files from rootfs that the whiteouts in the layer
+// at layerPath mark as deleted. If the layer has any whiteouts, the set of the
+// layer's other files is returned, so that the whiteouts themselves aren't
+// extracted.
+func applyWhiteouts(layerPath, rootfs string) (map[string]struct{}, error) {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dr, err := aci.NewCompressedReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing layer: %v", err)
+	}
+	defer dr.Close()
+
+	fileMap := make(map[string]struct{})
+	hasWhiteouts := false
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		name := filepath.Clean(hdr.Name)
+		dir, base := filepath.Split(name)
+		switch {
+		case base == whiteoutOpaqueDir:
+			hasWhiteouts = true
+			p, err := util.ResolveInRoot(rootfs, name)
+			if err != nil {
+				return nil, err
+			}
+			children, err := ioutil.ReadDir(filepath.Dir(p))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			for _, child := range children {
+				err := os.RemoveAll(filepath.Join(filepath.Dir(p), child.Name()))
+				if err != nil {
+					return nil, err
+				}
+			}
+		case strings.HasPrefix(base, whiteoutPrefix):
+			hasWhiteouts = true
+			p, err := util.ResolveInRoot(rootfs, filepath.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			if err != nil {
+				return nil, err
+			}
+			err = os.RemoveAll(p)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			fileMap[name] = struct{}{}
+		}
+	}
+
+	if !hasWhiteouts {
+		return nil, nil
+	}
+	return fileMap, nil
+}
+
+// seedManifest fills in man from the given image config.
+func seedManifest(man *schema.ImageManifest, image oci.Image) error {
+	if image.OS != "" {
+		setLabel(man, "os", image.OS)
+	}
+	if image.Architecture != "" {
+		setLabel(man, "arch", appcArch(image.Architecture, image.Variant))
+	}
+
+	config := image.Config
+	var labelNames []string
+	for name := range config.Labels {
+		labelNames = append(labelNames, name)
+	}
+	sort.Strings(labelNames)
+	for _, name := range labelNames {
+		acid, err := types.SanitizeACIdentifier(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: skipping label %q, it can't be turned into an annotation: %v\n", name, err)
+			continue
+		}
+		man.Annotations.Set(*types.MustACIdentifier(acid), config.Labels[name])
+	}
+
+	exec := append(config.Entrypoint, config.Cmd...)
+	if len(exec) == 0 && config.User == "" && len(config.Env) == 0 && config.WorkingDir == "" &&
+		len(config.ExposedPorts) == 0 && len(config.Volumes) == 0 {
+		return nil
+	}
+
+	app := &types.App{
+		Exec:             exec,
+		User:             "0",
+		Group:            "0",
+		WorkingDirectory: config.WorkingDir,
+	}
+	if config.User != "" {
+		parts := strings.SplitN(config.User, ":", 2)
+		app.User = parts[0]
+		if len(parts) == 2 {
+			app.Group = parts[1]
+		}
+	}
+
+	for _, env := range config.Env {
+		parts := strings.SplitN(env, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		app.Environment.Set(parts[0], parts[1])
+	}
+
+	var ports []string
+	for port := range config.ExposedPorts {
+		ports = append(ports, port)
+	}
+	sort.Strings(ports)
+	for _, port := range ports {
+		parts := strings.SplitN(port, "/", 2)
+		protocol := "tcp"
+		if len(parts) == 2 {
+			protocol = parts[1]
+		}
+		number, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid exposed port %q", port)
+		}
+		name, err := types.NewACName(fmt.Sprintf("%s-%d", protocol, number))
+		if err != nil {
+			return err
+		}
+		app.Ports = append(app.Ports, types.Port{
+			Name:     *name,
+			Protocol: protocol,
+			Port:     uint(number),
+			Count:    1,
+		})
+	}
+
+	var volumes []string
+	for volume := range config.Volumes {
+		volumes = append(volumes, volume)
+	}
+	sort.Strings(volumes)
+	for _, volume := range volumes {
+		name, err := types.SanitizeACName("volume" + volume)
+		if err != nil {
+			return err
+		}
+		app.MountPoints = append(app.MountPoints, types.MountPoint{
+			Name: *types.MustACName(name),
+			Path: volume,
+		})
+	}
+
+	man.App = app
+	return nil
+}
+
+func setLabel(man *schema.ImageManifest, name, value string) {
+	for i, label := range man.Labels {
+		if label.Name.String() == name {
+			man.Labels[i].Value = value
+			return
+		}
+	}
+	man.Labels = append(man.Labels, types.Label{Name: *types.MustACIdentifier(name), Value: value})
+}
+
+// appcArch maps an OCI architecture and variant onto an appc architecture
+// label, undoing ociArchs.
+func appcArch(arch, variant string) string {
+	switch {
+	case arch == "386":
+		return "i386"
+	case arch == "arm64":
+		return "aarch64"
+	case arch == "arm" && variant == "v6":
+		return "armv6l"
+	case arch == "arm":
+		return "armv7l"
+	}
+	return arch
+}
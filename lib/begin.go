@@ -26,7 +26,6 @@ import (
 	"strings"
 	"unsafe"
 
-	"github.com/appc/acbuild/registry"
 	"github.com/appc/acbuild/util"
 
 	docker2aci "github.com/appc/docker2aci/lib"
@@ -99,9 +98,14 @@ func (a *ACBuild) Begin(start string, insecure bool) (err error) {
 			}
 		} else {
 			dockerPrefix := "docker://"
-			if strings.HasPrefix(start, dockerPrefix) {
+			switch {
+			case strings.HasPrefix(start, dockerPrefix):
 				start = strings.TrimPrefix(start, dockerPrefix)
 				return a.beginFromRemoteDockerImage(start, insecure)
+			case strings.HasPrefix(start, ociLayoutPrefix):
+				return a.beginFromOCILayout(strings.TrimPrefix(start, ociLayoutPrefix))
+			case strings.HasPrefix(start, dockerArchivePrefix):
+				return a.beginFromDockerArchive(strings.TrimPrefix(start, dockerArchivePrefix))
 			}
 			return a.beginFromRemoteImage(start, insecure)
 		}
@@ -262,26 +266,30 @@ func (a *ACBuild) beginFromRemoteImage(start string, insecure bool) error {
 		return err
 	}
 
-	tmpDepStoreTarPath, err := ioutil.TempDir("", "acbuild-begin-tar")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmpDepStoreTarPath)
-
-	tmpDepStoreExpandedPath, err := ioutil.TempDir("", "acbuild-begin-expanded")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tmpDepStoreExpandedPath)
+	reg := a.newRegistry(insecure)
+	if a.sharedStore {
+		release, err := a.useStore()
+		if err != nil {
+			return err
+		}
+		defer release()
+	} else {
+		// Without a shared store, the image is only kept until it's
+		// extracted
+		reg.DepStoreTarPath, err = ioutil.TempDir("", "acbuild-begin-tar")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(reg.DepStoreTarPath)
 
-	reg := registry.Registry{
-		DepStoreTarPath:      tmpDepStoreTarPath,
-		DepStoreExpandedPath: tmpDepStoreExpandedPath,
-		Insecure:             insecure,
-		Debug:                a.Debug,
+		reg.DepStoreExpandedPath, err = ioutil.TempDir("", "acbuild-begin-expanded")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(reg.DepStoreExpandedPath)
 	}
 
-	err = reg.Fetch(app.Name, labels, 0, false)
+	key, err := reg.Fetch(app.Name, labels, 0, false)
 	if err != nil {
 		if urlerr, ok := err.(*url.Error); ok {
 			if operr, ok := urlerr.Err.(*net.OpError); ok {
@@ -295,24 +303,7 @@ func (a *ACBuild) beginFromRemoteImage(start string, insecure bool) error {
 		return err
 	}
 
-	files, err := ioutil.ReadDir(tmpDepStoreTarPath)
-	if err != nil {
-		return err
-	}
-
-	if len(files) != 1 {
-		var filelist string
-		for _, file := range files {
-			if filelist == "" {
-				filelist = file.Name()
-			} else {
-				filelist = filelist + ", " + file.Name()
-			}
-		}
-		panic("unexpected number of files in store after download: " + filelist)
-	}
-
-	return util.ExtractImage(path.Join(tmpDepStoreTarPath, files[0].Name()), a.CurrentACIPath, nil)
+	return util.ExtractImage(path.Join(reg.DepStoreTarPath, key), a.CurrentACIPath, nil)
 }
 
 func (a *ACBuild) beginFromRemoteDockerImage(start string, insecure bool) (err error) {
@@ -0,0 +1,39 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"github.com/appc/acbuild/registry"
+)
+
+// CachedImages returns the ACIs in the shared store at a.SharedStorePath,
+// least recently used first. No build needs to be in progress.
+func (a *ACBuild) CachedImages() ([]registry.StoreEntry, error) {
+	return registry.Store{Path: a.SharedStorePath}.Entries()
+}
+
+// PruneCache removes the ACIs selected by opts from the shared store at
+// a.SharedStorePath, and returns them. No build needs to be in progress, but
+// none may be using the store.
+func (a *ACBuild) PruneCache(opts registry.PruneOptions) ([]registry.StoreEntry, error) {
+	return registry.Store{Path: a.SharedStorePath}.Prune(opts)
+}
+
+// GCCache removes the files left behind in the shared store at
+// a.SharedStorePath by interrupted fetches, and returns their paths. No build
+// needs to be in progress, but none may be using the store.
+func (a *ACBuild) GCCache() ([]string, error) {
+	return registry.Store{Path: a.SharedStorePath}.GC()
+}
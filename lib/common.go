@@ -19,8 +19,11 @@ import (
 	"os"
 	"path"
 	"syscall"
+	"time"
 
 	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/registry"
 )
 
 const defaultWorkPath = ".acbuild"
@@ -54,9 +57,31 @@ type ACBuild struct {
 	DepStoreExpandedPath string
 	OverlayTargetPath    string
 	OverlayWorkPath      string
+	IDMapPath            string
+	SecretsPath          string
+	TrustStorePath       string
 	Debug                bool
 
-	lockFile *os.File
+	// SharedStorePath is the path of the store shared between builds. Its
+	// ACIs are only used after UseSharedStore is called.
+	SharedStorePath string
+
+	// FetchConcurrency is the number of dependencies downloaded at once. If
+	// it isn't set, registry.DefaultConcurrency is used.
+	FetchConcurrency int
+
+	// LayerCachePath is the directory the results of run commands are cached
+	// in. If it is empty, nothing is cached.
+	LayerCachePath string
+
+	// SourceDateEpoch makes written images reproducible when it is set. Every
+	// timestamp in them is clamped to it, and nothing that depends on the
+	// host or on when the image was written is recorded.
+	SourceDateEpoch *time.Time
+
+	lockFile    *os.File
+	lockHeld    bool
+	sharedStore bool
 }
 
 // NewACBuild returns a new ACBuild struct with sane defaults for all of the
@@ -70,10 +95,49 @@ func NewACBuild(cwd string, debug bool) *ACBuild {
 		DepStoreExpandedPath: path.Join(cwd, defaultWorkPath, "depstore-expanded"),
 		OverlayTargetPath:    path.Join(cwd, defaultWorkPath, "target"),
 		OverlayWorkPath:      path.Join(cwd, defaultWorkPath, "work"),
+		IDMapPath:            path.Join(cwd, defaultWorkPath, "idmap"),
+		SecretsPath:          path.Join(cwd, defaultWorkPath, "secrets"),
+		TrustStorePath:       registry.DefaultTrustStorePath(),
+		SharedStorePath:      registry.DefaultStorePath(),
 		Debug:                debug,
 	}
 }
 
+// UseSharedStore makes the build fetch and render its dependencies in the
+// store at a.SharedStorePath, instead of in its own work path, so that they
+// are kept for other builds to use.
+func (a *ACBuild) UseSharedStore() {
+	store := registry.Store{Path: a.SharedStorePath}
+	a.DepStoreTarPath = store.TarPath()
+	a.DepStoreExpandedPath = store.ExpandedPath()
+	a.sharedStore = true
+}
+
+// newRegistry returns the registry the build's dependencies are fetched with.
+func (a *ACBuild) newRegistry(insecure bool) registry.Registry {
+	reg := registry.Registry{
+		DepStoreTarPath:      a.DepStoreTarPath,
+		DepStoreExpandedPath: a.DepStoreExpandedPath,
+		TrustStorePath:       a.TrustStorePath,
+		Insecure:             insecure,
+		Debug:                a.Debug,
+		Concurrency:          a.FetchConcurrency,
+	}
+	if a.sharedStore {
+		reg.LockPath = registry.Store{Path: a.SharedStorePath}.LockPath()
+	}
+	return reg
+}
+
+// useStore keeps the ACIs in the shared store from being removed while the
+// build uses them, until the returned function is called.
+func (a *ACBuild) useStore() (func() error, error) {
+	if !a.sharedStore {
+		return func() error { return nil }, nil
+	}
+	return registry.Store{Path: a.SharedStorePath}.Use()
+}
+
 func (a *ACBuild) lock() error {
 	_, err := os.Stat(a.ContextPath)
 	switch {
@@ -83,6 +147,10 @@ func (a *ACBuild) lock() error {
 		return err
 	}
 
+	if a.lockHeld {
+		return nil
+	}
+
 	if a.lockFile != nil {
 		return fmt.Errorf("lock already held by this ACBuild")
 	}
@@ -104,6 +172,10 @@ func (a *ACBuild) lock() error {
 }
 
 func (a *ACBuild) unlock() error {
+	if a.lockHeld {
+		return nil
+	}
+
 	if a.lockFile == nil {
 		return fmt.Errorf("lock isn't held by this ACBuild")
 	}
@@ -120,9 +192,33 @@ func (a *ACBuild) unlock() error {
 	a.lockFile = nil
 
 	err = os.Remove(a.LockPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
 
 	return nil
 }
+
+// Lock takes the lock on the build context and holds it until Unlock is
+// called, instead of each operation taking and releasing it. This lets a
+// sequence of operations, like the lines of a script, run without another
+// acbuild changing the build in between them. Copies of a made while the lock
+// is held share it.
+func (a *ACBuild) Lock() error {
+	err := a.lock()
+	if err != nil {
+		return err
+	}
+	a.lockHeld = true
+	return nil
+}
+
+// Unlock releases the lock taken by Lock. It can be called after End, in which
+// case the lock file is already gone.
+func (a *ACBuild) Unlock() error {
+	if !a.lockHeld {
+		return fmt.Errorf("lock isn't held by this ACBuild")
+	}
+	a.lockHeld = false
+	return a.unlock()
+}
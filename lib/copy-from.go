@@ -0,0 +1,495 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/discovery"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/util"
+)
+
+// copySource is where the files copied into the current ACI are read from.
+type copySource struct {
+	// roots are the root filesystems the files are looked up in, from the
+	// topmost layer of the image down. If it's empty, the files are read
+	// from the host.
+	roots []string
+	// files holds the file map of each of roots' images, as rendered on top
+	// of the layers below. It's nil unless the files are read from an image
+	// in the store.
+	files []map[string]struct{}
+	name  string
+	// tmpDir is removed once the copy is done
+	tmpDir string
+	// release, if set, is called once the copy is done
+	release func() error
+}
+
+// openCopySource finds the root filesystem the files at paths, copied into the
+// current ACI with the given options, are read from, extracting or fetching the
+// image it belongs to if needed.
+func (a *ACBuild) openCopySource(opts CopyOptions, paths []string) (*copySource, error) {
+	if opts.From == "" {
+		return &copySource{}, nil
+	}
+
+	info, err := os.Stat(opts.From)
+	switch {
+	case err == nil && info.IsDir():
+		return openWorkPathSource(opts.From)
+	case err == nil:
+		return openACISource(opts.From, paths)
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+	return a.openImageSource(opts.From, opts.Insecure)
+}
+
+// openWorkPathSource reads the files from the current ACI of the build in the
+// given work path. The path of the build's context directory itself is also
+// accepted.
+func openWorkPathSource(workPath string) (*copySource, error) {
+	for _, contextPath := range []string{path.Join(workPath, defaultWorkPath), workPath} {
+		currentACIPath := path.Join(contextPath, "currentaci")
+		_, err := os.Stat(path.Join(currentACIPath, aci.ManifestFile))
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return nil, err
+		}
+		return &copySource{
+			roots: []string{path.Join(currentACIPath, aci.RootfsDir)},
+			name:  workPath,
+		}, nil
+	}
+	return nil, fmt.Errorf("%s is neither an ACI nor the work path of a build", workPath)
+}
+
+// openACISource extracts the ACI at aciPath to read the files from. Only the
+// files under paths are extracted, unless a symlink has to be followed to
+// find them.
+func openACISource(aciPath string, paths []string) (src *copySource, err error) {
+	fileMap, err := aciFileMap(aciPath, paths)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := ioutil.TempDir("", "acbuild-copy-from")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(tmpDir)
+		}
+	}()
+
+	err = util.ExtractImage(aciPath, tmpDir, fileMap)
+	if err != nil {
+		return nil, err
+	}
+	_, err = os.Stat(path.Join(tmpDir, aci.ManifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't an ACI: %v", aciPath, err)
+	}
+	return &copySource{
+		roots:  []string{path.Join(tmpDir, aci.RootfsDir)},
+		name:   aciPath,
+		tmpDir: tmpDir,
+	}, nil
+}
+
+// aciFileMap returns the file map extracting the manifest of the ACI at aciPath
+// and the files under paths in its rootfs, which can end in shell patterns.
+// It's nil if one of the paths isn't in the ACI as it's written, as there's a
+// symlink in the way.
+func aciFileMap(aciPath string, paths []string) (map[string]struct{}, error) {
+	file, err := os.Open(aciPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	dr, err := aci.NewCompressedReader(file)
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing image: %v", err)
+	}
+	defer dr.Close()
+
+	prefixes := make([]string, len(paths))
+	found := make([]bool, len(paths))
+	for i, p := range paths {
+		prefixes[i] = path.Join(aci.RootfsDir, path.Clean("/"+p))
+	}
+
+	fileMap := map[string]struct{}{aci.ManifestFile: struct{}{}}
+	tr := tar.NewReader(dr)
+	for {
+		hdr, err := tr.Next()
+		switch {
+		case err == io.EOF:
+			for _, f := range found {
+				if !f {
+					return nil, nil
+				}
+			}
+			return fileMap, nil
+		case err != nil:
+			return nil, err
+		}
+		name := path.Clean(hdr.Name)
+		for i, prefix := range prefixes {
+			if prefix == aci.RootfsDir || pathHasPrefix(name, prefix) {
+				fileMap[name] = struct{}{}
+				found[i] = true
+			}
+		}
+	}
+}
+
+// pathHasPrefix returns whether p is prefix, or is under it. The last element
+// of prefix can be a shell pattern.
+func pathHasPrefix(p, prefix string) bool {
+	parts := strings.Split(p, "/")
+	n := strings.Count(prefix, "/") + 1
+	if len(parts) < n {
+		return false
+	}
+	matched, _ := path.Match(prefix, strings.Join(parts[:n], "/"))
+	return matched
+}
+
+// openImageSource fetches the image with the given name, with any labels
+// written as in "example.com/app:1.0,os=linux", into the build's depstore,
+// and reads the files from its layers.
+func (a *ACBuild) openImageSource(name string, insecure bool) (_ *copySource, err error) {
+	app, err := discovery.NewAppFromString(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s isn't a file, a directory or an image name: %v", name, err)
+	}
+	var labels types.Labels
+	for labelName, value := range app.Labels {
+		labels = append(labels, types.Label{Name: labelName, Value: value})
+	}
+
+	release, err := a.useStore()
+	if err != nil {
+		return nil, err
+	}
+	src := &copySource{name: name, release: release}
+	defer func() {
+		if err != nil {
+			src.close()
+		}
+	}()
+
+	reg := a.newRegistry(insecure)
+	key, err := reg.FetchAndRenderDependency(types.Dependency{ImageName: app.Name, Labels: labels})
+	if err != nil {
+		return nil, err
+	}
+	// The renderer doesn't check for cycles
+	_, err = genDeplist(key, reg)
+	if err != nil {
+		return nil, err
+	}
+
+	imageID, err := types.NewHash(key)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := acirenderer.GetRenderedACIWithImageID(*imageID, reg)
+	if err != nil {
+		return nil, err
+	}
+	for _, files := range rendered {
+		src.roots = append(src.roots, path.Join(a.DepStoreExpandedPath, files.Key, aci.RootfsDir))
+		src.files = append(src.files, files.FileMap)
+	}
+	return src, nil
+}
+
+// resolve returns the path on the host of the file at p in the source.
+func (src *copySource) resolve(p string) (string, error) {
+	hostPath, ok, err := src.lookup(p)
+	if err != nil {
+		return "", err
+	}
+	if !ok {
+		return "", fmt.Errorf("%s doesn't exist in %s", p, src.name)
+	}
+	return hostPath, nil
+}
+
+// lookup returns the path on the host of the file at p in the source, and
+// whether it exists. Symlinks are followed in the topmost layer of the image
+// that has p. The layers are then merged the way write --squash merges them,
+// so that files hidden by whiteouts or left out by a path whitelist aren't
+// found, and a directory spread over several layers is merged into a
+// temporary directory.
+func (src *copySource) lookup(p string) (string, bool, error) {
+	if len(src.roots) == 0 {
+		return p, true, nil
+	}
+	var relpath string
+	for _, root := range src.roots {
+		hostPath, err := util.ResolveInRoot(root, p)
+		if err != nil {
+			return "", false, err
+		}
+		_, err = os.Lstat(hostPath)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return "", false, err
+		}
+		if src.files == nil {
+			return hostPath, true, nil
+		}
+		// The path relative to the rendered image, like the squasher
+		// and the file maps use
+		relpath, err = filepath.Rel(filepath.Dir(root), hostPath)
+		if err != nil {
+			return "", false, err
+		}
+		break
+	}
+	if relpath == "" {
+		return "", false, nil
+	}
+
+	layers, err := src.walkLayers(relpath)
+	if err != nil {
+		return "", false, err
+	}
+	if len(layers) == 0 {
+		return "", false, nil
+	}
+	if !layers[0].info.IsDir() {
+		return layers[0].hostPath, true, nil
+	}
+	merged, err := src.merge(relpath, layers)
+	if err != nil {
+		return "", false, err
+	}
+	return merged, true, nil
+}
+
+// layerFile is a file from one of the layers of an image.
+type layerFile struct {
+	hostPath string
+	relpath  string
+	info     os.FileInfo
+}
+
+// walkLayers returns the files at and under relpath in the source's layers
+// that aren't hidden by the layers above them, from the top layer down.
+func (src *copySource) walkLayers(relpath string) ([]layerFile, error) {
+	s := &squasher{
+		seen:   make(map[string]os.FileMode),
+		hidden: make(map[string]bool),
+		opaque: make(map[string]bool),
+	}
+	var layers []layerFile
+	for i, root := range src.roots {
+		dir := filepath.Dir(root)
+		walk := s.walker(dir, src.files[i], func(p string, info os.FileInfo, err error) error {
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if rel == relpath || strings.HasPrefix(rel, relpath+"/") {
+				layers = append(layers, layerFile{p, rel, info})
+			}
+			return nil
+		})
+		// Only the directories leading to relpath are walked above it,
+		// so that the squasher sees the whiteouts and opaque
+		// directories on the way
+		err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if rel != "." && rel != relpath && !strings.HasPrefix(relpath, rel+"/") && !strings.HasPrefix(rel, relpath+"/") {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			return walk(p, info, nil)
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return layers, nil
+}
+
+// merge copies the given files from the layers of the directory at relpath
+// into a temporary directory, and returns its path.
+func (src *copySource) merge(relpath string, layers []layerFile) (string, error) {
+	if src.tmpDir == "" {
+		tmpDir, err := ioutil.TempDir("", "acbuild-copy-from")
+		if err != nil {
+			return "", err
+		}
+		src.tmpDir = tmpDir
+	}
+	mergeDir, err := ioutil.TempDir(src.tmpDir, "merged")
+	if err != nil {
+		return "", err
+	}
+	// The merged directory keeps its name, as copy-to-dir copies it under it
+	merged := filepath.Join(mergeDir, filepath.Base(relpath))
+
+	// Only the file itself is copied, not what's under it, as that can
+	// come from other layers
+	onlyFile := util.CopyTreeOptions{Exclude: func(string) bool { return true }}
+	var dirs []layerFile
+	for _, f := range layers {
+		rel, err := filepath.Rel(relpath, f.relpath)
+		if err != nil {
+			return "", err
+		}
+		err = util.CopyTree(f.hostPath, filepath.Join(merged, rel), onlyFile)
+		if err != nil {
+			return "", err
+		}
+		if f.info.IsDir() {
+			dirs = append(dirs, f)
+		}
+	}
+
+	// Copying files into the directories changed their times, so they're
+	// restored once everything has been copied
+	for _, d := range dirs {
+		rel, err := filepath.Rel(relpath, d.relpath)
+		if err != nil {
+			return "", err
+		}
+		err = os.Chtimes(filepath.Join(merged, rel), d.info.ModTime(), d.info.ModTime())
+		if err != nil {
+			return "", err
+		}
+	}
+	return merged, nil
+}
+
+// glob returns the paths on the host of the files matching the shell pattern
+// p in the source. For images, patterns can only be used in the last element
+// of p, and every layer of the image is searched for matches.
+func (src *copySource) glob(p string) ([]string, error) {
+	if !hasMeta(p) {
+		hostPath, err := src.resolve(p)
+		if err != nil {
+			return nil, err
+		}
+		return []string{hostPath}, nil
+	}
+
+	if len(src.roots) == 0 {
+		matches, err := filepath.Glob(p)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", p)
+		}
+		return matches, nil
+	}
+
+	dir, pattern := path.Split(path.Clean("/" + p))
+	if hasMeta(dir) {
+		return nil, fmt.Errorf("%s: patterns can only be used in the last element of paths in %s", p, src.name)
+	}
+	var matches []string
+	seen := make(map[string]bool)
+	for _, root := range src.roots {
+		// Resolve a placeholder in the directory to resolve the
+		// directory itself, symlinks and all
+		hostDir, err := util.ResolveInRoot(root, path.Join(dir, "_"))
+		if err != nil {
+			return nil, err
+		}
+		names, err := readDirNames(filepath.Dir(hostDir))
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range names {
+			if matched, _ := path.Match(pattern, name); !matched || seen[name] {
+				continue
+			}
+			seen[name] = true
+			// The match may be hidden by a layer above
+			hostPath, ok, err := src.lookup(path.Join(dir, name))
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				matches = append(matches, hostPath)
+			}
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no files match %s in %s", p, src.name)
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// readDirNames returns the names of the entries in dir, or nothing if it
+// doesn't exist.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+func (src *copySource) close() error {
+	var err error
+	if src.tmpDir != "" {
+		err = os.RemoveAll(src.tmpDir)
+	}
+	if src.release != nil {
+		if err1 := src.release(); err == nil {
+			err = err1
+		}
+	}
+	return err
+}
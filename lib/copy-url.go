@@ -0,0 +1,160 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/aci"
+
+	"github.com/appc/acbuild/registry"
+	"github.com/appc/acbuild/util"
+)
+
+// CopyURLOptions changes how CopyURL downloads a file into the current ACI.
+type CopyURLOptions struct {
+	// SHA256 is the hex encoded sha256 digest the downloaded file must have.
+	SHA256 string
+
+	// Extract makes the downloaded file be treated as a tarball, optionally
+	// compressed, and extracted into the target directory.
+	Extract bool
+
+	// Insecure allows the download to be made over https without checking
+	// the server's certificate.
+	Insecure bool
+
+	// Chown and Chmod are the owner and mode given to the downloaded file,
+	// as for CopyOptions. They can't be used with Extract.
+	Chown string
+	Chmod *os.FileMode
+}
+
+// CopyURL downloads the file at rawurl into the current ACI, at the path to.
+// If to ends in a slash or is an existing directory, the file is placed in it
+// under the last element of the URL's path. The file's digest is checked
+// before anything is written into the ACI.
+func (a *ACBuild) CopyURL(rawurl, to string, opts CopyURLOptions) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	expected := strings.ToLower(opts.SHA256)
+	if b, err := hex.DecodeString(expected); err != nil || len(b) != sha256.Size {
+		return fmt.Errorf("invalid sha256 digest %q", opts.SHA256)
+	}
+	if opts.Extract && (opts.Chown != "" || opts.Chmod != nil) {
+		return fmt.Errorf("the owner and mode can't be changed when extracting")
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("unsupported URL %q, only http and https are supported", rawurl)
+	}
+	name := path.Base(u.Path)
+
+	tmpFile, err := ioutil.TempFile(a.ContextPath, "download-")
+	if err != nil {
+		return err
+	}
+	tmpFile.Close()
+	defer os.Remove(tmpFile.Name())
+
+	reg := registry.Registry{
+		Insecure: opts.Insecure,
+		Debug:    a.Debug,
+	}
+	err = reg.Download(rawurl, tmpFile.Name(), name)
+	if err != nil {
+		return fmt.Errorf("error downloading %s: %v", rawurl, err)
+	}
+
+	digest, err := sha256File(tmpFile.Name())
+	if err != nil {
+		return err
+	}
+	if digest != expected {
+		return fmt.Errorf("sha256 digest of %s is %s, expected %s", rawurl, digest, expected)
+	}
+
+	target := path.Join(a.CurrentACIPath, aci.RootfsDir, to)
+	if opts.Extract {
+		err := os.MkdirAll(target, 0755)
+		if err != nil {
+			return err
+		}
+		return util.ExtractImage(tmpFile.Name(), target, nil)
+	}
+
+	info, err := os.Stat(target)
+	switch {
+	case err == nil && info.IsDir(), strings.HasSuffix(to, "/"):
+		if name == "/" || name == "." {
+			return fmt.Errorf("can't name the file downloaded from %s, give its full path in the ACI", rawurl)
+		}
+		target = path.Join(target, name)
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	err = os.MkdirAll(path.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	treeOpts, err := a.copyTreeOptions(CopyOptions{Chown: opts.Chown, Chmod: opts.Chmod})
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmpFile.Name(), 0644)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return util.CopyTree(tmpFile.Name(), target, treeOpts)
+}
+
+// sha256File returns the hex encoded sha256 digest of the file at p.
+func sha256File(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -18,15 +18,56 @@ import (
 	"fmt"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 
 	"github.com/appc/spec/aci"
-	"github.com/coreos/rkt/pkg/fileutil"
-	"github.com/coreos/rkt/pkg/user"
+
+	"github.com/appc/acbuild/util"
 )
 
+// CopyOptions changes where CopyToTarget and CopyToDir copy files from, and
+// how the copies are made.
+type CopyOptions struct {
+	// From is the image the files are copied out of. It can be the path of
+	// an ACI, the work path of another build, or the name of an image to
+	// fetch. If it's empty, the files are copied from the host.
+	From string
+
+	// Insecure disables the signature verification of an image fetched to
+	// copy files out of.
+	Insecure bool
+
+	// Chown, in the format USER[:GROUP], is the owner given to the copied
+	// files. The user and group can be names from the current ACI's
+	// /etc/passwd and /etc/group, or numeric ids. If the group is left out
+	// it's the same as the user.
+	Chown string
+
+	// Chmod, if set, is the mode given to the copied files. Directories keep
+	// their own mode.
+	Chmod *os.FileMode
+
+	// Exclude holds shell patterns of files not to copy. Patterns without a
+	// slash are matched against the names of files at any depth, and other
+	// patterns against their paths relative to the target: the directory
+	// for CopyToDir, or the file or directory being copied for CopyToTarget.
+	Exclude []string
+
+	// IgnoreFile is the path of a file listing files not to copy, in the
+	// format of a .dockerignore file. If it's empty, the .acbuildignore
+	// file of each directory copied from the host is used, if it has one.
+	IgnoreFile string
+}
+
+// ignoreFileName is the name of the file in a directory copied from the host
+// that lists the files in it not to copy.
+const ignoreFileName = ".acbuildignore"
+
 // CopyToDir will copy all elements specified in the froms slice into the
-// directory inside the current ACI specified by the to string.
-func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
+// directory inside the current ACI specified by the to string. The froms can
+// be shell patterns, in which case every matching file is copied.
+func (a *ACBuild) CopyToDir(froms []string, to string, opts CopyOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -36,6 +77,11 @@ func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
 		}
 	}()
 
+	treeOpts, err := a.copyTreeOptions(opts)
+	if err != nil {
+		return err
+	}
+
 	target := path.Join(a.CurrentACIPath, aci.RootfsDir, to)
 
 	targetInfo, err := os.Stat(target)
@@ -51,20 +97,43 @@ func (a *ACBuild) CopyToDir(froms []string, to string) (err error) {
 		return fmt.Errorf("target %q is not a directory", to)
 	}
 
+	src, err := a.openCopySource(opts, froms)
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
 	for _, from := range froms {
-		_, file := path.Split(from)
-		tmptarget := path.Join(target, file)
-		err := fileutil.CopyTree(from, tmptarget, user.NewBlankUidRange())
+		srcPaths, err := src.glob(from)
 		if err != nil {
 			return err
 		}
+		for _, srcPath := range srcPaths {
+			_, file := path.Split(from)
+			if hasMeta(from) {
+				file = filepath.Base(srcPath)
+			}
+			fileOpts, skip, err := src.treeOptions(treeOpts, from, srcPath, file, opts.IgnoreFile)
+			if err != nil {
+				return err
+			}
+			if skip {
+				continue
+			}
+			tmptarget := path.Join(target, file)
+			err = util.CopyTree(srcPath, tmptarget, fileOpts)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 // CopyToTarget will copy a single file/directory from the from string to the
-// path specified by the to string inside the current ACI.
-func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
+// path specified by the to string inside the current ACI. The from string can
+// be a shell pattern, as long as it only matches one file.
+func (a *ACBuild) CopyToTarget(from string, to string, opts CopyOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -74,6 +143,11 @@ func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
 		}
 	}()
 
+	treeOpts, err := a.copyTreeOptions(opts)
+	if err != nil {
+		return err
+	}
+
 	target := path.Join(a.CurrentACIPath, aci.RootfsDir, to)
 
 	dir, _ := path.Split(target)
@@ -84,5 +158,167 @@ func (a *ACBuild) CopyToTarget(from string, to string) (err error) {
 		}
 	}
 
-	return fileutil.CopyTree(from, target, user.NewBlankUidRange())
+	src, err := a.openCopySource(opts, []string{from})
+	if err != nil {
+		return err
+	}
+	defer src.close()
+
+	srcPaths, err := src.glob(from)
+	if err != nil {
+		return err
+	}
+	if len(srcPaths) != 1 {
+		return fmt.Errorf("%s matches %d files, use copy-to-dir to copy more than one", from, len(srcPaths))
+	}
+	treeOpts, _, err = src.treeOptions(treeOpts, from, srcPaths[0], "", opts.IgnoreFile)
+	if err != nil {
+		return err
+	}
+	return util.CopyTree(srcPaths[0], target, treeOpts)
+}
+
+// copyTreeOptions translates opts into the options for util.CopyTree, looking
+// up the owner in the current ACI.
+func (a *ACBuild) copyTreeOptions(opts CopyOptions) (util.CopyTreeOptions, error) {
+	var treeOpts util.CopyTreeOptions
+
+	if opts.Chown != "" {
+		parts := strings.SplitN(opts.Chown, ":", 2)
+		rootfs := path.Join(a.CurrentACIPath, aci.RootfsDir)
+		uid, err := util.LookupUID(rootfs, parts[0])
+		if err != nil {
+			return treeOpts, err
+		}
+		gid := uid
+		if len(parts) == 2 {
+			gid, err = util.LookupGID(rootfs, parts[1])
+			if err != nil {
+				return treeOpts, err
+			}
+		}
+		treeOpts.Chown, treeOpts.UID, treeOpts.GID = true, uid, gid
+	}
+
+	if opts.Chmod != nil {
+		treeOpts.Chmod, treeOpts.Mode = true, *opts.Chmod
+	}
+
+	if len(opts.Exclude) != 0 {
+		for _, pattern := range opts.Exclude {
+			if _, err := filepath.Match(pattern, ""); err != nil {
+				return treeOpts, fmt.Errorf("bad exclude pattern %q: %v", pattern, err)
+			}
+		}
+		treeOpts.Exclude = func(relpath string) bool {
+			return matchesAny(opts.Exclude, relpath)
+		}
+	}
+	return treeOpts, nil
+}
+
+// treeOptions returns treeOpts adjusted for copying the file at srcPath,
+// matched by the from argument, to name in the target directory, or to the
+// target itself if name is empty. Files copied from the host are also checked
+// against the ignore file, and skip is set if srcPath itself is excluded, by
+// the exclude patterns whether or not from is a pattern, and by the ignore
+// file of the directory it's in if from is a pattern.
+func (s *copySource) treeOptions(treeOpts util.CopyTreeOptions, from, srcPath, name, ignoreFile string) (opts util.CopyTreeOptions, skip bool, err error) {
+	exclude := treeOpts.Exclude
+
+	// The ignore file's patterns are relative to the directory being copied,
+	// or to the directory a pattern's matches are in
+	var ignored func(string) bool
+	var prefix string
+	if s.roots == nil {
+		ignoreDir := srcPath
+		if hasMeta(from) {
+			ignoreDir, prefix = filepath.Split(srcPath)
+		}
+		info, err := os.Stat(ignoreDir)
+		if err != nil {
+			return treeOpts, false, err
+		}
+		if info.IsDir() {
+			ignored, err = hostIgnored(ignoreDir, ignoreFile)
+			if err != nil {
+				return treeOpts, false, err
+			}
+		}
+	}
+
+	treeOpts.Exclude = func(relpath string) bool {
+		if exclude != nil && exclude(filepath.Join(name, relpath)) {
+			return true
+		}
+		return ignored != nil && ignored(filepath.Join(prefix, relpath))
+	}
+	if name != "" {
+		if hasMeta(from) {
+			skip = treeOpts.Exclude(".")
+		} else {
+			skip = exclude != nil && exclude(name)
+		}
+	}
+	return treeOpts, skip, nil
+}
+
+// hostIgnored returns a function reporting whether a file under the host
+// directory dir, given relative to it, is matched by the patterns in
+// ignoreFile, or in dir's .acbuildignore if ignoreFile is empty. The work
+// directories of builds are always ignored.
+func hostIgnored(dir, ignoreFile string) (func(string) bool, error) {
+	if ignoreFile == "" {
+		ignoreFile = filepath.Join(dir, ignoreFileName)
+		if _, err := os.Stat(ignoreFile); os.IsNotExist(err) {
+			ignoreFile = ""
+		}
+	}
+	var m *util.IgnoreMatcher
+	if ignoreFile != "" {
+		var err error
+		m, err = util.ReadIgnoreFile(ignoreFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading ignore file: %v", err)
+		}
+	}
+
+	return func(relpath string) bool {
+		if filepath.Base(relpath) == defaultWorkPath {
+			return true
+		}
+		if m == nil || !m.Matches(relpath) {
+			return false
+		}
+		// An ignored directory is still walked if some of the files
+		// under it may be included again
+		if m.MayIncludeUnder(relpath) {
+			info, err := os.Lstat(filepath.Join(dir, relpath))
+			return err != nil || !info.IsDir()
+		}
+		return true
+	}, nil
+}
+
+// matchesAny returns whether relpath matches one of the patterns. Patterns
+// without a slash are matched against the last element of relpath, others
+// against all of it.
+func matchesAny(patterns []string, relpath string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		name := relpath
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(relpath)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMeta returns whether p contains any of the special characters of shell
+// patterns.
+func hasMeta(p string) bool {
+	return strings.ContainsAny(p, `*?[\`)
 }
@@ -21,6 +21,22 @@ import (
 	"github.com/appc/spec/schema/types"
 )
 
+// DependencyChange describes the image a dependency was pinned to by
+// LockDependencies or UpdateDependencies.
+type DependencyChange struct {
+	ImageName types.ACIdentifier
+	// OldImageID is the image ID the dependency had before, if any
+	OldImageID *types.Hash
+	ImageID    types.Hash
+	Size       uint
+}
+
+// Changed returns whether the dependency was pinned to a different image than
+// before.
+func (c DependencyChange) Changed() bool {
+	return c.OldImageID == nil || *c.OldImageID != c.ImageID
+}
+
 func removeDep(imageName types.ACIdentifier) func(*schema.ImageManifest) error {
 	return func(s *schema.ImageManifest) error {
 		foundOne := false
@@ -85,3 +101,83 @@ func (a *ACBuild) RemoveDependency(imageName string) (err error) {
 
 	return util.ModifyManifest(removeDep(*acid), a.CurrentACIPath)
 }
+
+// LockDependencies will pin every dependency of the untarred ACI stored at
+// a.CurrentACIPath that doesn't have an image ID to the image it currently
+// resolves to, by setting the dependency's image ID and size to the image's.
+// Images are fetched into the depstore if they aren't already there. Once a
+// dependency has an image ID, run refuses to use any other image for it.
+func (a *ACBuild) LockDependencies(insecure bool) ([]DependencyChange, error) {
+	return a.pinDependencies(insecure, false)
+}
+
+// UpdateDependencies will fetch the images matching the names and labels of
+// every dependency of the untarred ACI stored at a.CurrentACIPath again, even
+// if they are already in the depstore, and pin the dependencies to them.
+func (a *ACBuild) UpdateDependencies(insecure bool) ([]DependencyChange, error) {
+	return a.pinDependencies(insecure, true)
+}
+
+func (a *ACBuild) pinDependencies(insecure, update bool) (changes []DependencyChange, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	man, err := util.GetManifest(a.CurrentACIPath)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := a.useStore()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	reg := a.newRegistry(insecure)
+	deps := man.Dependencies
+	for i, dep := range deps {
+		change := DependencyChange{
+			ImageName:  dep.ImageName,
+			OldImageID: dep.ImageID,
+		}
+		if dep.ImageID != nil && !update {
+			change.ImageID, change.Size = *dep.ImageID, dep.Size
+			changes = append(changes, change)
+			continue
+		}
+
+		var key string
+		if update {
+			key, err = reg.FetchLatest(dep.ImageName, dep.Labels)
+		} else {
+			key, err = reg.Fetch(dep.ImageName, dep.Labels, dep.Size, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+		imageID, err := types.NewHash(key)
+		if err != nil {
+			return nil, err
+		}
+		size, err := reg.Size(key)
+		if err != nil {
+			return nil, err
+		}
+
+		deps[i].ImageID, deps[i].Size = imageID, size
+		change.ImageID, change.Size = *imageID, size
+		changes = append(changes, change)
+	}
+
+	fn := func(s *schema.ImageManifest) error {
+		s.Dependencies = deps
+		return nil
+	}
+	return changes, util.ModifyManifest(fn, a.CurrentACIPath)
+}
@@ -0,0 +1,158 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/registry"
+	"github.com/appc/acbuild/util"
+)
+
+// DependencyNode is an image in the dependency tree of an ACI, as resolved in
+// the depstore.
+type DependencyNode struct {
+	ImageName types.ACIdentifier `json:"imageName"`
+	Labels    types.Labels       `json:"labels,omitempty"`
+	ImageID   string             `json:"imageID,omitempty"`
+	Size      uint               `json:"size,omitempty"`
+	// Duplicate is set on every occurrence of an image in the tree but the
+	// first, whose dependencies are only listed under the first one
+	Duplicate    bool              `json:"duplicate,omitempty"`
+	Dependencies []*DependencyNode `json:"dependencies,omitempty"`
+}
+
+// DependencyTree will resolve the dependencies of the untarred ACI stored at
+// a.CurrentACIPath, and the dependencies of those, fetching them into the
+// depstore if needed. The returned node is the current ACI itself, which has
+// no image ID. An error is returned if the dependencies form a cycle.
+func (a *ACBuild) DependencyTree(insecure bool) (root *DependencyNode, err error) {
+	if err = a.lock(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	man, err := util.GetManifest(a.CurrentACIPath)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := a.useStore()
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	t := depTree{
+		reg:  a.newRegistry(insecure),
+		seen: make(map[string]bool),
+	}
+	root = &DependencyNode{
+		ImageName: man.Name,
+		Labels:    man.Labels,
+	}
+	for _, dep := range man.Dependencies {
+		node, err := t.node(dep, nil)
+		if err != nil {
+			return nil, err
+		}
+		root.Dependencies = append(root.Dependencies, node)
+	}
+	return root, nil
+}
+
+// depTree fetches and resolves the images in a dependency tree.
+type depTree struct {
+	reg  registry.Registry
+	seen map[string]bool
+}
+
+// node returns the node for the image dep refers to, whose dependents are in
+// chain.
+func (t depTree) node(dep types.Dependency, chain depChain) (*DependencyNode, error) {
+	// Only the image itself is fetched, so that its dependencies are fetched
+	// here after checking for cycles
+	key, err := t.reg.FetchDependency(dep)
+	if err != nil {
+		return nil, err
+	}
+	man, err := t.reg.GetImageManifest(key)
+	if err != nil {
+		return nil, err
+	}
+	chain, err = chain.add(key, man.Name)
+	if err != nil {
+		return nil, err
+	}
+	size, err := t.reg.Size(key)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &DependencyNode{
+		ImageName: man.Name,
+		Labels:    man.Labels,
+		ImageID:   key,
+		Size:      size,
+		Duplicate: t.seen[key],
+	}
+	if node.Duplicate {
+		return node, nil
+	}
+	t.seen[key] = true
+
+	for _, subdep := range man.Dependencies {
+		subnode, err := t.node(subdep, chain)
+		if err != nil {
+			return nil, err
+		}
+		node.Dependencies = append(node.Dependencies, subnode)
+	}
+	return node, nil
+}
+
+// depChain is the chain of images that led to the dependency being resolved,
+// starting with the outermost one.
+type depChain []depLink
+
+type depLink struct {
+	key  string
+	name types.ACIdentifier
+}
+
+// add returns the chain extended with the image with the given key and name,
+// or an error naming the images in the cycle if the image is already in it.
+func (c depChain) add(key string, name types.ACIdentifier) (depChain, error) {
+	for i, link := range c {
+		if link.key != key {
+			continue
+		}
+		var names []string
+		for _, l := range c[i:] {
+			names = append(names, string(l.name))
+		}
+		names = append(names, string(name))
+		return nil, fmt.Errorf("dependency cycle: %s", strings.Join(names, " -> "))
+	}
+	// Copy the chain, as siblings extend the same parent chain
+	return append(c[:len(c):len(c)], depLink{key, name}), nil
+}
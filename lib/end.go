@@ -40,6 +40,11 @@ func (a *ACBuild) End() error {
 		return err
 	}
 
+	err = util.MaybeUnmount(a.secretsTmpfsPath())
+	if err != nil {
+		return err
+	}
+
 	err = os.RemoveAll(a.ContextPath)
 	if err != nil {
 		return err
@@ -0,0 +1,335 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema/types"
+	"github.com/coreos/rkt/pkg/fileutil"
+
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/acbuild/util"
+	"github.com/appc/acbuild/util/fsdiffer"
+)
+
+const (
+	runCacheDeltaFile    = "delta.tar"
+	runCacheMetadataFile = "metadata"
+
+	// overlayOpaqueXattr marks a directory in an overlayfs upper dir whose
+	// contents hide the contents of the same directory in the lower dirs
+	overlayOpaqueXattr = "trusted.overlay.opaque"
+)
+
+// runCacheMetadata holds the parts of a cached run's result that can't be
+// stored in its delta tarball.
+type runCacheMetadata struct {
+	Deleted []string `json:"deleted"`
+	Opaque  []string `json:"opaque"`
+}
+
+// runCacheKeyData is everything that can influence the result of a run, and
+// is hashed to produce the run's cache key.
+type runCacheKeyData struct {
+	Manifest   json.RawMessage   `json:"manifest"`
+	Rootfs     string            `json:"rootfs"`
+	Deps       []string          `json:"deps"`
+	Cmd        []string          `json:"cmd"`
+	WorkingDir string            `json:"workingDir"`
+	Env        types.Environment `json:"env"`
+	Engine     string            `json:"engine"`
+	Mounts     []engine.Mount    `json:"mounts,omitempty"`
+	Secrets    []Secret          `json:"secrets,omitempty"`
+	User       string            `json:"user,omitempty"`
+	Group      string            `json:"group,omitempty"`
+}
+
+// runCacheKey returns the key under which the result of running cmd on the
+// current state of the build is stored in the layer cache. deps are the keys
+// of the rendered dependencies of the current ACI, and mounts are what is
+// mounted into the container. Only where things are mounted from is part of
+// the key, not what the mounts contain, and only the ids and targets of the
+// secrets in opts.
+func (a *ACBuild) runCacheKey(cmd []string, workingDir string, env types.Environment, runEngine engine.Engine, deps []string, mounts []engine.Mount, opts RunOptions) (string, error) {
+	manblob, err := ioutil.ReadFile(filepath.Join(a.CurrentACIPath, aci.ManifestFile))
+	if err != nil {
+		return "", err
+	}
+
+	rootfsHash, err := hashRootfs(filepath.Join(a.CurrentACIPath, aci.RootfsDir))
+	if err != nil {
+		return "", err
+	}
+
+	blob, err := json.Marshal(runCacheKeyData{
+		Manifest:   manblob,
+		Rootfs:     rootfsHash,
+		Deps:       deps,
+		Cmd:        cmd,
+		WorkingDir: workingDir,
+		Env:        env,
+		Engine:     fmt.Sprintf("%T%+v", runEngine, runEngine),
+		Mounts:     mounts,
+		Secrets:    opts.Secrets,
+		User:       opts.User,
+		Group:      opts.Group,
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("sha512-%x", sha512.Sum512(blob)), nil
+}
+
+// hashRootfs hashes the contents, modes, ownership, extended attributes and
+// link targets of every file under rootfs. Modification times are ignored, so that the same files
+// copied in from a fresh checkout produce the same hash.
+func hashRootfs(rootfs string) (string, error) {
+	h := sha512.New()
+	err := filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(h, "%q %o %d %d %d\n", relpath, hdr.Mode, hdr.Uid, hdr.Gid, hdr.Size)
+
+		xattrs, err := listXattrs(path)
+		if err != nil {
+			return err
+		}
+		for _, name := range xattrs {
+			value, err := fileutil.Lgetxattr(path, name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "xattr %q %q\n", name, value)
+		}
+
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%q\n", target)
+		case info.Mode().IsRegular():
+			f, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(h, f)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
+
+// listXattrs returns the sorted names of the extended attributes of the file
+// at path, without following symlinks.
+func listXattrs(path string) ([]string, error) {
+	pathBytes, err := syscall.BytePtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		// The size of the list is asked for first
+		sz, _, errno := syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), 0, 0)
+		switch {
+		case errno == syscall.ENOTSUP:
+			return nil, nil
+		case errno != 0:
+			return nil, errno
+		case sz == 0:
+			return nil, nil
+		}
+		list := make([]byte, sz)
+		sz, _, errno = syscall.Syscall(syscall.SYS_LLISTXATTR, uintptr(unsafe.Pointer(pathBytes)), uintptr(unsafe.Pointer(&list[0])), uintptr(len(list)))
+		// Attributes can be added in between
+		if errno == syscall.ERANGE {
+			continue
+		}
+		if errno != 0 {
+			return nil, errno
+		}
+		names := strings.Split(strings.TrimSuffix(string(list[:sz]), "\x00"), "\x00")
+		sort.Strings(names)
+		return names, nil
+	}
+}
+
+// restoreRunCache applies the cached result of a run stored at entry to rootfs.
+func restoreRunCache(entry, rootfs string) error {
+	blob, err := ioutil.ReadFile(filepath.Join(entry, runCacheMetadataFile))
+	if err != nil {
+		return err
+	}
+	var meta runCacheMetadata
+	err = json.Unmarshal(blob, &meta)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range meta.Deleted {
+		err := os.RemoveAll(filepath.Join(rootfs, p))
+		if err != nil {
+			return err
+		}
+	}
+
+	delta, err := os.Open(filepath.Join(entry, runCacheDeltaFile))
+	if err != nil {
+		return err
+	}
+	defer delta.Close()
+	err = util.ExtractTar(delta, rootfs, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range meta.Opaque {
+		err := fileutil.Lsetxattr(filepath.Join(rootfs, p), overlayOpaqueXattr, []byte("y"), 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveRunCache stores the given changes to rootfs as a cache entry at entry.
+// The entry is assembled in a temporary directory and renamed into place, so
+// that concurrent builds sharing the cache never see a partial entry.
+func saveRunCache(entry, rootfs string, changes fsdiffer.FSChanges) error {
+	tmpEntry, err := ioutil.TempDir(filepath.Dir(entry), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpEntry)
+
+	sort.Sort(byPath(changes))
+
+	var meta runCacheMetadata
+	deltaFile, err := os.Create(filepath.Join(tmpEntry, runCacheDeltaFile))
+	if err != nil {
+		return err
+	}
+	defer deltaFile.Close()
+	tw := tar.NewWriter(deltaFile)
+	for _, change := range changes {
+		if change.ChangeType == fsdiffer.Deleted {
+			meta.Deleted = append(meta.Deleted, change.Path)
+			continue
+		}
+		err := addToDelta(tw, rootfs, change.Path)
+		if err != nil {
+			return err
+		}
+		opaque, err := fileutil.Lgetxattr(filepath.Join(rootfs, change.Path), overlayOpaqueXattr)
+		if err == nil && string(opaque) == "y" {
+			meta.Opaque = append(meta.Opaque, change.Path)
+		}
+	}
+	err = tw.Close()
+	if err != nil {
+		return err
+	}
+
+	blob, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(filepath.Join(tmpEntry, runCacheMetadataFile), blob, 0644)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpEntry, entry)
+	if err != nil {
+		if _, err1 := os.Stat(entry); err1 == nil {
+			// Another build stored the same result first
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func addToDelta(tw *tar.Writer, rootfs, relpath string) error {
+	p := filepath.Join(rootfs, relpath)
+	info, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err = os.Readlink(p)
+		if err != nil {
+			return err
+		}
+	}
+
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = relpath
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+type byPath fsdiffer.FSChanges
+
+func (c byPath) Len() int           { return len(c) }
+func (c byPath) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c byPath) Less(i, j int) bool { return c[i].Path < c[j].Path }
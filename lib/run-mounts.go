@@ -0,0 +1,174 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"syscall"
+
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/acbuild/util"
+)
+
+// CacheMount is a named cache directory, mounted at Target in the container.
+type CacheMount struct {
+	Name   string
+	Target string
+}
+
+var mountNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+// ParseCacheMount parses a cache mount given as NAME:CONTAINER_PATH.
+func ParseCacheMount(s string) (CacheMount, error) {
+	parts := strings.SplitN(s, ":", 2)
+	if len(parts) != 2 {
+		return CacheMount{}, fmt.Errorf("invalid cache %q, must be NAME:CONTAINER_PATH", s)
+	}
+	if !mountNameRegexp.MatchString(parts[0]) {
+		return CacheMount{}, fmt.Errorf("invalid cache name %q, must only contain letters, digits, '.', '_' and '-'", parts[0])
+	}
+	if !filepath.IsAbs(parts[1]) {
+		return CacheMount{}, fmt.Errorf("invalid cache %q, the container path must be absolute", s)
+	}
+	return CacheMount{Name: parts[0], Target: filepath.Clean(parts[1])}, nil
+}
+
+// cacheMountPath returns the directory on the host holding the contents of
+// the named cache. Caches are kept in the shared store when it is used, so
+// that other builds can use them too, and in the work path otherwise.
+func (a *ACBuild) cacheMountPath(name string) string {
+	if a.sharedStore {
+		return filepath.Join(a.SharedStorePath, "cache-mounts", name)
+	}
+	return filepath.Join(a.ContextPath, "cache-mounts", name)
+}
+
+// runMounts returns every mount in opts as an engine.Mount with an absolute
+// source, creating the directories of the caches that don't exist yet.
+func (a *ACBuild) runMounts(opts RunOptions) ([]engine.Mount, error) {
+	var mounts []engine.Mount
+	for _, m := range opts.Mounts {
+		src, err := filepath.Abs(m.Source)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := os.Stat(src); err != nil {
+			return nil, err
+		}
+		m.Source = src
+		mounts = append(mounts, m)
+	}
+	for _, c := range opts.Caches {
+		src := a.cacheMountPath(c.Name)
+		err := os.MkdirAll(src, 0755)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, engine.Mount{Source: src, Target: c.Target})
+	}
+	return mounts, nil
+}
+
+// createMountPoints creates the targets of mounts in root that don't exist
+// yet, as directories or empty files depending on what is mounted on them.
+// The returned function removes everything it created again, so that the
+// mount points don't end up in the image.
+func createMountPoints(root string, mounts []engine.Mount) (func() error, error) {
+	var created []string
+	remove := func() error {
+		for i := len(created) - 1; i >= 0; i-- {
+			err := os.Remove(created[i])
+			if err != nil && !os.IsNotExist(err) {
+				// The command put something else in it
+				if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOTEMPTY {
+					continue
+				}
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, m := range mounts {
+		err := createMountPoint(root, m, &created)
+		if err != nil {
+			remove()
+			return nil, err
+		}
+	}
+	return remove, nil
+}
+
+// createMountPoint creates the target of m in root if it doesn't exist,
+// appending every path it creates to created.
+func createMountPoint(root string, m engine.Mount, created *[]string) error {
+	target, err := util.ResolveInRoot(root, m.Target)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(target)
+	switch {
+	case err == nil:
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("can't mount on %s, it is a symlink", m.Target)
+		}
+		return nil
+	case !os.IsNotExist(err):
+		return err
+	}
+
+	srcInfo, err := os.Stat(m.Source)
+	if err != nil {
+		return err
+	}
+
+	var dirs []string
+	for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+		_, err := os.Lstat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		dirs = append(dirs, dir)
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := os.Mkdir(dirs[i], 0755)
+		if err != nil {
+			return err
+		}
+		*created = append(*created, dirs[i])
+	}
+
+	if srcInfo.IsDir() {
+		err = os.Mkdir(target, 0755)
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			err = f.Close()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	*created = append(*created, target)
+	return nil
+}
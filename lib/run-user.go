@@ -0,0 +1,166 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/coreos/rkt/pkg/user"
+
+	"github.com/appc/acbuild/engine"
+)
+
+// etcEntry is a line of /etc/passwd or /etc/group, split into its fields.
+type etcEntry []string
+
+// readEtcFile returns the entries of the passwd or group file at path, which
+// have at least fields fields. A missing file has no entries.
+func readEtcFile(path string, fields int) ([]etcEntry, error) {
+	f, err := os.Open(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []etcEntry
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entry := strings.Split(line, ":")
+		if len(entry) < fields {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, s.Err()
+}
+
+// resolveID resolves id, which is the name of a user or group, a numeric id,
+// or the absolute path of a file whose owner is used, in the rootfs at root.
+// It returns the uid for a user, and the gid for a group.
+func resolveID(root, id string, isGroup bool) (int, error) {
+	var r user.Resolver
+	var err error
+	switch {
+	case strings.HasPrefix(id, "/"):
+		r, err = user.IDsFromStat(root, id, nil)
+	case isGroup:
+		r, err = user.NumericIDs(id)
+		if err != nil {
+			r, err = user.IDsFromEtc(root, "", id)
+		}
+	default:
+		r, err = user.NumericIDs(id)
+		if err != nil {
+			r, err = user.IDsFromEtc(root, id, "")
+		}
+	}
+	if err != nil {
+		return -1, err
+	}
+	uid, gid, err := r.IDs()
+	if err != nil {
+		return -1, err
+	}
+	if isGroup {
+		return gid, nil
+	}
+	return uid, nil
+}
+
+// resolveRunUser returns the user a command is run as in the rootfs at root,
+// resolving userName and groupName in the same way as rkt does for the user
+// and group of an app. Each can be a name from the rootfs's /etc/passwd or
+// /etc/group, a numeric id, or the absolute path of a file in the rootfs
+// whose owner is used. An empty userName is root, and an empty groupName is
+// the user's primary group from /etc/passwd, or 0 if the user has no entry
+// there. The user is given every group in /etc/group that lists it as a member
+// as a supplementary group.
+func resolveRunUser(root, userName, groupName string) (*engine.User, error) {
+	if userName == "" {
+		userName = "0"
+	}
+	uid, err := resolveID(root, userName, false)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resolve user %q: %v", userName, err)
+	}
+
+	passwd, err := readEtcFile(filepath.Join(root, "etc/passwd"), 4)
+	if err != nil {
+		return nil, err
+	}
+	var entry etcEntry
+	for _, e := range passwd {
+		if e[2] == strconv.Itoa(uid) {
+			entry = e
+			break
+		}
+	}
+
+	u := &engine.User{UID: uid}
+	var primaryGID int
+	if entry != nil {
+		u.Name = entry[0]
+		primaryGID, err = strconv.Atoi(entry[3])
+		if err != nil {
+			return nil, fmt.Errorf("invalid gid %q of user %q in /etc/passwd", entry[3], u.Name)
+		}
+	}
+	if groupName == "" {
+		u.GID = primaryGID
+	} else {
+		u.GID, err = resolveID(root, groupName, true)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't resolve group %q: %v", groupName, err)
+		}
+	}
+	if u.Name == "" {
+		return u, nil
+	}
+	u.DefaultGroups = u.GID == primaryGID
+
+	groups, err := readEtcFile(filepath.Join(root, "etc/group"), 4)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[int]bool{u.GID: true}
+	for _, g := range groups {
+		for _, member := range strings.Split(g[3], ",") {
+			if member != u.Name {
+				continue
+			}
+			gid, err := strconv.Atoi(g[2])
+			if err != nil {
+				return nil, fmt.Errorf("invalid gid %q of group %q in /etc/group", g[2], g[0])
+			}
+			if !seen[gid] {
+				seen[gid] = true
+				u.AdditionalGIDs = append(u.AdditionalGIDs, gid)
+			}
+		}
+	}
+	return u, nil
+}
@@ -16,14 +16,17 @@ package lib
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/schema/types"
@@ -31,8 +34,45 @@ import (
 	"github.com/appc/acbuild/engine"
 	"github.com/appc/acbuild/registry"
 	"github.com/appc/acbuild/util"
+	"github.com/appc/acbuild/util/fsdiffer"
 )
 
+// RunOptions changes how Run runs a command, and what it makes available to
+// it.
+type RunOptions struct {
+	// Mounts are files and directories on the host that are bind mounted
+	// into the container while the command runs.
+	Mounts []engine.Mount
+
+	// Caches are directories that are mounted into the container and keep
+	// their contents from one run to the next, like the download cache of
+	// a package manager. Their contents are never part of the ACI.
+	Caches []CacheMount
+
+	// Secrets are files that are mounted read-only into the container from
+	// a tmpfs. Write refuses to write the ACI if any of them were left in
+	// the rootfs.
+	Secrets []Secret
+
+	// User and Group are the user and group the command is run as, given
+	// in the same forms as the user and group of an app. If neither is
+	// set, the command is run as root.
+	User  string
+	Group string
+
+	// AsAppUser runs the command as the user and group of the ACI's app,
+	// instead of User and Group.
+	AsAppUser bool
+
+	// Timeout is how long the command can run for before it's killed,
+	// along with every process it started. Run then returns an
+	// *engine.TimeoutError. If it's 0, the command can run forever.
+	Timeout time.Duration
+
+	// Limits are the memory and CPU time the command can use.
+	Limits engine.Limits
+}
+
 // Run will execute the given command in the ACI being built. a.CurrentACIPath
 // is where the untarred ACI is stored, a.DepStoreTarPath is the directory to
 // download dependencies into, a.DepStoreExpandedPath is where the dependencies
@@ -46,8 +86,22 @@ import (
 // - workingDir: If specified, the current directory inside the container is
 // changed to its value before running the given command.
 //
-// - runEngine:  The engine used to perform the execution of the command.
-func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine engine.Engine) (err error) {
+// - runEngine:  The engine used to perform the execution of the command. If
+// it is an engine.RootlessEngine that uses a user namespace, acbuild doesn't
+// need to be run as root, and the engine's id mappings are saved at
+// a.IDMapPath so that Write can translate the ownership of the files created
+// by the command.
+//
+// - opts:       The files, directories, caches and secrets mounted into the
+// container while the command runs, and the user, timeout and resource limits
+// it runs with. Mounting anything requires an engine that is an
+// engine.MountingEngine. The mounts and their contents never end up in the
+// ACI.
+//
+// If a.LayerCachePath is set and the same command has already been run on the
+// same state of the build, the changes it made to the rootfs are restored from
+// the cache instead of running the command again.
+func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine engine.Engine, opts RunOptions) (err error) {
 	if err = a.lock(); err != nil {
 		return err
 	}
@@ -57,7 +111,15 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		}
 	}()
 
-	if os.Geteuid() != 0 {
+	var idmaps *engine.IDMappings
+	if rootlessEngine, ok := runEngine.(engine.RootlessEngine); ok {
+		idmaps, err = rootlessEngine.IDMappings()
+		if err != nil {
+			return err
+		}
+	}
+
+	if os.Geteuid() != 0 && idmaps == nil {
 		return fmt.Errorf("the run subcommand must be run as root")
 	}
 
@@ -65,6 +127,16 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		return fmt.Errorf("command to run not set")
 	}
 
+	if len(opts.Mounts) != 0 || len(opts.Caches) != 0 || len(opts.Secrets) != 0 {
+		if _, ok := runEngine.(engine.MountingEngine); !ok {
+			return fmt.Errorf("the engine doesn't support mounts")
+		}
+	}
+	mounts, err := a.runMounts(opts)
+	if err != nil {
+		return err
+	}
+
 	err = util.MaybeUnmount(a.OverlayTargetPath)
 	if err != nil {
 		return err
@@ -94,7 +166,17 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		return err
 	}
 
+	if opts.AsAppUser {
+		if man.App == nil {
+			return fmt.Errorf("can't run as the app's user, the ACI has no app")
+		}
+		opts.User, opts.Group = man.App.User, man.App.Group
+	}
+
 	if len(man.Dependencies) != 0 {
+		if idmaps != nil {
+			return fmt.Errorf("run in a user namespace doesn't support images with dependencies")
+		}
 		if !supportsOverlay() {
 			err := exec.Command("modprobe", "overlay").Run()
 			if err != nil {
@@ -110,20 +192,128 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		}
 	}
 
+	release, err := a.useStore()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := release(); err == nil {
+			err = err1
+		}
+	}()
+
 	deps, err := a.renderACI(insecure, a.Debug)
 	if err != nil {
 		return err
 	}
 
-	var chrootDir string
-	if deps == nil {
-		chrootDir = path.Join(a.CurrentACIPath, aci.RootfsDir)
+	var env types.Environment
+	if man.App != nil {
+		env = man.App.Environment
 	} else {
-		for i, dep := range deps {
-			deps[i] = path.Join(a.DepStoreExpandedPath, dep, aci.RootfsDir)
+		env = types.Environment{}
+	}
+
+	if idmaps != nil {
+		err = a.saveIDMappings(idmaps)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The secrets are checked and recorded even if the result of the run
+	// is taken from the cache, as the run still used them
+	if len(opts.Secrets) != 0 {
+		err = a.recordSecrets(opts.Secrets)
+		if err != nil {
+			return err
+		}
+	}
+
+	rootfs := path.Join(a.CurrentACIPath, aci.RootfsDir)
+	var cacheEntry string
+	var differ *fsdiffer.TemporalFSDiffer
+	if a.LayerCachePath != "" {
+		err = os.MkdirAll(a.LayerCachePath, 0755)
+		if err != nil {
+			return err
+		}
+		key, err := a.runCacheKey(cmd, workingDir, env, runEngine, deps, mounts, opts)
+		if err != nil {
+			return err
+		}
+		cacheEntry = path.Join(a.LayerCachePath, key)
+		_, err = os.Stat(cacheEntry)
+		switch {
+		case os.IsNotExist(err):
+			break
+		case err != nil:
+			return err
+		default:
+			if a.Debug {
+				fmt.Fprintf(os.Stderr, "Using cached result of %v\n", cmd)
+			}
+			return restoreRunCache(cacheEntry, rootfs)
+		}
+		differ, err = fsdiffer.NewTemporalFSDiffer(rootfs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(opts.Secrets) != 0 {
+		var secretMounts []engine.Mount
+		var removeSecrets func() error
+		secretMounts, removeSecrets, err = a.stageSecrets(opts.Secrets)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err1 := removeSecrets(); err == nil {
+				err = err1
+			}
+		}()
+		mounts = append(mounts, secretMounts...)
+	}
+
+	removeZoneInfo, err := a.mirrorLocalZoneInfo()
+	if err != nil {
+		return err
+	}
+	err = a.runInRootfs(cmd, workingDir, env, deps, runEngine, mounts, opts)
+	if err1 := removeZoneInfo(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+
+	if differ != nil {
+		changes, err := differ.Diff()
+		if err != nil {
+			return err
+		}
+		return saveRunCache(cacheEntry, rootfs, changes)
+	}
+
+	return nil
+}
+
+// runInRootfs runs cmd with the given engine in the current ACI's rootfs, with
+// the rendered dependencies at deps, from the top layer down, mounted beneath
+// it and mounts mounted on top of it. The user, group, timeout and limits in
+// opts are applied to the command, with the user and group resolved in the
+// rootfs and its dependencies.
+func (a *ACBuild) runInRootfs(cmd []string, workingDir string, env types.Environment, deps []string, runEngine engine.Engine, mounts []engine.Mount, opts RunOptions) (err error) {
+	chrootDir := path.Join(a.CurrentACIPath, aci.RootfsDir)
+	if deps != nil {
+		// The leftmost lower directory is the top one
+		var lowerDirs []string
+		for _, dep := range deps {
+			lowerDirs = append(lowerDirs, path.Join(a.DepStoreExpandedPath, dep, aci.RootfsDir))
 		}
-		options := "lowerdir=" + strings.Join(deps, ":") +
-			",upperdir=" + path.Join(a.CurrentACIPath, aci.RootfsDir) +
+		options := "lowerdir=" + strings.Join(lowerDirs, ":") +
+			",upperdir=" + chrootDir +
 			",workdir=" + a.OverlayWorkPath
 		err := syscall.Mount("overlay", a.OverlayTargetPath, "overlay", 0, options)
 		if err != nil {
@@ -140,24 +330,60 @@ func (a *ACBuild) Run(cmd []string, workingDir string, insecure bool, runEngine
 		chrootDir = a.OverlayTargetPath
 	}
 
-	var env types.Environment
-	if man.App != nil {
-		env = man.App.Environment
-	} else {
-		env = types.Environment{}
+	if opts.User != "" || opts.Group != "" {
+		runUser, err := resolveRunUser(chrootDir, opts.User, opts.Group)
+		if err != nil {
+			return err
+		}
+		runEngine, err = runEngine.WithUser(runUser)
+		if err != nil {
+			return err
+		}
 	}
 
-	err = a.mirrorLocalZoneInfo()
+	if !opts.Limits.IsZero() {
+		runEngine, err = runEngine.WithLimits(opts.Limits)
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	if opts.Timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+
+	if len(mounts) == 0 {
+		return runEngine.Run(ctx, cmd[0], cmd[1:], env, chrootDir, workingDir)
+	}
+
+	removeMountPoints, err := createMountPoints(chrootDir, mounts)
 	if err != nil {
 		return err
 	}
+	defer func() {
+		if err1 := removeMountPoints(); err == nil {
+			err = err1
+		}
+	}()
 
-	err = runEngine.Run(cmd[0], cmd[1:], env, chrootDir, workingDir)
+	return runEngine.(engine.MountingEngine).RunWithMounts(ctx, cmd[0], cmd[1:], env, chrootDir, workingDir, mounts)
+}
+
+// saveIDMappings records the id mappings used by a user namespace at
+// a.IDMapPath. All run commands in a build have to use the same mappings, as
+// otherwise the ownership of the files in the rootfs would be ambiguous.
+func (a *ACBuild) saveIDMappings(idmaps *engine.IDMappings) error {
+	oldIDMaps, err := engine.ReadIDMappings(a.IDMapPath)
 	if err != nil {
 		return err
 	}
-
-	return nil
+	if oldIDMaps != nil && !reflect.DeepEqual(oldIDMaps, idmaps) {
+		return fmt.Errorf("user namespace id mappings have changed since the last run in this build")
+	}
+	return idmaps.Save(a.IDMapPath)
 }
 
 // stolen from github.com/coreos/rkt/common/common.go
@@ -179,13 +405,11 @@ func supportsOverlay() bool {
 	return false
 }
 
+// renderACI renders the dependencies of the current ACI, and returns their keys
+// from the top layer down, in the same order as squashLayers.
 func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
-	reg := registry.Registry{
-		DepStoreTarPath:      a.DepStoreTarPath,
-		DepStoreExpandedPath: a.DepStoreExpandedPath,
-		Insecure:             insecure,
-		Debug:                debug,
-	}
+	reg := a.newRegistry(insecure)
+	reg.Debug = debug
 
 	man, err := util.GetManifest(a.CurrentACIPath)
 	if err != nil {
@@ -198,17 +422,12 @@ func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
 
 	var deplist []string
 	for _, dep := range man.Dependencies {
-		err := reg.FetchAndRender(dep.ImageName, dep.Labels, dep.Size)
-		if err != nil {
-			return nil, err
-		}
-
-		depkey, err := reg.GetACI(dep.ImageName, dep.Labels)
+		depkey, err := reg.FetchAndRenderDependency(dep)
 		if err != nil {
 			return nil, err
 		}
 
-		subdeplist, err := genDeplist(path.Join(a.DepStoreExpandedPath, depkey), reg)
+		subdeplist, err := genDeplist(depkey, reg)
 		if err != nil {
 			return nil, err
 		}
@@ -218,63 +437,138 @@ func (a *ACBuild) renderACI(insecure, debug bool) ([]string, error) {
 	return deplist, nil
 }
 
-func genDeplist(acipath string, reg registry.Registry) ([]string, error) {
-	man, err := util.GetManifest(acipath)
+// genDeplist returns the keys of the image with the given key and of all of
+// its dependencies, from the top layer down the way acirenderer orders them:
+// every image comes before the images it depends on, and a later dependency
+// before an earlier one. An error is returned if the dependencies form a
+// cycle.
+func genDeplist(key string, reg registry.Registry) ([]string, error) {
+	return genDeplistFrom(key, reg, nil)
+}
+
+func genDeplistFrom(key string, reg registry.Registry, chain depChain) ([]string, error) {
+	man, err := reg.GetImageManifest(key)
 	if err != nil {
 		return nil, err
 	}
-	key, err := reg.GetACI(man.Name, man.Labels)
+	chain, err = chain.add(key, man.Name)
 	if err != nil {
-		fmt.Printf("Name: %s", man.Name)
 		return nil, err
 	}
 
-	var deps []string
-	for _, dep := range man.Dependencies {
-		depkey, err := reg.GetACI(dep.ImageName, dep.Labels)
+	deps := []string{key}
+	for i := len(man.Dependencies) - 1; i >= 0; i-- {
+		dep := man.Dependencies[i]
+		var depkey string
+		if dep.ImageID != nil {
+			depkey, err = reg.ResolveKey(dep.ImageID.String())
+		} else {
+			depkey, err = reg.GetACI(dep.ImageName, dep.Labels)
+		}
 		if err != nil {
 			return nil, err
 		}
 
-		subdeps, err := genDeplist(path.Join(reg.DepStoreExpandedPath, depkey), reg)
+		subdeps, err := genDeplistFrom(depkey, reg, chain)
 		if err != nil {
 			return nil, err
 		}
 		deps = append(deps, subdeps...)
 	}
-
-	deps = append(deps, key)
 	return deps, nil
 }
 
-func (a *ACBuild) mirrorLocalZoneInfo() error {
+// mirrorLocalZoneInfo copies the host's zoneinfo file, which /etc/localtime
+// points to, into the same place in the rootfs, so that engines mirroring the
+// host's /etc/localtime into the container find it there. The returned function
+// removes the copy again, along with any directories created for it, so that
+// the host's timezone doesn't leak into the image. If the rootfs already has
+// the file, it is left alone.
+func (a *ACBuild) mirrorLocalZoneInfo() (func() error, error) {
+	noop := func() error { return nil }
+
 	zif, err := filepath.EvalSymlinks("/etc/localtime")
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	destp := filepath.Join(a.CurrentACIPath, aci.RootfsDir, zif)
+	_, err = os.Lstat(destp)
+	switch {
+	case err == nil:
+		return noop, nil
+	case !os.IsNotExist(err):
+		return nil, err
 	}
 
 	src, err := os.Open(zif)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer src.Close()
 
-	destp := filepath.Join(a.CurrentACIPath, aci.RootfsDir, zif)
+	// Find the directories that need to be created, so that they can be
+	// removed again afterwards
+	var createdDirs []string
+	for dir := filepath.Dir(destp); ; dir = filepath.Dir(dir) {
+		_, err := os.Lstat(dir)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		createdDirs = append(createdDirs, dir)
+	}
+
+	var copied os.FileInfo
+	remove := func() error {
+		// If the command replaced the copy, say by installing the zoneinfo
+		// files, what it put there is kept
+		info, err := os.Lstat(destp)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return err
+		case copied == nil || (os.SameFile(info, copied) && info.ModTime().Equal(copied.ModTime())):
+			err := os.Remove(destp)
+			if err != nil {
+				return err
+			}
+		}
+		for _, dir := range createdDirs {
+			err := os.Remove(dir)
+			if err != nil && !os.IsNotExist(err) {
+				// The command put something else in it
+				if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.ENOTEMPTY {
+					return nil
+				}
+				return err
+			}
+		}
+		return nil
+	}
 
 	if err = os.MkdirAll(filepath.Dir(destp), 0755); err != nil {
-		return err
+		remove()
+		return nil, err
 	}
 
 	dest, err := os.OpenFile(destp, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
-		return err
+		remove()
+		return nil, err
 	}
 	defer dest.Close()
 
 	_, err = io.Copy(dest, src)
+	if err == nil {
+		copied, err = dest.Stat()
+	}
 	if err != nil {
-		return err
+		remove()
+		return nil, err
 	}
 
-	return nil
+	return remove, nil
 }
@@ -0,0 +1,258 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/aci"
+
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/acbuild/util"
+)
+
+// tmpfsMagic is the filesystem type statfs reports for a tmpfs.
+const tmpfsMagic = 0x01021994
+
+// Secret is a file on the host that is made available to a command run in the
+// container, without it ever being written into the ACI.
+type Secret struct {
+	ID string `json:"id"`
+	// Source is the path of the file on the host
+	Source string `json:"-"`
+	// Target is the path of the secret inside of the container
+	Target string `json:"target"`
+}
+
+// ParseSecret parses a secret given as id=NAME,src=FILE[,target=PATH]. The
+// target defaults to /run/secrets/NAME.
+func ParseSecret(s string) (Secret, error) {
+	var secret Secret
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return Secret{}, fmt.Errorf("invalid secret %q, must be id=NAME,src=FILE[,target=PATH]", s)
+		}
+		switch kv[0] {
+		case "id":
+			secret.ID = kv[1]
+		case "src":
+			secret.Source = kv[1]
+		case "target":
+			secret.Target = kv[1]
+		default:
+			return Secret{}, fmt.Errorf("invalid secret %q, unknown key %q", s, kv[0])
+		}
+	}
+	if !mountNameRegexp.MatchString(secret.ID) {
+		return Secret{}, fmt.Errorf("invalid secret id %q, must only contain letters, digits, '.', '_' and '-'", secret.ID)
+	}
+	if secret.Source == "" {
+		return Secret{}, fmt.Errorf("invalid secret %q, src must be set", s)
+	}
+	if secret.Target == "" {
+		secret.Target = "/run/secrets/" + secret.ID
+	}
+	if !filepath.IsAbs(secret.Target) {
+		return Secret{}, fmt.Errorf("invalid secret %q, the target must be absolute", s)
+	}
+	secret.Target = filepath.Clean(secret.Target)
+	return secret, nil
+}
+
+// secretsTmpfsPath returns the directory a tmpfs is mounted on to hold the
+// secrets of a run when acbuild is run as root.
+func (a *ACBuild) secretsTmpfsPath() string {
+	return filepath.Join(a.ContextPath, "secrets-tmpfs")
+}
+
+// recordSecrets adds the targets of secrets to the ones recorded at
+// a.SecretsPath, so that Write can make sure none of them were left in the
+// rootfs. A secret's target must not exist in the rootfs before it's mounted
+// there.
+func (a *ACBuild) recordSecrets(secrets []Secret) error {
+	rootfs := filepath.Join(a.CurrentACIPath, aci.RootfsDir)
+	ids := make(map[string]bool)
+	for _, s := range secrets {
+		if ids[s.ID] {
+			return fmt.Errorf("secret %q given more than once", s.ID)
+		}
+		ids[s.ID] = true
+		target, err := util.ResolveInRoot(rootfs, s.Target)
+		if err != nil {
+			return err
+		}
+		_, err = os.Lstat(target)
+		switch {
+		case err == nil:
+			return fmt.Errorf("target of secret %q already exists in the ACI: %s", s.ID, s.Target)
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+
+	recorded, err := a.readSecrets()
+	if err != nil {
+		return err
+	}
+	for _, s := range secrets {
+		known := false
+		for _, r := range recorded {
+			if r.ID == s.ID && r.Target == s.Target {
+				known = true
+				break
+			}
+		}
+		if !known {
+			recorded = append(recorded, s)
+		}
+	}
+	blob, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(a.SecretsPath, blob, 0644)
+}
+
+// readSecrets returns the secrets recorded at a.SecretsPath. Only their ids
+// and targets are known.
+func (a *ACBuild) readSecrets() ([]Secret, error) {
+	blob, err := ioutil.ReadFile(a.SecretsPath)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var secrets []Secret
+	err = json.Unmarshal(blob, &secrets)
+	if err != nil {
+		return nil, err
+	}
+	return secrets, nil
+}
+
+// checkSecrets returns an error if the target of any secret used by a run in
+// this build exists in the rootfs.
+func (a *ACBuild) checkSecrets() error {
+	secrets, err := a.readSecrets()
+	if err != nil {
+		return err
+	}
+	rootfs := filepath.Join(a.CurrentACIPath, aci.RootfsDir)
+	for _, s := range secrets {
+		target, err := util.ResolveInRoot(rootfs, s.Target)
+		if err != nil {
+			return err
+		}
+		_, err = os.Lstat(target)
+		switch {
+		case err == nil:
+			return fmt.Errorf("secret %q was left in the rootfs at %s", s.ID, s.Target)
+		case !os.IsNotExist(err):
+			return err
+		}
+	}
+	return nil
+}
+
+// stageSecrets copies the secrets onto a tmpfs, so that they are never written
+// to disk, and returns the read-only mounts making them available in the
+// container. The returned function removes the copies again.
+//
+// When acbuild is run as root a tmpfs is mounted in the work path for them,
+// and otherwise they're put in /dev/shm.
+func (a *ACBuild) stageSecrets(secrets []Secret) ([]engine.Mount, func() error, error) {
+	var dir string
+	var remove func() error
+	if os.Geteuid() == 0 {
+		dir = a.secretsTmpfsPath()
+		err := util.MaybeUnmount(dir)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = os.MkdirAll(dir, 0700)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV|syscall.MS_NOEXEC, "mode=0700")
+		if err != nil {
+			return nil, nil, fmt.Errorf("couldn't mount a tmpfs for the secrets: %v", err)
+		}
+		remove = func() error {
+			err := syscall.Unmount(dir, 0)
+			if err != nil {
+				return err
+			}
+			return os.Remove(dir)
+		}
+	} else {
+		var st syscall.Statfs_t
+		err := syscall.Statfs("/dev/shm", &st)
+		if err != nil {
+			return nil, nil, err
+		}
+		if st.Type != tmpfsMagic {
+			return nil, nil, fmt.Errorf("secrets require /dev/shm to be a tmpfs")
+		}
+		dir, err = ioutil.TempDir("/dev/shm", "acbuild-secrets-")
+		if err != nil {
+			return nil, nil, err
+		}
+		remove = func() error {
+			return os.RemoveAll(dir)
+		}
+	}
+
+	var mounts []engine.Mount
+	for _, s := range secrets {
+		staged := filepath.Join(dir, s.ID)
+		err := copySecret(s.Source, staged)
+		if err != nil {
+			remove()
+			return nil, nil, fmt.Errorf("couldn't read secret %q: %v", s.ID, err)
+		}
+		mounts = append(mounts, engine.Mount{Source: staged, Target: s.Target, ReadOnly: true})
+	}
+	return mounts, remove, nil
+}
+
+// copySecret copies the file at src to a new read-only file at dst. It can be
+// read by anyone, so that commands run as other users than root can read it,
+// and is kept from other users on the host by the directory it's in.
+func copySecret(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0444)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
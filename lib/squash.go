@@ -0,0 +1,254 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/coreos/rkt/pkg/fileutil"
+)
+
+// squashLayer is the rendered rootfs of an image in the dependency tree of the
+// current ACI, to be merged into it. Only the files in files are taken from
+// it, as the others are either left out by a path whitelist or provided by an
+// image above it in the same tree.
+type squashLayer struct {
+	dir   string
+	files map[string]struct{}
+}
+
+// WriteSquashed is like Write, except that the dependencies of the current ACI
+// are fetched, rendered and merged into the written ACI's rootfs, in the order
+// run layers them, and removed from its manifest, so that the written ACI can
+// be run without them.
+func (a *ACBuild) WriteSquashed(output string, overwrite, sign, insecure bool, gpgflags []string) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	man, err := a.manifestToWrite()
+	if err != nil {
+		return err
+	}
+
+	release, err := a.useStore()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := release(); err == nil {
+			err = err1
+		}
+	}()
+
+	layers, err := a.squashLayers(man, insecure)
+	if err != nil {
+		return err
+	}
+	man.Dependencies = nil
+
+	return a.write(output, overwrite, sign, gpgflags, man, layers)
+}
+
+// squashLayers renders the dependencies of the ACI with the given manifest,
+// and returns their layers from top to bottom.
+func (a *ACBuild) squashLayers(man *schema.ImageManifest, insecure bool) ([]squashLayer, error) {
+	reg := a.newRegistry(insecure)
+	layers := []squashLayer{}
+	for _, dep := range man.Dependencies {
+		key, err := reg.FetchAndRenderDependency(dep)
+		if err != nil {
+			return nil, err
+		}
+		// The renderer doesn't check for cycles
+		_, err = genDeplist(key, reg)
+		if err != nil {
+			return nil, err
+		}
+
+		imageID, err := types.NewHash(key)
+		if err != nil {
+			return nil, err
+		}
+		rendered, err := acirenderer.GetRenderedACIWithImageID(*imageID, reg)
+		if err != nil {
+			return nil, err
+		}
+		for _, files := range rendered {
+			layers = append(layers, squashLayer{
+				dir:   path.Join(a.DepStoreExpandedPath, files.Key),
+				files: files.FileMap,
+			})
+		}
+	}
+	return layers, nil
+}
+
+// walkSquashed adds the current rootfs to aw, followed by the files from the
+// given layers that aren't hidden by the layers above them, the way overlayfs
+// would merge them.
+func (a *ACBuild) walkSquashed(aw aci.ArchiveWriter, headerFn aci.TarHeaderWalkFunc, man *schema.ImageManifest, layers []squashLayer) error {
+	s := &squasher{
+		seen:   make(map[string]os.FileMode),
+		hidden: make(map[string]bool),
+		opaque: make(map[string]bool),
+	}
+	if len(man.PathWhitelist) != 0 {
+		s.whitelist = make(map[string]struct{})
+		for _, p := range man.PathWhitelist {
+			s.whitelist[filepath.Join(aci.RootfsDir, p)] = struct{}{}
+		}
+	}
+
+	err := filepath.Walk(a.CurrentACIPath, s.walker(a.CurrentACIPath, nil,
+		aci.BuildWalker(a.CurrentACIPath, aw, headerFn)))
+	if err != nil {
+		return err
+	}
+
+	// The dependencies' files aren't owned by ids mapped by a user namespace
+	var depHeaderFn aci.TarHeaderWalkFunc
+	if a.SourceDateEpoch != nil {
+		depHeaderFn = func(hdr *tar.Header) bool {
+			makeHeaderReproducible(hdr, *a.SourceDateEpoch)
+			return true
+		}
+	}
+	for _, layer := range layers {
+		err := filepath.Walk(layer.dir, s.walker(layer.dir, layer.files,
+			aci.BuildWalker(layer.dir, aw, depHeaderFn)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// squasher keeps track of the files in the layers merged so far, from the top
+// down.
+type squasher struct {
+	// seen holds the type of every file added so far
+	seen map[string]os.FileMode
+	// hidden holds the files deleted by whiteouts
+	hidden map[string]bool
+	// opaque holds the directories whose contents hide the lower layers'
+	opaque map[string]bool
+	// whitelist, if set, holds the only files other than directories that
+	// may be added
+	whitelist map[string]struct{}
+}
+
+// walker returns a filepath.WalkFunc for the ACI at root, calling walk for
+// every file in its rootfs that belongs in the squashed ACI. If files is set,
+// other files than directories are only added if they are in it.
+func (s *squasher) walker(root string, files map[string]struct{}, walk filepath.WalkFunc) filepath.WalkFunc {
+	return func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if relpath == "." {
+			return walk(p, info, nil)
+		}
+
+		add, descend := false, false
+		// Rendered dependencies have other files next to their rootfs
+		if relpath == aci.RootfsDir || strings.HasPrefix(relpath, aci.RootfsDir+"/") {
+			add, descend, err = s.add(p, relpath, info, files)
+			if err != nil {
+				return err
+			}
+		}
+		if add {
+			err := walk(p, info, nil)
+			if err != nil {
+				return err
+			}
+		}
+		if info.IsDir() && !descend {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+}
+
+// add records the file at p, and returns whether it should be added to the
+// squashed ACI, and if it's a directory, whether its contents should be.
+func (s *squasher) add(p, relpath string, info os.FileInfo, files map[string]struct{}) (add, descend bool, err error) {
+	isDir := info.IsDir()
+
+	if isWhiteout(info) {
+		if _, ok := s.seen[relpath]; !ok {
+			s.hidden[relpath] = true
+		}
+		return false, false, nil
+	}
+	if s.hidden[relpath] {
+		return false, false, nil
+	}
+	if mode, ok := s.seen[relpath]; ok {
+		// Directories are merged, unless the upper one is opaque
+		return false, mode.IsDir() && isDir && !s.opaque[relpath], nil
+	}
+
+	if !isDir {
+		if files != nil {
+			if _, ok := files[relpath]; !ok {
+				return false, false, nil
+			}
+		}
+		if s.whitelist != nil {
+			if _, ok := s.whitelist[relpath]; !ok {
+				return false, false, nil
+			}
+		}
+	}
+
+	s.seen[relpath] = info.Mode()
+	if isDir {
+		opaque, err := fileutil.Lgetxattr(p, overlayOpaqueXattr)
+		if err == nil && string(opaque) == "y" {
+			s.opaque[relpath] = true
+		}
+	}
+	return true, isDir, nil
+}
+
+// isWhiteout returns whether info describes an overlayfs whiteout, which marks
+// a file deleted from the layers below.
+func isWhiteout(info os.FileInfo) bool {
+	if info.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
@@ -0,0 +1,39 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"github.com/appc/acbuild/registry"
+)
+
+// TrustKey will add the public key stored at keyPath to the trust store at
+// a.TrustStorePath, trusting it to sign images whose names start with prefix.
+// If prefix is empty the key is trusted for every image. The key's fingerprint
+// is returned. No build needs to be in progress.
+func (a *ACBuild) TrustKey(prefix, keyPath string) (string, error) {
+	return registry.TrustStore{Path: a.TrustStorePath}.AddKey(prefix, keyPath)
+}
+
+// UntrustKey will remove the key with the given fingerprint from the trust
+// store at a.TrustStorePath. No build needs to be in progress.
+func (a *ACBuild) UntrustKey(fingerprint string) error {
+	return registry.TrustStore{Path: a.TrustStorePath}.RemoveKey(fingerprint)
+}
+
+// TrustedKeys will return all of the keys in the trust store at
+// a.TrustStorePath. No build needs to be in progress.
+func (a *ACBuild) TrustedKeys() ([]registry.TrustedKey, error) {
+	return registry.TrustStore{Path: a.TrustStorePath}.Keys()
+}
@@ -0,0 +1,443 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package lib
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+
+	"github.com/appc/acbuild/engine"
+	"github.com/appc/acbuild/oci"
+	"github.com/appc/acbuild/util"
+)
+
+// ociArchs maps appc architecture labels onto OCI architectures and variants.
+// Labels that aren't in here are the same in both.
+var ociArchs = map[string][2]string{
+	"i386":    {"386", ""},
+	"aarch64": {"arm64", ""},
+	"armv6l":  {"arm", "v6"},
+	"armv7l":  {"arm", "v7"},
+	"armv7b":  {"arm", "v7"},
+}
+
+// WriteOCI will produce an OCI image layout from the current build context,
+// saving it to the given path. If the path ends in ".tar" the layout is written
+// as a tarball, otherwise it is written as a directory.
+func (a *ACBuild) WriteOCI(output string, overwrite bool) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	man, err := a.manifestToWrite()
+	if err != nil {
+		return err
+	}
+
+	err = removeOutput(output, overwrite)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// When write is done, if an error is encountered remove the partial
+		// image that had been written.
+		if err != nil {
+			os.RemoveAll(output)
+		}
+	}()
+
+	if !strings.HasSuffix(output, ".tar") {
+		return a.writeOCILayout(output, man)
+	}
+
+	layoutPath, err := ioutil.TempDir(filepath.Dir(output), "."+filepath.Base(output)+"-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(layoutPath)
+
+	err = a.writeOCILayout(layoutPath, man)
+	if err != nil {
+		return err
+	}
+
+	ofile, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	defer ofile.Close()
+	modTime := time.Now()
+	if a.SourceDateEpoch != nil {
+		modTime = *a.SourceDateEpoch
+	}
+	return oci.Layout{Path: layoutPath}.WriteTar(ofile, modTime)
+}
+
+// WriteOCIBundle will produce an OCI runtime bundle from the current build
+// context, saving it to a directory at the given path. The bundle holds a copy
+// of the rootfs, and a config.json that runs the ACI's app in it.
+func (a *ACBuild) WriteOCIBundle(output string, overwrite bool) (err error) {
+	if err = a.lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := a.unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	man, err := a.manifestToWrite()
+	if err != nil {
+		return err
+	}
+
+	image := ociImage(man)
+	spec, err := ociSpec(image)
+	if err != nil {
+		return err
+	}
+
+	err = removeOutput(output, overwrite)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(output)
+		}
+	}()
+
+	rootfs := filepath.Join(output, spec.Root.Path)
+	err = os.MkdirAll(rootfs, 0755)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(a.writeRootfsTar(pw))
+	}()
+	err = util.ExtractTar(pr, rootfs, nil)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	blob, err := json.MarshalIndent(spec, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(output, "config.json"), blob, 0644)
+}
+
+// removeOutput removes whatever exists at output if overwrite is set, and
+// otherwise returns an error if anything exists there.
+func removeOutput(output string, overwrite bool) error {
+	_, err := os.Lstat(output)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case !overwrite:
+		return fmt.Errorf("image already exists: %s", output)
+	}
+	return os.RemoveAll(output)
+}
+
+// writeOCILayout writes an image layout holding the current ACI, with the
+// given manifest, to the directory at path.
+func (a *ACBuild) writeOCILayout(path string, man *schema.ImageManifest) error {
+	layout, err := oci.CreateLayout(path)
+	if err != nil {
+		return err
+	}
+
+	// The layer's digest is of its compressed contents, while its diff id is
+	// of its uncompressed contents, so both are computed in one pass
+	diffID := sha256.New()
+	pr, pw := io.Pipe()
+	go func() {
+		gzwriter := gzip.NewWriter(pw)
+		err := a.writeRootfsTar(io.MultiWriter(gzwriter, diffID))
+		if err == nil {
+			err = gzwriter.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+	layerDesc, err := layout.WriteBlob(oci.MediaTypeImageLayerGzip, pr)
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+
+	image := ociImage(man)
+	image.RootFS = oci.RootFS{
+		Type:    "layers",
+		DiffIDs: []string{fmt.Sprintf("sha256:%x", diffID.Sum(nil))},
+	}
+	configDesc, err := layout.WriteJSONBlob(oci.MediaTypeImageConfig, image)
+	if err != nil {
+		return err
+	}
+
+	manifestDesc, err := layout.WriteJSONBlob(oci.MediaTypeImageManifest, oci.Manifest{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeImageManifest,
+		Config:        configDesc,
+		Layers:        []oci.Descriptor{layerDesc},
+	})
+	if err != nil {
+		return err
+	}
+	manifestDesc.Platform = &oci.Platform{
+		Architecture: image.Architecture,
+		OS:           image.OS,
+		Variant:      image.Variant,
+	}
+	refName := "latest"
+	if version, ok := man.Labels.Get("version"); ok {
+		refName = version
+	}
+	manifestDesc.Annotations = map[string]string{oci.AnnotationRefName: refName}
+
+	return layout.WriteIndex(oci.Index{
+		SchemaVersion: 2,
+		MediaType:     oci.MediaTypeImageIndex,
+		Manifests:     []oci.Descriptor{manifestDesc},
+	})
+}
+
+// writeRootfsTar writes the current ACI's rootfs to w as an uncompressed
+// tarball, with the rootfs as the root of the tarball.
+func (a *ACBuild) writeRootfsTar(w io.Writer) error {
+	headerFn, err := a.writeHeaderFn()
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	rootfs := filepath.Join(a.CurrentACIPath, aci.RootfsDir)
+	err = filepath.Walk(rootfs, aci.BuildWalker(a.CurrentACIPath, rootfsTarWriter{tw}, headerFn))
+	if err != nil {
+		return a.writeWalkError(err)
+	}
+	return tw.Close()
+}
+
+// rootfsTarWriter is an aci.ArchiveWriter that strips the rootfs directory
+// from the paths of the files added to it.
+type rootfsTarWriter struct {
+	*tar.Writer
+}
+
+func (w rootfsTarWriter) AddFile(hdr *tar.Header, r io.Reader) error {
+	name, err := filepath.Rel(aci.RootfsDir, hdr.Name)
+	if err != nil {
+		return err
+	}
+	if name == "." {
+		return nil
+	}
+	hdr.Name = name
+	if hdr.Typeflag == tar.TypeLink {
+		hdr.Linkname, err = filepath.Rel(aci.RootfsDir, hdr.Linkname)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if r == nil {
+		return nil
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+// ociImage translates the given manifest into an OCI image config, warning
+// about anything in the manifest that has no OCI equivalent. The config's
+// rootfs is left for the caller to fill in.
+func ociImage(man *schema.ImageManifest) oci.Image {
+	image := oci.Image{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+	}
+
+	labels := make(map[string]string)
+	for _, label := range man.Labels {
+		switch label.Name {
+		case "os":
+			image.OS = label.Value
+		case "arch":
+			image.Architecture, image.Variant = label.Value, ""
+			if arch, ok := ociArchs[label.Value]; ok {
+				image.Architecture, image.Variant = arch[0], arch[1]
+			}
+		default:
+			labels[label.Name.String()] = label.Value
+		}
+	}
+	for _, annotation := range man.Annotations {
+		switch annotation.Name {
+		case "created":
+			image.Created = annotation.Value
+		case "authors":
+			image.Author = annotation.Value
+		}
+		labels[annotation.Name.String()] = annotation.Value
+	}
+	if len(labels) != 0 {
+		image.Config.Labels = labels
+	}
+
+	if len(man.Dependencies) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: dependencies have no OCI equivalent, and are not included in the image\n")
+	}
+
+	app := man.App
+	if app == nil {
+		return image
+	}
+
+	image.Config.Entrypoint = app.Exec
+	image.Config.WorkingDir = app.WorkingDirectory
+
+	switch {
+	case strings.HasPrefix(app.User, "/"):
+		fmt.Fprintf(os.Stderr, "warning: user %q is a path, which has no OCI equivalent\n", app.User)
+	case strings.HasPrefix(app.Group, "/"):
+		fmt.Fprintf(os.Stderr, "warning: group %q is a path, which has no OCI equivalent\n", app.Group)
+		image.Config.User = app.User
+	case app.Group != "":
+		image.Config.User = app.User + ":" + app.Group
+	default:
+		image.Config.User = app.User
+	}
+
+	for _, env := range app.Environment {
+		image.Config.Env = append(image.Config.Env, env.Name+"="+env.Value)
+	}
+
+	for _, port := range app.Ports {
+		if image.Config.ExposedPorts == nil {
+			image.Config.ExposedPorts = make(map[string]struct{})
+		}
+		if port.SocketActivated {
+			fmt.Fprintf(os.Stderr, "warning: port %q is socket activated, which has no OCI equivalent\n", port.Name)
+		}
+		count := port.Count
+		if count == 0 {
+			count = 1
+		}
+		for i := uint(0); i < count; i++ {
+			image.Config.ExposedPorts[fmt.Sprintf("%d/%s", port.Port+i, port.Protocol)] = struct{}{}
+		}
+	}
+
+	for _, mount := range app.MountPoints {
+		if image.Config.Volumes == nil {
+			image.Config.Volumes = make(map[string]struct{})
+		}
+		if mount.ReadOnly {
+			fmt.Fprintf(os.Stderr, "warning: mount point %q is read only, which has no OCI equivalent\n", mount.Name)
+		}
+		image.Config.Volumes[mount.Path] = struct{}{}
+	}
+
+	if len(app.EventHandlers) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: event handlers have no OCI equivalent, and are not included in the image\n")
+	}
+	if len(app.Isolators) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: isolators have no OCI equivalent, and are not included in the image\n")
+	}
+	if len(app.SupplementaryGIDs) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: supplementary groups have no OCI equivalent, and are not included in the image\n")
+	}
+
+	return image
+}
+
+// ociSpec creates the runtime spec for a bundle running the given image.
+func ociSpec(image oci.Image) (oci.Spec, error) {
+	spec := oci.DefaultSpec()
+
+	spec.Process.Args = append(image.Config.Entrypoint, image.Config.Cmd...)
+	if len(spec.Process.Args) == 0 {
+		return spec, fmt.Errorf("can't write OCI bundle, exec command was never set")
+	}
+
+	if image.Config.WorkingDir != "" {
+		spec.Process.Cwd = image.Config.WorkingDir
+	}
+
+	spec.Process.Env = image.Config.Env
+	hasPath := false
+	for _, env := range spec.Process.Env {
+		if strings.HasPrefix(env, "PATH=") {
+			hasPath = true
+		}
+	}
+	if !hasPath {
+		spec.Process.Env = append([]string{"PATH=" + strings.Join(engine.Pathlist, ":")}, spec.Process.Env...)
+	}
+
+	// The runtime spec has no way to look up names, so only numeric users
+	// and groups can be used
+	if image.Config.User != "" {
+		parts := strings.SplitN(image.Config.User, ":", 2)
+		uid, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil {
+			return spec, fmt.Errorf("can't write OCI bundle, user %q isn't numeric", parts[0])
+		}
+		spec.Process.User.UID = uint32(uid)
+		if len(parts) == 2 {
+			gid, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return spec, fmt.Errorf("can't write OCI bundle, group %q isn't numeric", parts[1])
+			}
+			spec.Process.User.GID = uint32(gid)
+		}
+	}
+
+	if len(image.Config.ExposedPorts) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: ports have no equivalent in an OCI bundle, and are not included in it\n")
+	}
+	if len(image.Config.Volumes) != 0 {
+		fmt.Fprintf(os.Stderr, "warning: mount points have no equivalent in an OCI bundle, mounts must be added to its config.json\n")
+	}
+
+	return spec, nil
+}
@@ -16,17 +16,23 @@ package lib
 
 import (
 	"archive/tar"
+	"bytes"
 	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path"
 	"path/filepath"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 
+	"github.com/appc/acbuild/engine"
 	"github.com/appc/acbuild/util"
 )
 
@@ -42,19 +48,17 @@ func (a *ACBuild) Write(output string, overwrite, sign bool, gpgflags []string)
 		}
 	}()
 
-	man, err := util.GetManifest(a.CurrentACIPath)
+	man, err := a.manifestToWrite()
 	if err != nil {
 		return err
 	}
 
-	if man.App != nil && len(man.App.Exec) == 0 {
-		fmt.Fprintf(os.Stderr, "warning: exec command was never set.\n")
-	}
-
-	if man.Name == types.ACIdentifier(placeholdername) {
-		return fmt.Errorf("can't write ACI, name was never set")
-	}
+	return a.write(output, overwrite, sign, gpgflags, man, nil)
+}
 
+// write writes the ACI with the given manifest, and the current rootfs layered
+// on top of the given dependency layers, to output.
+func (a *ACBuild) write(output string, overwrite, sign bool, gpgflags []string, man *schema.ImageManifest, layers []squashLayer) (err error) {
 	fileFlags := os.O_CREATE | os.O_WRONLY
 
 	_, err = os.Stat(output)
@@ -89,27 +93,30 @@ func (a *ACBuild) Write(output string, overwrite, sign bool, gpgflags []string)
 	// setup compression
 	gzwriter := gzip.NewWriter(ofile)
 	defer gzwriter.Close()
+	if a.SourceDateEpoch != nil {
+		// Leave the timestamp out of the gzip header
+		gzwriter.ModTime = time.Time{}
+		gzwriter.Name = ""
+	}
+
+	headerFn, err := a.writeHeaderFn()
+	if err != nil {
+		return err
+	}
 
 	// create the aci writer
 	aw := aci.NewImageWriter(*man, tar.NewWriter(gzwriter))
-	err = filepath.Walk(a.CurrentACIPath, aci.BuildWalker(a.CurrentACIPath, aw, nil))
+	if a.SourceDateEpoch != nil {
+		aw = &reproducibleImageWriter{tar.NewWriter(gzwriter), man, *a.SourceDateEpoch}
+	}
+	if layers == nil {
+		err = filepath.Walk(a.CurrentACIPath, aci.BuildWalker(a.CurrentACIPath, aw, headerFn))
+	} else {
+		err = a.walkSquashed(aw, headerFn, man, layers)
+	}
 	defer aw.Close()
 	if err != nil {
-		pathErr, ok := err.(*os.PathError)
-		if !ok {
-			fmt.Printf("not a path error!\n")
-			return err
-		}
-		syscallErrno, ok := pathErr.Err.(syscall.Errno)
-		if !ok {
-			fmt.Printf("not a syscall errno!\n")
-			return err
-		}
-		if pathErr.Op == "open" && syscallErrno != syscall.EACCES {
-			return err
-		}
-		problemPath := pathErr.Path[len(path.Join(a.CurrentACIPath, aci.RootfsDir)):]
-		return fmt.Errorf("%q: permission denied - call write as root", problemPath)
+		return a.writeWalkError(err)
 	}
 
 	if sign {
@@ -122,6 +129,130 @@ func (a *ACBuild) Write(output string, overwrite, sign bool, gpgflags []string)
 	return nil
 }
 
+// manifestToWrite returns the manifest of the current ACI, if it's ready to be
+// written out. It isn't if a secret used by run was left in the rootfs.
+func (a *ACBuild) manifestToWrite() (*schema.ImageManifest, error) {
+	man, err := util.GetManifest(a.CurrentACIPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if man.App != nil && len(man.App.Exec) == 0 {
+		fmt.Fprintf(os.Stderr, "warning: exec command was never set.\n")
+	}
+
+	if man.Name == types.ACIdentifier(placeholdername) {
+		return nil, fmt.Errorf("can't write ACI, name was never set")
+	}
+
+	err = a.checkSecrets()
+	if err != nil {
+		return nil, fmt.Errorf("can't write ACI, %v", err)
+	}
+	return man, nil
+}
+
+// writeHeaderFn returns the function applied to the header of every file in
+// the current ACI as it is written out.
+func (a *ACBuild) writeHeaderFn() (aci.TarHeaderWalkFunc, error) {
+	// files created by run in a user namespace are owned by the host ids the
+	// namespace's ids were mapped to
+	idmaps, err := engine.ReadIDMappings(a.IDMapPath)
+	if err != nil {
+		return nil, err
+	}
+	if idmaps == nil && a.SourceDateEpoch == nil {
+		return nil, nil
+	}
+	return func(hdr *tar.Header) bool {
+		if idmaps != nil {
+			hdr.Uid, hdr.Gid = idmaps.HostToContainer(hdr.Uid, hdr.Gid)
+			// The names belong to the host's users and groups
+			hdr.Uname, hdr.Gname = "", ""
+		}
+		if a.SourceDateEpoch != nil {
+			makeHeaderReproducible(hdr, *a.SourceDateEpoch)
+		}
+		return true
+	}, nil
+}
+
+// makeHeaderReproducible clamps the modification time of hdr to epoch and
+// drops everything else in it that depends on when or where it was written.
+// The entries' order doesn't need fixing, as filepath.Walk visits them in
+// lexical order.
+func makeHeaderReproducible(hdr *tar.Header, epoch time.Time) {
+	if hdr.ModTime.After(epoch) {
+		hdr.ModTime = epoch
+	}
+	// Sub-second times and access and change times would need PAX records
+	hdr.ModTime = hdr.ModTime.Truncate(time.Second)
+	hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+	// Only the ids are meaningful inside of the image, the names are looked
+	// up on the host
+	hdr.Uname, hdr.Gname = "", ""
+}
+
+// reproducibleImageWriter is an aci.ArchiveWriter like the one returned by
+// aci.NewImageWriter, except that the manifest is written with a fixed
+// timestamp instead of the current time.
+type reproducibleImageWriter struct {
+	*tar.Writer
+	man     *schema.ImageManifest
+	modTime time.Time
+}
+
+func (aw *reproducibleImageWriter) AddFile(hdr *tar.Header, r io.Reader) error {
+	err := aw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	if r != nil {
+		_, err = io.Copy(aw, r)
+	}
+	return err
+}
+
+func (aw *reproducibleImageWriter) Close() error {
+	manblob, err := aw.man.MarshalJSON()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{
+		Name:     aci.ManifestFile,
+		Mode:     0644,
+		Size:     int64(len(manblob)),
+		ModTime:  aw.modTime,
+		Typeflag: tar.TypeReg,
+	}
+	makeHeaderReproducible(hdr, aw.modTime)
+	err = aw.AddFile(hdr, bytes.NewReader(manblob))
+	if err != nil {
+		return err
+	}
+	return aw.Writer.Close()
+}
+
+// writeWalkError turns an error encountered while walking the current ACI's
+// rootfs during a write into a friendlier one where possible.
+func (a *ACBuild) writeWalkError(err error) error {
+	pathErr, ok := err.(*os.PathError)
+	if !ok {
+		fmt.Printf("not a path error!\n")
+		return err
+	}
+	syscallErrno, ok := pathErr.Err.(syscall.Errno)
+	if !ok {
+		fmt.Printf("not a syscall errno!\n")
+		return err
+	}
+	if pathErr.Op == "open" && syscallErrno != syscall.EACCES {
+		return err
+	}
+	problemPath := strings.TrimPrefix(pathErr.Path, path.Join(a.CurrentACIPath, aci.RootfsDir))
+	return fmt.Errorf("%q: permission denied - call write as root", problemPath)
+}
+
 func signACI(acipath, signaturepath string, flags []string) error {
 	if len(flags) == 0 {
 		flags = []string{"--armor", "--yes"}
@@ -0,0 +1,203 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oci
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	layoutFile    = "oci-layout"
+	indexFile     = "index.json"
+	blobsDir      = "blobs"
+	layoutVersion = "1.0.0"
+)
+
+// Layout is an OCI image layout on disk: a directory holding an index, and the
+// blobs it references stored by their content address.
+type Layout struct {
+	Path string
+}
+
+// CreateLayout creates an empty image layout at path, which must not already
+// hold one.
+func CreateLayout(path string) (Layout, error) {
+	l := Layout{Path: path}
+	err := os.MkdirAll(filepath.Join(path, blobsDir, "sha256"), 0755)
+	if err != nil {
+		return l, err
+	}
+	blob, err := json.Marshal(map[string]string{"imageLayoutVersion": layoutVersion})
+	if err != nil {
+		return l, err
+	}
+	return l, ioutil.WriteFile(filepath.Join(path, layoutFile), blob, 0644)
+}
+
+// BlobPath returns the path of the blob with the given digest.
+func (l Layout) BlobPath(digest string) string {
+	return filepath.Join(l.Path, blobsDir, strings.Replace(digest, ":", string(filepath.Separator), 1))
+}
+
+// WriteBlob stores the contents of r as a blob, and returns its descriptor.
+func (l Layout) WriteBlob(mediaType string, r io.Reader) (Descriptor, error) {
+	tmp, err := ioutil.TempFile(filepath.Join(l.Path, blobsDir), ".tmp-")
+	if err != nil {
+		return Descriptor{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	err = tmp.Chmod(0644)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	desc := Descriptor{
+		MediaType: mediaType,
+		Digest:    fmt.Sprintf("sha256:%x", h.Sum(nil)),
+		Size:      size,
+	}
+	return desc, os.Rename(tmp.Name(), l.BlobPath(desc.Digest))
+}
+
+// WriteJSONBlob stores v marshalled as JSON as a blob, and returns its
+// descriptor.
+func (l Layout) WriteJSONBlob(mediaType string, v interface{}) (Descriptor, error) {
+	blob, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+	return l.WriteBlob(mediaType, strings.NewReader(string(blob)))
+}
+
+// WriteIndex stores the layout's index.
+func (l Layout) WriteIndex(index Index) error {
+	blob, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(l.Path, indexFile), blob, 0644)
+}
+
+// WriteTar writes the layout to w as an uncompressed tarball, with the
+// layout's directory as the root of the tarball. Every entry in the tarball is
+// owned by root and has the given modification time, so that the same layout
+// always produces the same tarball.
+func (l Layout) WriteTar(w io.Writer, modTime time.Time) error {
+	tw := tar.NewWriter(w)
+	err := filepath.Walk(l.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(l.Path, path)
+		if err != nil {
+			return err
+		}
+		if relpath == "." {
+			return nil
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(relpath)
+		hdr.ModTime = modTime.Truncate(time.Second)
+		hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// OpenLayout opens the existing image layout at path.
+func OpenLayout(path string) (Layout, error) {
+	l := Layout{Path: path}
+	blob, err := ioutil.ReadFile(filepath.Join(path, layoutFile))
+	if os.IsNotExist(err) {
+		return l, fmt.Errorf("%s is not an OCI image layout", path)
+	}
+	if err != nil {
+		return l, err
+	}
+	var layout struct {
+		Version string `json:"imageLayoutVersion"`
+	}
+	err = json.Unmarshal(blob, &layout)
+	if err != nil {
+		return l, fmt.Errorf("invalid %s: %v", layoutFile, err)
+	}
+	if layout.Version != layoutVersion {
+		return l, fmt.Errorf("unsupported image layout version %q", layout.Version)
+	}
+	return l, nil
+}
+
+// ReadIndex reads the layout's index.
+func (l Layout) ReadIndex() (Index, error) {
+	var index Index
+	blob, err := ioutil.ReadFile(filepath.Join(l.Path, indexFile))
+	if err != nil {
+		return index, err
+	}
+	return index, json.Unmarshal(blob, &index)
+}
+
+// ReadJSONBlob unmarshals the JSON blob with the given descriptor into v,
+// after checking that the blob matches the descriptor's digest.
+func (l Layout) ReadJSONBlob(desc Descriptor, v interface{}) error {
+	if !strings.HasPrefix(desc.Digest, "sha256:") {
+		return fmt.Errorf("unsupported digest %q", desc.Digest)
+	}
+	blob, err := ioutil.ReadFile(l.BlobPath(desc.Digest))
+	if err != nil {
+		return err
+	}
+	if digest := fmt.Sprintf("sha256:%x", sha256.Sum256(blob)); digest != desc.Digest {
+		return fmt.Errorf("blob %s has digest %s", desc.Digest, digest)
+	}
+	return json.Unmarshal(blob, v)
+}
@@ -19,18 +19,22 @@ import (
 	"compress/bzip2"
 	"compress/gzip"
 	"crypto/sha512"
-	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
 	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/appc/spec/aci"
 	"github.com/appc/spec/discovery"
 	"github.com/appc/spec/pkg/acirenderer"
+	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
 	"github.com/coreos/ioprogress"
 	"xi2.org/x/xz"
@@ -38,41 +42,62 @@ import (
 	"github.com/appc/acbuild/util"
 )
 
-func (r Registry) tmppath() string {
-	return path.Join(r.DepStoreTarPath, "tmp.aci")
-}
-
-func (r Registry) tmpuncompressedpath() string {
-	return path.Join(r.DepStoreTarPath, "tmp.uncompressed.aci")
-}
+// sizeFile is the name of the file next to an image's manifest in
+// DepStoreExpandedPath recording its size as downloaded.
+const sizeFile = "size"
 
 // Fetch will download the given image, and optionally its dependencies, into
-// r.DepStoreTarPath
-func (r Registry) Fetch(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) error {
-	_, err := r.GetACI(imagename, labels)
-	if err == ErrNotFound {
-		err := r.fetchACIWithSize(imagename, labels, size, fetchDeps)
-		if err != nil {
-			return err
-		}
-		return nil
+// r.DepStoreTarPath, and returns its key
+func (r Registry) Fetch(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) (string, error) {
+	unlock, err := r.lock()
+	if err != nil {
+		return "", err
 	}
-	return err
+	defer unlock()
+	r.locked = true
+	r.fetches = newFetchGroup(r.Concurrency, r.Insecure)
+	defer r.fetches.close()
+	return r.fetch(imagename, labels, size, fetchDeps)
 }
 
 // FetchAndRender will fetch the given image and all of its dependencies if
 // they have not been fetched yet, and will then render them on to the
 // filesystem if they have not been rendered yet.
 func (r Registry) FetchAndRender(imagename types.ACIdentifier, labels types.Labels, size uint) error {
-	err := r.Fetch(imagename, labels, size, true)
+	_, err := r.FetchAndRenderDependency(types.Dependency{
+		ImageName: imagename,
+		Labels:    labels,
+		Size:      size,
+	})
+	return err
+}
+
+// FetchAndRenderDependency is like FetchAndRender, for the image a dependency
+// refers to. If the dependency has an image ID, the image with that ID is
+// used, and an error is returned if a different image is fetched for it. The
+// image's key is returned.
+func (r Registry) FetchAndRenderDependency(dep types.Dependency) (string, error) {
+	unlock, err := r.lock()
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer unlock()
+	r.locked = true
+	r.fetches = newFetchGroup(r.Concurrency, r.Insecure)
+	defer r.fetches.close()
 
-	filesToRender, err := acirenderer.GetRenderedACI(imagename,
-		labels, r)
+	key, err := r.fetchDependency(dep, true)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	imageID, err := types.NewHash(key)
+	if err != nil {
+		return "", err
+	}
+	filesToRender, err := acirenderer.GetRenderedACIWithImageID(*imageID, r)
+	if err != nil {
+		return "", err
 	}
 
 filesloop:
@@ -82,7 +107,7 @@ filesloop:
 		case os.IsNotExist(err):
 			break
 		case err != nil:
-			return err
+			return "", err
 		default:
 			// This ACI has already been rendered
 			continue filesloop
@@ -91,113 +116,325 @@ filesloop:
 		err = util.ExtractImage(path.Join(r.DepStoreTarPath, fs.Key),
 			path.Join(r.DepStoreExpandedPath, fs.Key), fs.FileMap)
 		if err != nil {
-			return err
+			return "", err
 		}
 
 		rfile, err := os.Create(
 			path.Join(r.DepStoreExpandedPath, fs.Key, "rendered"))
 		if err != nil {
-			return err
+			return "", err
 		}
 		rfile.Close()
 	}
-	return nil
+	return key, nil
 }
 
-func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) error {
-	endpoint, err := r.discoverEndpoint(imagename, labels)
+// FetchDependency will fetch the image a dependency refers to, but not its
+// dependencies, if it has not been fetched yet, and returns its key. Like
+// FetchAndRenderDependency, it only accepts the image with the dependency's
+// image ID if it has one.
+func (r Registry) FetchDependency(dep types.Dependency) (string, error) {
+	unlock, err := r.lock()
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer unlock()
+	r.locked = true
+	r.fetches = newFetchGroup(r.Concurrency, r.Insecure)
+	defer r.fetches.close()
+	return r.fetchDependency(dep, false)
+}
 
-	err = r.download(endpoint.ACI, r.tmppath(), string(imagename))
+// FetchLatest will fetch the given image and its dependencies again, even if
+// they are already in the store, so that newer images matching the name and
+// labels are found. The image's key is returned.
+func (r Registry) FetchLatest(imagename types.ACIdentifier, labels types.Labels) (string, error) {
+	unlock, err := r.lock()
 	if err != nil {
-		return err
+		return "", err
 	}
+	defer unlock()
+	r.locked = true
+	r.fetches = newFetchGroup(r.Concurrency, r.Insecure)
+	defer r.fetches.close()
+	return r.fetchACIWithSize(imagename, labels, 0, true)
+}
 
-	//TODO: download .asc, verify the .aci with it
+// Size returns the size of the image with the given key as it was downloaded,
+// or 0 if it isn't known.
+func (r Registry) Size(key string) (uint, error) {
+	blob, err := ioutil.ReadFile(path.Join(r.DepStoreExpandedPath, key, sizeFile))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	size, err := strconv.ParseUint(string(blob), 10, 0)
+	if err != nil {
+		return 0, err
+	}
+	return uint(size), nil
+}
 
-	if size != 0 {
-		finfo, err := os.Stat(r.tmppath())
+// lock creates the stores r fetches images into, and if they belong to a
+// shared Store takes its lock, so that only one build adds images to it at a
+// time. The returned function releases the lock.
+func (r Registry) lock() (func() error, error) {
+	for _, dir := range []string{r.DepStoreTarPath, r.DepStoreExpandedPath} {
+		err := os.MkdirAll(dir, 0755)
 		if err != nil {
-			return err
+			return nil, err
+		}
+	}
+	if r.LockPath == "" {
+		return func() error { return nil }, nil
+	}
+	f, err := lockFile(r.LockPath, syscall.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	return f.Close, nil
+}
+
+// fetch downloads the given image, and optionally its dependencies, if they
+// aren't in the store yet, and returns the image's key. An image that is
+// already being fetched by another dependency is only fetched once.
+func (r Registry) fetch(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) (string, error) {
+	id := fetchID(imagename, labels)
+	return r.fetches.do(r.fetchID, id, func() (string, error) {
+		r.fetchID = id
+		key, err := r.GetACI(imagename, labels)
+		switch {
+		case err == ErrNotFound:
+			key, err = r.fetchACIWithSize(imagename, labels, size, fetchDeps)
+			if err != nil {
+				return "", err
+			}
+		case err != nil:
+			return "", err
+		case fetchDeps:
+			err := r.fetchDeps(key)
+			if err != nil {
+				return "", err
+			}
 		}
-		if finfo.Size() != int64(size) {
-			return fmt.Errorf(
-				"dependency %s has incorrect size: expected=%d, actual=%d",
-				size, finfo.Size())
+		return key, r.touch(key)
+	})
+}
+
+// fetchDependency fetches the image dep refers to, and optionally its
+// dependencies, preferring the image with dep's image ID if it is in the store.
+func (r Registry) fetchDependency(dep types.Dependency, fetchDeps bool) (string, error) {
+	if dep.ImageID != nil {
+		key, err := r.ResolveKey(dep.ImageID.String())
+		if err == nil {
+			if fetchDeps {
+				err = r.fetchDeps(key)
+				if err != nil {
+					return "", err
+				}
+			}
+			return key, r.touch(key)
 		}
 	}
 
-	err = r.uncompress()
+	key, err := r.fetch(dep.ImageName, dep.Labels, dep.Size, fetchDeps)
 	if err != nil {
-		return err
+		return "", err
 	}
+	if dep.ImageID != nil && key != dep.ImageID.String() {
+		return "", fmt.Errorf("dependency %s resolved to %s, which doesn't match its image ID %s",
+			dep.ImageName, key, dep.ImageID)
+	}
+	return key, nil
+}
 
-	err = os.Remove(r.tmppath())
+// fetchDeps fetches the dependencies of the image with the given key, which
+// may have been fetched without them, if they aren't in the store yet.
+func (r Registry) fetchDeps(key string) error {
+	man, err := r.GetImageManifest(key)
 	if err != nil {
 		return err
 	}
+	_, err = r.fetchAll(man.Name, man.Dependencies)
+	return err
+}
 
-	id, err := GenImageID(r.tmpuncompressedpath())
-	if err != nil {
-		return err
+// fetchAll fetches the given dependencies of the image with the given name,
+// along with their own dependencies, in parallel, and returns their keys.
+func (r Registry) fetchAll(name types.ACIdentifier, deps types.Dependencies) ([]string, error) {
+	keys := make([]string, len(deps))
+	errs := make([]error, len(deps))
+	var wg sync.WaitGroup
+	for i, dep := range deps {
+		wg.Add(1)
+		go func(i int, dep types.Dependency) {
+			defer wg.Done()
+			keys[i], errs[i] = r.fetch(dep.ImageName, dep.Labels, dep.Size, true)
+		}(i, dep)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("couldn't fetch dependency %s of %s: %v", deps[i].ImageName, name, err)
+		}
 	}
+	return keys, nil
+}
+
+// touch records that the image with the given key was just used, for pruning
+// shared stores.
+func (r Registry) touch(key string) error {
+	now := time.Now()
+	return os.Chtimes(path.Join(r.DepStoreTarPath, key), now, now)
+}
 
-	err = os.Rename(r.tmpuncompressedpath(), path.Join(r.DepStoreTarPath, id))
+func (r Registry) fetchACIWithSize(imagename types.ACIdentifier, labels types.Labels, size uint, fetchDeps bool) (string, error) {
+	id, man, err := r.downloadACI(imagename, labels, size)
 	if err != nil {
-		return err
+		return "", err
 	}
 
 	if !fetchDeps {
-		return nil
+		return id, nil
+	}
+
+	depids, err := r.fetchAll(imagename, man.Dependencies)
+	if err != nil {
+		return "", err
+	}
+	for i, dep := range man.Dependencies {
+		if dep.ImageID != nil && depids[i] != dep.ImageID.String() {
+			return "", fmt.Errorf("dependency %s doesn't match hash",
+				dep.ImageName)
+		}
+	}
+	return id, nil
+}
+
+// downloadACI downloads the given image into the store, and returns its key
+// and manifest. Only a limited number of images are downloaded at once.
+func (r Registry) downloadACI(imagename types.ACIdentifier, labels types.Labels, size uint) (string, *schema.ImageManifest, error) {
+	release := r.fetches.acquire()
+	defer release()
+
+	endpoint, err := r.discoverEndpoint(imagename, labels)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// Other images may be downloaded into the store at the same time
+	tmppath, err := r.tempFile()
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmppath)
+
+	err = r.download(endpoint.ACI, tmppath, string(imagename))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if r.Insecure {
+		fmt.Fprintf(os.Stderr, "warning: signature verification of %s has been disabled\n", imagename)
+	} else {
+		tmpascpath, err := r.tempFile()
+		if err != nil {
+			return "", nil, err
+		}
+		defer os.Remove(tmpascpath)
+		err = r.download(endpoint.ASC, tmpascpath, string(imagename)+" signature")
+		if err != nil {
+			return "", nil, err
+		}
+		err = TrustStore{Path: r.TrustStorePath}.Verify(imagename, tmppath, tmpascpath)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	finfo, err := os.Stat(tmppath)
+	if err != nil {
+		return "", nil, err
+	}
+	if size != 0 && finfo.Size() != int64(size) {
+		return "", nil, fmt.Errorf(
+			"dependency %s has incorrect size: expected=%d, actual=%d",
+			imagename, size, finfo.Size())
+	}
+
+	tmpuncompressedpath, err := r.tempFile()
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.Remove(tmpuncompressedpath)
+	err = uncompress(tmppath, tmpuncompressedpath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	id, err := GenImageID(tmpuncompressedpath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	err = os.Rename(tmpuncompressedpath, path.Join(r.DepStoreTarPath, id))
+	if err != nil {
+		return "", nil, err
 	}
 
 	err = os.MkdirAll(
 		path.Join(r.DepStoreExpandedPath, id, aci.RootfsDir), 0755)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	err = getManifestFromTar(path.Join(r.DepStoreTarPath, id),
 		path.Join(r.DepStoreExpandedPath, id, aci.ManifestFile))
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+
+	// The size of the image as downloaded is what dependencies record
+	err = ioutil.WriteFile(path.Join(r.DepStoreExpandedPath, id, sizeFile),
+		[]byte(strconv.FormatInt(finfo.Size(), 10)), 0644)
+	if err != nil {
+		return "", nil, err
 	}
 
 	man, err := r.GetImageManifest(id)
 	if err != nil {
-		return err
+		return "", nil, err
 	}
 
 	if man.Name != imagename {
-		return fmt.Errorf(
+		return "", nil, fmt.Errorf(
 			"downloaded ACI name %q does not match expected image name %q",
 			man.Name, imagename)
 	}
 
-	for _, dep := range man.Dependencies {
-		err := r.fetchACIWithSize(dep.ImageName, dep.Labels, dep.Size, fetchDeps)
-		if err != nil {
-			return err
-		}
-		if dep.ImageID != nil {
-			id, err := r.GetACI(dep.ImageName, dep.Labels)
-			if err != nil {
-				return err
-			}
-			if id != dep.ImageID.String() {
-				return fmt.Errorf("dependency %s doesn't match hash",
-					dep.ImageName)
-			}
-		}
+	err = r.addToIndex(id, man.Name, man.Labels)
+	if err != nil {
+		return "", nil, err
 	}
-	return nil
+	return id, man, nil
+}
+
+// tempFile creates an empty file in the store to download an image into, and
+// returns its path. Store.GC removes any that are left behind.
+func (r Registry) tempFile() (string, error) {
+	f, err := ioutil.TempFile(r.DepStoreTarPath, "tmp")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
 }
 
 // Need to uncompress the file to be able to generate the Image ID
-func (r Registry) uncompress() error {
-	acifile, err := os.Open(r.tmppath())
+func uncompress(src, dst string) error {
+	acifile, err := os.Open(src)
 	if err != nil {
 		return err
 	}
@@ -236,7 +473,7 @@ func (r Registry) uncompress() error {
 		return fmt.Errorf("downloaded ACI is of an unknown type")
 	}
 
-	out, err := os.OpenFile(r.tmpuncompressedpath(),
+	out, err := os.OpenFile(dst,
 		os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
 		return err
@@ -276,7 +513,11 @@ func getManifestFromTar(tarpath, dst string) error {
 		switch {
 		case hdr.Typeflag == tar.TypeReg:
 			if hdr.Name == aci.ManifestFile {
-				f, err := os.OpenFile(dst,
+				// The manifest is written to a temporary file first,
+				// so that it never appears half written to another
+				// build sharing the store
+				tmpdst := dst + ".tmp"
+				f, err := os.OpenFile(tmpdst,
 					os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 				if err != nil {
 					return err
@@ -286,7 +527,7 @@ func getManifestFromTar(tarpath, dst string) error {
 				if err != nil {
 					return err
 				}
-				return nil
+				return os.Rename(tmpdst, dst)
 			}
 		default:
 			continue
@@ -354,30 +595,24 @@ func (r Registry) discoverEndpoint(imageName types.ACIdentifier, labels types.La
 	return &acis[0], nil
 }
 
+// Download fetches the file at url to path, showing the progress of the
+// download on stderr as label. Proxies are taken from the environment, and if
+// r.Insecure is set TLS certificates aren't verified.
+func (r Registry) Download(url, path, label string) error {
+	r.fetches = newFetchGroup(r.Concurrency, r.Insecure)
+	defer r.fetches.close()
+	return r.download(url, path, label)
+}
+
 func (r Registry) download(url, path, label string) error {
 	//TODO: auth
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return err
 	}
-	transport := http.DefaultTransport
-	transport.(*http.Transport).Proxy = http.ProxyFromEnvironment
-	if r.Insecure {
-		transport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
-	}
-
-	client := &http.Client{Transport: transport}
 	//f.setHTTPHeaders(req, etag)
 
-	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
-		if len(via) >= 10 {
-			return fmt.Errorf("too many redirects")
-		}
-		//f.setHTTPHeaders(req, etag)
-		return nil
-	}
-
-	res, err := client.Do(req)
+	res, err := r.fetches.client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -395,7 +630,7 @@ func (r Registry) download(url, path, label string) error {
 		return err
 	}
 
-	reader := newIoprogress(label, res.ContentLength, res.Body)
+	reader := r.newIoprogress(label, res.ContentLength, res.Body)
 
 	_, err = io.Copy(out, reader)
 	if err != nil {
@@ -415,7 +650,9 @@ func (r Registry) download(url, path, label string) error {
 	return nil
 }
 
-func newIoprogress(label string, size int64, rdr io.Reader) io.Reader {
+// newIoprogress returns a reader drawing the progress of reading rdr. The
+// downloads of a call into the registry each get a line of their own.
+func (r Registry) newIoprogress(label string, size int64, rdr io.Reader) io.Reader {
 	prefix := "Downloading " + label
 	fmtBytesSize := 18
 
@@ -444,10 +681,14 @@ func newIoprogress(label string, size int64, rdr io.Reader) io.Reader {
 		)
 	}
 
+	drawFunc := ioprogress.DrawTerminalf(os.Stderr, fmtfunc)
+	if r.fetches != nil {
+		drawFunc = r.fetches.progress.drawFunc(fmtfunc)
+	}
 	return &ioprogress.Reader{
 		Reader:       rdr,
 		Size:         size,
-		DrawFunc:     ioprogress.DrawTerminalf(os.Stderr, fmtfunc),
+		DrawFunc:     drawFunc,
 		DrawInterval: time.Second,
 	}
 }
@@ -0,0 +1,160 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/appc/spec/schema/types"
+)
+
+// DefaultConcurrency is the number of images a Registry downloads at once if
+// its Concurrency isn't set.
+const DefaultConcurrency = 4
+
+// fetchGroup coordinates the fetches made by one call into a Registry, which
+// fetch the dependencies of every image in parallel. It downloads at most a
+// limited number of images at once, and fetches each image only once, however
+// many images depend on it. Its downloads share one transport, so that
+// connections to the same server are reused.
+type fetchGroup struct {
+	sem       chan struct{}
+	progress  *progressLines
+	transport *http.Transport
+	client    *http.Client
+
+	mu    sync.Mutex
+	calls map[string]*fetchCall
+	// deps maps the id of every fetch to the ids of the fetches of its
+	// dependencies, to detect cycles
+	deps map[string][]string
+}
+
+type fetchCall struct {
+	done chan struct{}
+	key  string
+	err  error
+}
+
+// newFetchGroup returns a fetchGroup downloading at most concurrency images at
+// once, or DefaultConcurrency if it's 0. If insecure is set, TLS certificates
+// aren't verified. close must be called once the group is done.
+func newFetchGroup(concurrency int, insecure bool) *fetchGroup {
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+	// The default transport's proxy settings and timeouts are kept, but
+	// it's left alone itself
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return fmt.Errorf("too many redirects")
+			}
+			//f.setHTTPHeaders(req, etag)
+			return nil
+		},
+	}
+	return &fetchGroup{
+		sem:       make(chan struct{}, concurrency),
+		progress:  newProgressLines(),
+		transport: transport,
+		client:    client,
+		calls:     make(map[string]*fetchCall),
+		deps:      make(map[string][]string),
+	}
+}
+
+// close closes the idle connections the group's downloads left open.
+func (g *fetchGroup) close() {
+	g.transport.CloseIdleConnections()
+}
+
+// fetchID returns the id of the fetch of the image with the given name and
+// labels, which also describes it in errors.
+func fetchID(name types.ACIdentifier, labels types.Labels) string {
+	var ls []string
+	for _, l := range labels {
+		ls = append(ls, string(l.Name)+"="+l.Value)
+	}
+	sort.Strings(ls)
+	return strings.Join(append([]string{string(name)}, ls...), ",")
+}
+
+// do calls fn to fetch the image with the given id for the fetch with the id
+// parent, unless it is already being fetched, in which case the result of
+// that fetch is waited for instead. An error is returned if the image depends
+// on parent.
+func (g *fetchGroup) do(parent, id string, fn func() (string, error)) (string, error) {
+	if g == nil {
+		return fn()
+	}
+
+	g.mu.Lock()
+	call, ok := g.calls[id]
+	if ok {
+		if cycle := g.path(id, parent); cycle != nil {
+			g.mu.Unlock()
+			return "", fmt.Errorf("dependency cycle: %s", strings.Join(append(cycle, id), " -> "))
+		}
+	} else {
+		call = &fetchCall{done: make(chan struct{})}
+		g.calls[id] = call
+	}
+	g.deps[parent] = append(g.deps[parent], id)
+	g.mu.Unlock()
+
+	if ok {
+		<-call.done
+	} else {
+		call.key, call.err = fn()
+		close(call.done)
+	}
+	return call.key, call.err
+}
+
+// path returns the ids of the fetches leading from the fetch with the id from
+// to the one with the id to through their dependencies, or nil if there are
+// none.
+func (g *fetchGroup) path(from, to string) []string {
+	if from == to {
+		return []string{from}
+	}
+	for _, dep := range g.deps[from] {
+		if p := g.path(dep, to); p != nil {
+			return append([]string{from}, p...)
+		}
+	}
+	return nil
+}
+
+// acquire waits until fewer images than the group's limit are being
+// downloaded. The returned function must be called once the download is done.
+func (g *fetchGroup) acquire() func() {
+	if g == nil {
+		return func() {}
+	}
+	g.sem <- struct{}{}
+	return func() { <-g.sem }
+}
@@ -0,0 +1,98 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchGroupFetchesOnce(t *testing.T) {
+	g := newFetchGroup(2, false)
+	var mu sync.Mutex
+	fetches := 0
+	fetch := func() (string, error) {
+		mu.Lock()
+		fetches++
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		return "sha512-aa", nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, err := g.do("", "example.com/app", fetch)
+			if err != nil || key != "sha512-aa" {
+				t.Errorf("unexpected result: %q, %v", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("image was fetched %d times", fetches)
+	}
+}
+
+func TestFetchGroupConcurrency(t *testing.T) {
+	g := newFetchGroup(2, false)
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := g.acquire()
+			defer release()
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if maxRunning != 2 {
+		t.Errorf("%d downloads ran at once, expected 2", maxRunning)
+	}
+}
+
+func TestFetchGroupCycle(t *testing.T) {
+	g := newFetchGroup(2, false)
+	_, err := g.do("", "example.com/a", func() (string, error) {
+		return g.do("example.com/a", "example.com/b,version=1", func() (string, error) {
+			return g.do("example.com/b,version=1", "example.com/a", func() (string, error) {
+				t.Fatalf("image in a cycle was fetched twice")
+				return "", nil
+			})
+		})
+	})
+	expected := "dependency cycle: example.com/a -> example.com/b,version=1 -> example.com/a"
+	if err == nil || err.Error() != expected {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
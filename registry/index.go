@@ -0,0 +1,256 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/util"
+)
+
+// indexFile is the name of the file in DepStoreExpandedPath holding the
+// store's index.
+const indexFile = "index.json"
+
+// indexLock is held along with the store's lock while the index is updated,
+// as the dependencies of an image are fetched, and added to the index, in
+// parallel by the same build.
+var indexLock sync.Mutex
+
+// storeIndex maps the names of the images in a store to their keys and
+// labels, so that images can be looked up without reading every manifest in
+// the store. The entries for each name are sorted by key.
+type storeIndex map[types.ACIdentifier][]indexEntry
+
+type indexEntry struct {
+	Key    string       `json:"key"`
+	Labels types.Labels `json:"labels"`
+}
+
+// lookup returns the key of the image with the given name whose labels match
+// labels, ignoring the labels the image doesn't have. If several images
+// match, the one with the most of the labels wins, and then the one with the
+// lowest key, so that the same image is picked every time.
+func (idx storeIndex) lookup(name types.ACIdentifier, labels types.Labels) (string, bool) {
+	key, bestMatched := "", -1
+nextentry:
+	for _, entry := range idx[name] {
+		matched := 0
+		for _, l := range labels {
+			val, ok := entry.Labels.Get(l.Name.String())
+			if !ok {
+				continue
+			}
+			if val != l.Value {
+				continue nextentry
+			}
+			matched++
+		}
+		if matched > bestMatched {
+			key, bestMatched = entry.Key, matched
+		}
+	}
+	return key, bestMatched != -1
+}
+
+func (idx storeIndex) add(key string, name types.ACIdentifier, labels types.Labels) {
+	entries := idx[name]
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Key >= key })
+	if i < len(entries) && entries[i].Key == key {
+		entries[i].Labels = labels
+		return
+	}
+	entries = append(entries, indexEntry{})
+	copy(entries[i+1:], entries[i:])
+	entries[i] = indexEntry{Key: key, Labels: labels}
+	idx[name] = entries
+}
+
+// remove drops the image with the given key from the index, and returns
+// whether it was in it.
+func (idx storeIndex) remove(key string) bool {
+	for name, entries := range idx {
+		for i, entry := range entries {
+			if entry.Key != key {
+				continue
+			}
+			entries = append(entries[:i], entries[i+1:]...)
+			if len(entries) == 0 {
+				delete(idx, name)
+			} else {
+				idx[name] = entries
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// readIndex returns the store's index, or nil if it has none.
+func (r Registry) readIndex() (storeIndex, error) {
+	blob, err := ioutil.ReadFile(path.Join(r.DepStoreExpandedPath, indexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var idx storeIndex
+	err = json.Unmarshal(blob, &idx)
+	if err != nil {
+		// A corrupt index is rebuilt like a missing one
+		return nil, nil
+	}
+	return idx, nil
+}
+
+// writeIndex replaces the store's index with idx. The index is written to a
+// temporary file that's renamed into place, so that other builds sharing the
+// store never read it half written.
+func (r Registry) writeIndex(idx storeIndex) error {
+	blob, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(r.DepStoreExpandedPath, indexFile+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	_, err = tmpFile.Write(blob)
+	if err1 := tmpFile.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path.Join(r.DepStoreExpandedPath, indexFile))
+}
+
+// rebuildIndex indexes every image in the store by reading its manifest, and
+// saves the result as the store's index. The locks taken by lockIndex must be
+// held.
+func (r Registry) rebuildIndex() (storeIndex, error) {
+	idx := storeIndex{}
+	files, err := ioutil.ReadDir(r.DepStoreExpandedPath)
+	if os.IsNotExist(err) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !file.IsDir() {
+			continue
+		}
+		man, err := util.GetManifest(path.Join(r.DepStoreExpandedPath, file.Name()))
+		if os.IsNotExist(err) {
+			// The ACI is still being fetched
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		idx.add(file.Name(), man.Name, man.Labels)
+	}
+	return idx, r.writeIndex(idx)
+}
+
+// lockIndex takes the locks needed to update the store's index: the store's
+// lock, unless the current call into the registry already holds it, so that
+// other builds sharing the store don't update the index at the same time, and
+// indexLock. The returned function releases them.
+func (r Registry) lockIndex() (func() error, error) {
+	unlock := func() error { return nil }
+	if !r.locked && r.LockPath != "" {
+		f, err := lockFile(r.LockPath, syscall.LOCK_EX)
+		if err != nil {
+			return nil, err
+		}
+		unlock = f.Close
+	}
+	indexLock.Lock()
+	return func() error {
+		indexLock.Unlock()
+		return unlock()
+	}, nil
+}
+
+// addToIndex records the image with the given key, name and labels in the
+// store's index.
+func (r Registry) addToIndex(key string, name types.ACIdentifier, labels types.Labels) (err error) {
+	unlock, err := r.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	idx, err := r.readIndex()
+	if err != nil {
+		return err
+	}
+	if idx == nil {
+		// Indexing the rest of the store also picks up the new image
+		_, err := r.rebuildIndex()
+		return err
+	}
+	idx.add(key, name, labels)
+	return r.writeIndex(idx)
+}
+
+// removeFromIndex drops the image with the given key from the store's index.
+func (r Registry) removeFromIndex(key string) (err error) {
+	unlock, err := r.lockIndex()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err1 := unlock(); err == nil {
+			err = err1
+		}
+	}()
+
+	idx, err := r.readIndex()
+	if err != nil || idx == nil || !idx.remove(key) {
+		// A missing index is rebuilt without the image anyway
+		return err
+	}
+	return r.writeIndex(idx)
+}
+
+// inStore returns whether the image with the given key is still in the store.
+func (r Registry) inStore(key string) (bool, error) {
+	_, err := os.Stat(path.Join(r.DepStoreExpandedPath, key, aci.ManifestFile))
+	switch {
+	case os.IsNotExist(err):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	return true, nil
+}
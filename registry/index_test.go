@@ -0,0 +1,221 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+func mustStoreManifest(t *testing.T, r Registry, key, name string, labels map[types.ACIdentifier]string) {
+	man := schema.BlankImageManifest()
+	man.Name = *types.MustACIdentifier(name)
+	for labelName, value := range labels {
+		man.Labels = append(man.Labels, types.Label{Name: labelName, Value: value})
+	}
+	blob, err := json.Marshal(man)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	dir := path.Join(r.DepStoreExpandedPath, key)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(path.Join(dir, aci.ManifestFile), blob, 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestGetACIIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-index-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := Registry{DepStoreExpandedPath: dir}
+
+	key := func(c string) string { return "sha512-" + strings.Repeat(c, 64) }
+	mustStoreManifest(t, r, key("b"), "example.com/app", map[types.ACIdentifier]string{"version": "1.0", "os": "linux"})
+	mustStoreManifest(t, r, key("a"), "example.com/app", map[types.ACIdentifier]string{"version": "2.0", "os": "linux"})
+	mustStoreManifest(t, r, key("c"), "example.com/app", map[types.ACIdentifier]string{"os": "linux"})
+
+	labels := func(l map[types.ACIdentifier]string) types.Labels {
+		labels, err := types.LabelsFromMap(l)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		return labels
+	}
+	for _, tt := range []struct {
+		labels types.Labels
+		key    string
+	}{
+		// Ties are broken by the lowest key
+		{nil, key("a")},
+		{labels(map[types.ACIdentifier]string{"os": "linux"}), key("a")},
+		// The image with the most matching labels wins
+		{labels(map[types.ACIdentifier]string{"version": "1.0"}), key("b")},
+		{labels(map[types.ACIdentifier]string{"version": "3.0"}), key("c")},
+	} {
+		for i := 0; i < 2; i++ {
+			got, err := r.GetACI("example.com/app", tt.labels)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if got != tt.key {
+				t.Errorf("labels %v: got %s, expected %s", tt.labels, got, tt.key)
+			}
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, indexFile)); err != nil {
+		t.Errorf("index wasn't saved: %v", err)
+	}
+
+	if _, err := r.GetACI("example.com/other", nil); err != ErrNotFound {
+		t.Errorf("missing image: got %v, expected ErrNotFound", err)
+	}
+
+	// Images removed from the store are dropped from the index
+	err = os.RemoveAll(path.Join(dir, key("a")))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	got, err := r.GetACI("example.com/app", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got != key("b") {
+		t.Errorf("got %s after removing %s, expected %s", got, key("a"), key("b"))
+	}
+
+	// New images are added to the index
+	err = r.addToIndex(key("d"), "example.com/new", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	idx, err := r.readIndex()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got, ok := idx.lookup("example.com/new", nil); !ok || got != key("d") {
+		t.Errorf("added image not in the index")
+	}
+
+	// Images missing from an intact index aren't looked for in the store
+	mustStoreManifest(t, r, key("e"), "example.com/unindexed", nil)
+	if _, err := r.GetACI("example.com/unindexed", nil); err != ErrNotFound {
+		t.Errorf("unindexed image: got %v, expected ErrNotFound", err)
+	}
+
+	// A corrupt index is rebuilt
+	err = ioutil.WriteFile(path.Join(dir, indexFile), []byte("{"), 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	got, err = r.GetACI("example.com/unindexed", nil)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if got != key("e") {
+		t.Errorf("got %s from the rebuilt index, expected %s", got, key("e"))
+	}
+}
+
+func TestIndexStoreLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-index-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	r := Registry{
+		DepStoreExpandedPath: dir,
+		LockPath:             path.Join(dir, "lock"),
+	}
+
+	// The index isn't updated while another build holds the store's lock
+	lock, err := lockFile(r.LockPath, syscall.LOCK_EX)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- r.addToIndex("sha512-"+strings.Repeat("a", 64), "example.com/app", nil)
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("index updated while the store was locked: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	lock.Close()
+	if err := <-done; err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestPruneIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acbuild-index-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(dir)
+	s := Store{Path: dir}
+	r := Registry{
+		DepStoreTarPath:      s.TarPath(),
+		DepStoreExpandedPath: s.ExpandedPath(),
+		LockPath:             s.LockPath(),
+	}
+
+	key := "sha512-" + strings.Repeat("a", 64)
+	mustStoreManifest(t, r, key, "example.com/app", nil)
+	err = os.MkdirAll(s.TarPath(), 0755)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = ioutil.WriteFile(path.Join(s.TarPath(), key), nil, 0644)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := r.GetACI("example.com/app", nil); err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, err = s.Prune(PruneOptions{All: true})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	idx, err := r.readIndex()
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if idx == nil {
+		t.Fatalf("the index was removed")
+	}
+	if _, ok := idx.lookup("example.com/app", nil); ok {
+		t.Errorf("pruned image still in the index")
+	}
+}
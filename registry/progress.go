@@ -0,0 +1,79 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/coreos/ioprogress"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// progressLines draws the progress of concurrent downloads to stderr. On a
+// terminal every download keeps a line of its own, which is redrawn in place,
+// and otherwise every update is printed on a new line.
+type progressLines struct {
+	mu    sync.Mutex
+	tty   bool
+	lines []string
+	// drawn is the number of lines drawn above the cursor
+	drawn int
+}
+
+func newProgressLines() *progressLines {
+	return &progressLines{tty: terminal.IsTerminal(int(os.Stderr.Fd()))}
+}
+
+// drawFunc returns an ioprogress.DrawFunc drawing the text formatted by f on a
+// new line.
+func (p *progressLines) drawFunc(f ioprogress.DrawTextFormatFunc) ioprogress.DrawFunc {
+	p.mu.Lock()
+	i := len(p.lines)
+	p.lines = append(p.lines, "")
+	p.mu.Unlock()
+
+	return func(progress, total int64) error {
+		// The end of the download, after which ioprogress would move
+		// on to a new line
+		if progress == -1 && total == -1 {
+			return nil
+		}
+		line := f(progress, total)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if !p.tty {
+			_, err := fmt.Fprintln(os.Stderr, line)
+			return err
+		}
+		p.lines[i] = line
+
+		var buf bytes.Buffer
+		if p.drawn > 0 {
+			// Move back up to the first line
+			fmt.Fprintf(&buf, "\033[%dA", p.drawn)
+		}
+		for _, line := range p.lines {
+			// Clear the rest of every line
+			fmt.Fprintf(&buf, "\r%s\033[K\n", line)
+		}
+		p.drawn = len(p.lines)
+		_, err := os.Stderr.Write(buf.Bytes())
+		return err
+	}
+}
@@ -49,8 +49,28 @@ var (
 type Registry struct {
 	DepStoreTarPath      string
 	DepStoreExpandedPath string
-	Insecure             bool
-	Debug                bool
+	// TrustStorePath is the path of the TrustStore holding the keys fetched
+	// ACIs' signatures are verified with. Signatures are only skipped when
+	// Insecure is set.
+	TrustStorePath string
+	// LockPath, if set, is the lock of the Store shared with other builds
+	// that DepStoreTarPath and DepStoreExpandedPath belong to. It's held
+	// while ACIs are fetched and rendered into the store.
+	LockPath string
+	Insecure bool
+	Debug    bool
+	// Concurrency is the number of images downloaded at once. If it isn't
+	// set, DefaultConcurrency is used.
+	Concurrency int
+
+	// locked is whether the current call into the registry holds the
+	// store's lock
+	locked bool
+	// fetches coordinates the fetches of the current call into the
+	// registry, and fetchID is the id of the fetch whose dependencies are
+	// being fetched, if any
+	fetches *fetchGroup
+	fetchID string
 }
 
 // Read the ACI contents stream given the key. Use ResolveKey to
@@ -78,7 +98,7 @@ func (r Registry) ResolveKey(key string) (string, error) {
 	}
 	for _, file := range files {
 		if len(file.Name()) >= len(key) && key == file.Name()[:len(key)] {
-			return key, nil
+			return file.Name(), nil
 		}
 	}
 	return "", fmt.Errorf("key not found in registry")
@@ -100,31 +120,42 @@ func (r Registry) GetImageManifest(key string) (*schema.ImageManifest, error) {
 	return util.GetManifest(path.Join(r.DepStoreExpandedPath, key))
 }
 
-// Returns the key for the ACI with the given name and labels
+// Returns the key for the ACI with the given name and labels. Images are
+// looked up in the store's index, which is only rebuilt from the manifests in
+// the store if it's missing, corrupt, or refers to an image that's no longer
+// in the store. ErrNotFound is returned if no image matches.
 func (r Registry) GetACI(name types.ACIdentifier, labels types.Labels) (string, error) {
-	files, err := ioutil.ReadDir(r.DepStoreExpandedPath)
+	idx, err := r.readIndex()
 	if err != nil {
 		return "", err
 	}
-nextkey:
-	for _, file := range files {
-		man, err := util.GetManifest(path.Join(r.DepStoreExpandedPath, file.Name()))
+	if idx != nil {
+		key, ok := idx.lookup(name, labels)
+		if !ok {
+			return "", ErrNotFound
+		}
+		inStore, err := r.inStore(key)
 		if err != nil {
 			return "", err
 		}
-		if man.Name != name {
-			continue
-		}
-		for _, l := range labels {
-			val, ok := man.Labels.Get(l.Name.String())
-			if !ok {
-				continue
-			}
-			if val != l.Value {
-				continue nextkey
-			}
+		if inStore {
+			return key, nil
 		}
-		return file.Name(), nil
+	}
+
+	unlock, err := r.lockIndex()
+	if err != nil {
+		return "", err
+	}
+	idx, err = r.rebuildIndex()
+	if err1 := unlock(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return "", err
+	}
+	if key, ok := idx.lookup(name, labels); ok {
+		return key, nil
 	}
 	return "", ErrNotFound
 }
@@ -0,0 +1,334 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema/types"
+
+	"github.com/appc/acbuild/util"
+)
+
+const (
+	storeTarDir      = "tar"
+	storeExpandedDir = "expanded"
+
+	// storeLockFile is held exclusively while ACIs are added to a store
+	storeLockFile = "lock"
+	// storeUseLockFile is held shared by every build using a store, and
+	// exclusively while ACIs are removed from it
+	storeUseLockFile = "use.lock"
+)
+
+// Store is a store of ACIs shared between builds, so that every build doesn't
+// fetch and render the same dependencies again. It's laid out like a
+// Registry's stores, with ACIs kept under their image IDs, so a Registry can
+// be pointed at its TarPath and ExpandedPath. The time each ACI was last
+// fetched or used is recorded as its tarball's modification time, so that the
+// least recently used ACIs can be pruned.
+type Store struct {
+	Path string
+}
+
+// StoreEntry describes an ACI in a Store.
+type StoreEntry struct {
+	Key      string
+	Name     types.ACIdentifier
+	Labels   types.Labels
+	Size     int64
+	LastUsed time.Time
+}
+
+// PruneOptions selects the ACIs Prune removes from a Store. An ACI is removed
+// if any of the options select it.
+type PruneOptions struct {
+	// All selects every ACI.
+	All bool
+	// UnusedFor, if set, selects the ACIs that haven't been used for at
+	// least this long.
+	UnusedFor time.Duration
+	// MaxSize, if set, selects the least recently used ACIs until the
+	// size of the rest is at most MaxSize bytes.
+	MaxSize int64
+}
+
+// DefaultStorePath returns the path of the shared store in the user's cache
+// directory.
+func DefaultStorePath() string {
+	cacheDir := os.Getenv("XDG_CACHE_HOME")
+	if cacheDir == "" {
+		cacheDir = path.Join(os.Getenv("HOME"), ".cache")
+	}
+	return path.Join(cacheDir, "acbuild", "depstore")
+}
+
+// TarPath returns the directory the store's ACI tarballs are kept in.
+func (s Store) TarPath() string {
+	return path.Join(s.Path, storeTarDir)
+}
+
+// ExpandedPath returns the directory the store's ACIs are rendered in.
+func (s Store) ExpandedPath() string {
+	return path.Join(s.Path, storeExpandedDir)
+}
+
+// LockPath returns the path of the lock a Registry fetching ACIs into the
+// store must hold.
+func (s Store) LockPath() string {
+	return path.Join(s.Path, storeLockFile)
+}
+
+// Use marks the store as being used by a build, which keeps ACIs from being
+// removed from it until the returned function is called.
+func (s Store) Use() (func() error, error) {
+	err := os.MkdirAll(s.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	f, err := lockFile(path.Join(s.Path, storeUseLockFile), syscall.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	return f.Close, nil
+}
+
+// Entries returns the ACIs in the store, least recently used first.
+func (s Store) Entries() ([]StoreEntry, error) {
+	keys, err := readDirNames(s.TarPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []StoreEntry
+	for _, key := range keys {
+		if !strings.HasPrefix(key, hashPrefix) {
+			// A temporary file of a fetch
+			continue
+		}
+		man, err := util.GetManifest(path.Join(s.ExpandedPath(), key))
+		if os.IsNotExist(err) {
+			// An incomplete fetch, which GC removes
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		info, err := os.Stat(path.Join(s.TarPath(), key))
+		if err != nil {
+			return nil, err
+		}
+		expandedSize, err := dirSize(path.Join(s.ExpandedPath(), key))
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, StoreEntry{
+			Key:      key,
+			Name:     man.Name,
+			Labels:   man.Labels,
+			Size:     info.Size() + expandedSize,
+			LastUsed: info.ModTime(),
+		})
+	}
+
+	sort.Sort(byLastUsed(entries))
+	return entries, nil
+}
+
+// Prune removes the ACIs selected by opts from the store, and returns them.
+// It fails if a build is using the store.
+func (s Store) Prune(opts PruneOptions) ([]StoreEntry, error) {
+	unlock, err := s.lockExclusive()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	entries, err := s.Entries()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, entry := range entries {
+		total += entry.Size
+	}
+
+	now := time.Now()
+	var removed []StoreEntry
+	for _, entry := range entries {
+		remove := opts.All ||
+			(opts.UnusedFor != 0 && now.Sub(entry.LastUsed) >= opts.UnusedFor) ||
+			(opts.MaxSize != 0 && total > opts.MaxSize)
+		if !remove {
+			continue
+		}
+		err := s.remove(entry.Key)
+		if err != nil {
+			return removed, err
+		}
+		total -= entry.Size
+		removed = append(removed, entry)
+	}
+	return removed, nil
+}
+
+// GC removes what interrupted fetches left behind in the store: temporary
+// files, and ACIs missing either their tarball or their manifest. The paths of
+// the removed files are returned. It fails if a build is using the store.
+func (s Store) GC() ([]string, error) {
+	unlock, err := s.lockExclusive()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	var garbage []string
+	tarKeys, err := readDirNames(s.TarPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range tarKeys {
+		if strings.HasPrefix(key, hashPrefix) {
+			_, err := os.Stat(path.Join(s.ExpandedPath(), key, aci.ManifestFile))
+			if err == nil {
+				continue
+			}
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		garbage = append(garbage, path.Join(s.TarPath(), key))
+	}
+
+	expandedKeys, err := readDirNames(s.ExpandedPath())
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range expandedKeys {
+		if key == indexFile {
+			continue
+		}
+		_, err := os.Stat(path.Join(s.TarPath(), key))
+		if err == nil {
+			_, err = os.Stat(path.Join(s.ExpandedPath(), key, aci.ManifestFile))
+			if err == nil {
+				continue
+			}
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		garbage = append(garbage, path.Join(s.ExpandedPath(), key))
+	}
+
+	for i, p := range garbage {
+		err := os.RemoveAll(p)
+		if err != nil {
+			return garbage[:i], err
+		}
+	}
+	return garbage, nil
+}
+
+// lockExclusive takes both of the store's locks, failing if a build is using
+// the store.
+func (s Store) lockExclusive() (func() error, error) {
+	err := os.MkdirAll(s.Path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	useLock, err := lockFile(path.Join(s.Path, storeUseLockFile), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return nil, fmt.Errorf("the store at %s is being used by a build", s.Path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	lock, err := lockFile(s.LockPath(), syscall.LOCK_EX)
+	if err != nil {
+		useLock.Close()
+		return nil, err
+	}
+	return func() error {
+		err := lock.Close()
+		if err1 := useLock.Close(); err == nil {
+			err = err1
+		}
+		return err
+	}, nil
+}
+
+// remove removes the ACI with the given key from the store and its index. The
+// locks taken by lockExclusive must be held.
+func (s Store) remove(key string) error {
+	err := os.RemoveAll(path.Join(s.ExpandedPath(), key))
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path.Join(s.TarPath(), key))
+	if err != nil {
+		return err
+	}
+	r := Registry{
+		DepStoreExpandedPath: s.ExpandedPath(),
+		LockPath:             s.LockPath(),
+		locked:               true,
+	}
+	return r.removeFromIndex(key)
+}
+
+// lockFile opens the file at p, creating it if needed, and flocks it with the
+// given operation. The lock is released by closing the file.
+func lockFile(p string, how int) (*os.File, error) {
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), how)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+type byLastUsed []StoreEntry
+
+func (e byLastUsed) Len() int           { return len(e) }
+func (e byLastUsed) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e byLastUsed) Less(i, j int) bool { return e[i].LastUsed.Before(e[j].LastUsed) }
@@ -0,0 +1,274 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/appc/spec/schema/types"
+)
+
+const (
+	rootKeysDir   = "root.d"
+	prefixKeysDir = "prefix.d"
+)
+
+// TrustStore is an appc style store of trusted public keys, laid out like
+// rkt's. Keys trusted for every image are stored in root.d, and keys trusted
+// for the images whose names start with a given prefix are stored in
+// prefix.d/<escaped prefix>. Each key is an ASCII armored file named after its
+// fingerprint.
+type TrustStore struct {
+	Path string
+}
+
+// TrustedKey describes a key in a TrustStore. Prefix is empty for keys that
+// are trusted for every image.
+type TrustedKey struct {
+	Prefix      string
+	Fingerprint string
+}
+
+// DefaultTrustStorePath returns the path of the trust store in the user's
+// configuration directory.
+func DefaultTrustStorePath() string {
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = path.Join(os.Getenv("HOME"), ".config")
+	}
+	return path.Join(configDir, "acbuild", "trustedkeys")
+}
+
+// AddKey stores the ASCII armored public key read from keyPath in the trust
+// store, trusting it for images whose names start with prefix, or for every
+// image if prefix is empty. The key's fingerprint is returned.
+func (ts TrustStore) AddKey(prefix, keyPath string) (string, error) {
+	if prefix != "" {
+		if _, err := types.NewACIdentifier(prefix); err != nil {
+			return "", fmt.Errorf("invalid prefix %q: %v", prefix, err)
+		}
+	}
+
+	fingerprints, err := gpgFingerprints(keyPath)
+	if err != nil {
+		return "", err
+	}
+	if len(fingerprints) != 1 {
+		return "", fmt.Errorf("expected exactly one public key in %s, found %d", keyPath, len(fingerprints))
+	}
+
+	key, err := ioutil.ReadFile(keyPath)
+	if err != nil {
+		return "", err
+	}
+
+	dir := ts.keyDir(prefix)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	err = ioutil.WriteFile(path.Join(dir, fingerprints[0]), key, 0644)
+	if err != nil {
+		return "", err
+	}
+	return fingerprints[0], nil
+}
+
+// RemoveKey removes the key with the given fingerprint from the trust store,
+// for every prefix it is trusted for.
+func (ts TrustStore) RemoveKey(fingerprint string) error {
+	keys, err := ts.Keys()
+	if err != nil {
+		return err
+	}
+	found := false
+	for _, key := range keys {
+		if key.Fingerprint != strings.ToUpper(fingerprint) {
+			continue
+		}
+		err := os.Remove(path.Join(ts.keyDir(key.Prefix), key.Fingerprint))
+		if err != nil {
+			return err
+		}
+		found = true
+	}
+	if !found {
+		return fmt.Errorf("no key with fingerprint %s in the trust store", fingerprint)
+	}
+	return nil
+}
+
+// Keys returns all of the keys in the trust store.
+func (ts TrustStore) Keys() ([]TrustedKey, error) {
+	var keys []TrustedKey
+
+	rootKeys, err := readDirNames(path.Join(ts.Path, rootKeysDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, fingerprint := range rootKeys {
+		keys = append(keys, TrustedKey{Fingerprint: fingerprint})
+	}
+
+	prefixes, err := readDirNames(path.Join(ts.Path, prefixKeysDir))
+	if err != nil {
+		return nil, err
+	}
+	for _, escapedPrefix := range prefixes {
+		prefixKeys, err := readDirNames(path.Join(ts.Path, prefixKeysDir, escapedPrefix))
+		if err != nil {
+			return nil, err
+		}
+		for _, fingerprint := range prefixKeys {
+			keys = append(keys, TrustedKey{
+				Prefix:      strings.Replace(escapedPrefix, ",", "/", -1),
+				Fingerprint: fingerprint,
+			})
+		}
+	}
+	return keys, nil
+}
+
+// Verify checks that ascPath holds a valid detached signature of the ACI at
+// aciPath, made with a key trusted for images with the given name.
+func (ts TrustStore) Verify(name types.ACIdentifier, aciPath, ascPath string) error {
+	keyPaths, err := ts.keysForImage(name)
+	if err != nil {
+		return err
+	}
+	if len(keyPaths) == 0 {
+		return fmt.Errorf("no keys in the trust store at %s are trusted for %s, add one with \"acbuild trust\"", ts.Path, name)
+	}
+
+	homedir, err := ioutil.TempDir("", "acbuild-gpg")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(homedir)
+
+	_, err = runGPG(homedir, append([]string{"--import"}, keyPaths...)...)
+	if err != nil {
+		return err
+	}
+	_, err = runGPG(homedir, "--verify", ascPath, aciPath)
+	if err != nil {
+		return fmt.Errorf("signature verification for %s failed: %v", name, err)
+	}
+	return nil
+}
+
+// keysForImage returns the paths of all of the keys trusted for images with
+// the given name: the root keys, and the keys of every prefix of the name.
+func (ts TrustStore) keysForImage(name types.ACIdentifier) ([]string, error) {
+	dirs := []string{ts.keyDir("")}
+	parts := strings.Split(string(name), "/")
+	for i := range parts {
+		dirs = append(dirs, ts.keyDir(strings.Join(parts[:i+1], "/")))
+	}
+
+	var keyPaths []string
+	for _, dir := range dirs {
+		keys, err := readDirNames(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range keys {
+			keyPaths = append(keyPaths, path.Join(dir, key))
+		}
+	}
+	return keyPaths, nil
+}
+
+func (ts TrustStore) keyDir(prefix string) string {
+	if prefix == "" {
+		return path.Join(ts.Path, rootKeysDir)
+	}
+	return path.Join(ts.Path, prefixKeysDir, strings.Replace(prefix, "/", ",", -1))
+}
+
+// readDirNames returns the names of the entries in dir, or nothing if it
+// doesn't exist.
+func readDirNames(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	switch {
+	case os.IsNotExist(err):
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	var names []string
+	for _, file := range files {
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
+
+// gpgFingerprints returns the fingerprints of the public keys in the file at
+// keyPath.
+func gpgFingerprints(keyPath string) ([]string, error) {
+	homedir, err := ioutil.TempDir("", "acbuild-gpg")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(homedir)
+
+	_, err = runGPG(homedir, "--import", keyPath)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runGPG(homedir, "--with-colons", "--fingerprint", "--list-keys")
+	if err != nil {
+		return nil, err
+	}
+
+	// Every public key is listed as a pub line, followed by the fpr line
+	// holding its fingerprint in the tenth field
+	var fingerprints []string
+	lines := strings.Split(string(output), "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "pub:") || i+1 == len(lines) {
+			continue
+		}
+		fields := strings.Split(lines[i+1], ":")
+		if fields[0] == "fpr" && len(fields) > 9 {
+			fingerprints = append(fingerprints, fields[9])
+		}
+	}
+	return fingerprints, nil
+}
+
+// runGPG runs gpg with the given arguments, using the keyring in homedir
+// instead of the user's own.
+func runGPG(homedir string, args ...string) ([]byte, error) {
+	args = append([]string{"--batch", "--homedir", homedir}, args...)
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("gpg", args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+		return nil, fmt.Errorf("gpg is required but not found")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
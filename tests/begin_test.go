@@ -15,10 +15,16 @@
 package tests
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
 	"io/ioutil"
 	"os"
+	"path"
 	"testing"
 	"time"
+
+	"github.com/appc/spec/schema/types"
 )
 
 func TestBeginEmpty(t *testing.T) {
@@ -84,3 +90,193 @@ func TestBeginLocalDirectory(t *testing.T) {
 	checkManifest(t, workingDir, emptyManifest())
 	testMatchingFSTree(t, workingDir, sourceDir, "/")
 }
+
+type tarEntry struct {
+	name     string
+	contents string
+}
+
+// mustTar returns a tarball holding the given entries. Entries whose names end
+// in a slash are directories.
+func mustTar(entries ...tarEntry) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		hdr := &tar.Header{
+			Name:     entry.name,
+			Mode:     0644,
+			Size:     int64(len(entry.contents)),
+			Typeflag: tar.TypeReg,
+		}
+		if entry.name[len(entry.name)-1] == '/' {
+			hdr.Mode, hdr.Typeflag = 0755, tar.TypeDir
+		}
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			panic(err)
+		}
+		_, err = tw.Write([]byte(entry.contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestBeginDockerArchive(t *testing.T) {
+	config, err := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"config": map[string]interface{}{
+			"Entrypoint":   []string{"/bin/app"},
+			"Cmd":          []string{"--serve"},
+			"Env":          []string{"FOO=bar"},
+			"User":         "1000:100",
+			"WorkingDir":   "/srv",
+			"ExposedPorts": map[string]struct{}{"80/tcp": {}},
+			"Labels":       map[string]string{"maintainer": "the acbuild devs"},
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	manifest, err := json.Marshal([]map[string]interface{}{{
+		"Config":   "config.json",
+		"RepoTags": []string{"example.com/app:1.0"},
+		"Layers":   []string{"layer1/layer.tar", "layer2/layer.tar"},
+	}})
+	if err != nil {
+		panic(err)
+	}
+
+	archive := mustTar(
+		tarEntry{"manifest.json", string(manifest)},
+		tarEntry{"config.json", string(config)},
+		tarEntry{"layer1/", ""},
+		tarEntry{"layer1/layer.tar", string(mustTar(
+			tarEntry{"etc/", ""},
+			tarEntry{"etc/deleted", "deleted"},
+			tarEntry{"etc/kept", "kept"},
+			tarEntry{"opaque/", ""},
+			tarEntry{"opaque/hidden", "hidden"},
+		))},
+		tarEntry{"layer2/", ""},
+		tarEntry{"layer2/layer.tar", string(mustTar(
+			tarEntry{"etc/.wh.deleted", ""},
+			tarEntry{"opaque/", ""},
+			tarEntry{"opaque/.wh..wh..opq", ""},
+			tarEntry{"opaque/new", "new"},
+		))},
+	)
+	archiveFile := mustTempFile()
+	defer os.Remove(archiveFile.Name())
+	_, err = archiveFile.Write(archive)
+	if err != nil {
+		panic(err)
+	}
+	archiveFile.Close()
+
+	workingDir := mustTempDir()
+	defer cleanUpTest(workingDir)
+
+	err = runACBuildNoHist(workingDir, "begin", "docker-archive:"+archiveFile.Name()+":example.com/app:1.0")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	wantedManifest := emptyManifest()
+	wantedManifest.Annotations = types.Annotations{
+		types.Annotation{
+			Name:  *types.MustACIdentifier("maintainer"),
+			Value: "the acbuild devs",
+		},
+	}
+	wantedManifest.App = &types.App{
+		Exec:             types.Exec{"/bin/app", "--serve"},
+		User:             "1000",
+		Group:            "100",
+		WorkingDirectory: "/srv",
+		Environment: types.Environment{
+			types.EnvironmentVariable{Name: "FOO", Value: "bar"},
+		},
+		Ports: []types.Port{
+			types.Port{
+				Name:     *types.MustACName("tcp-80"),
+				Protocol: "tcp",
+				Port:     80,
+				Count:    1,
+			},
+		},
+	}
+	checkManifest(t, workingDir, wantedManifest)
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", "rootfs")
+	for _, p := range []string{"etc/kept", "opaque/new"} {
+		if _, err := os.Stat(path.Join(rootfs, p)); err != nil {
+			t.Errorf("%s is missing: %v", p, err)
+		}
+	}
+	for _, p := range []string{"etc/deleted", "etc/.wh.deleted", "opaque/hidden", "opaque/.wh..wh..opq"} {
+		if _, err := os.Lstat(path.Join(rootfs, p)); !os.IsNotExist(err) {
+			t.Errorf("%s exists when it should have been deleted", p)
+		}
+	}
+}
+
+func TestBeginOCILayout(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	for _, args := range [][]string{
+		{"set-name", "example.com/app"},
+		{"set-exec", "/bin/app"},
+		{"environment", "add", "FOO", "bar"},
+	} {
+		err := runACBuildNoHist(workingDir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	err := ioutil.WriteFile(path.Join(workingDir, ".acbuild", "currentaci", "rootfs", "file"), []byte("contents"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	for _, output := range []string{"image", "image.tar"} {
+		err = runACBuildNoHist(workingDir, "write", "--format=oci", path.Join(workingDir, output))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for _, output := range []string{"image", "image.tar:latest"} {
+		newWorkingDir := mustTempDir()
+		defer cleanUpTest(newWorkingDir)
+
+		err = runACBuildNoHist(newWorkingDir, "begin", "oci-layout:"+path.Join(workingDir, output))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		wantedManifest := emptyManifest()
+		wantedManifest.App = &types.App{
+			Exec:  types.Exec{"/bin/app"},
+			User:  "0",
+			Group: "0",
+			Environment: types.Environment{
+				types.EnvironmentVariable{Name: "FOO", Value: "bar"},
+			},
+		}
+		checkManifest(t, newWorkingDir, wantedManifest)
+
+		contents, err := ioutil.ReadFile(path.Join(newWorkingDir, ".acbuild", "currentaci", "rootfs", "file"))
+		if err != nil {
+			t.Errorf("%v", err)
+		} else if string(contents) != "contents" {
+			t.Errorf("unexpected file contents: %q", contents)
+		}
+	}
+}
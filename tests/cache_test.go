@@ -0,0 +1,173 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+)
+
+// mustAddToStore adds a fake ACI with the given name to the shared store at
+// storePath under key, last used at the given time.
+func mustAddToStore(storePath, key, name string, lastUsed time.Time) {
+	man := emptyManifest()
+	man.Name = *types.MustACIdentifier(name)
+	mustAddManifestToStore(storePath, key, man, lastUsed)
+}
+
+// mustAddManifestToStore is like mustAddToStore, for a fake ACI with the given
+// manifest.
+func mustAddManifestToStore(storePath, key string, man schema.ImageManifest, lastUsed time.Time) {
+	manblob, err := json.Marshal(man)
+	if err != nil {
+		panic(err)
+	}
+	expanded := path.Join(storePath, "expanded", key)
+	err = os.MkdirAll(path.Join(expanded, aci.RootfsDir), 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(expanded, aci.ManifestFile), manblob, 0644)
+	if err != nil {
+		panic(err)
+	}
+	tarPath := path.Join(storePath, "tar", key)
+	err = os.MkdirAll(path.Dir(tarPath), 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(tarPath, []byte("not really a tarball"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Chtimes(tarPath, lastUsed, lastUsed)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestCache(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+	os.Setenv("XDG_CACHE_HOME", tmpdir)
+
+	storePath := path.Join(tmpdir, "acbuild", "depstore")
+	oldKey := "sha512-" + strings.Repeat("1", 64)
+	newKey := "sha512-" + strings.Repeat("2", 64)
+	mustAddToStore(storePath, oldKey, "example.com/old", time.Now().Add(-48*time.Hour))
+	mustAddToStore(storePath, newKey, "example.com/new", time.Now())
+
+	// Leftovers of interrupted fetches
+	garbage := []string{
+		path.Join(storePath, "tar", "tmp.aci"),
+		path.Join(storePath, "expanded", "sha512-"+strings.Repeat("3", 64)),
+	}
+	for _, p := range garbage {
+		err := ioutil.WriteFile(p, nil, 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	_, stdout, _, err := runACBuild(tmpdir, "cache", "ls")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	oldLine := strings.Index(stdout, "example.com/old")
+	newLine := strings.Index(stdout, "example.com/new")
+	if oldLine == -1 || newLine == -1 || oldLine > newLine {
+		t.Errorf("unexpected output from cache ls: %s", stdout)
+	}
+
+	_, stdout, _, err = runACBuild(tmpdir, "cache", "gc")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, p := range garbage {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s wasn't removed by cache gc", p)
+		}
+		if !strings.Contains(stdout, p) {
+			t.Errorf("%s missing from the output of cache gc: %s", p, stdout)
+		}
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "cache", "prune")
+	if err == nil {
+		t.Errorf("cache prune succeeded without any criteria")
+	} else if !strings.Contains(stderr, "must be given") {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+
+	// Pruning fails while a build is using the store
+	useLock, err := os.OpenFile(path.Join(storePath, "use.lock"), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = syscall.Flock(int(useLock.Fd()), syscall.LOCK_SH)
+	if err != nil {
+		panic(err)
+	}
+	_, _, stderr, err = runACBuild(tmpdir, "cache", "prune", "--all")
+	useLock.Close()
+	if err == nil {
+		t.Errorf("cache prune succeeded while the store was in use")
+	} else if !strings.Contains(stderr, "being used by a build") {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+
+	_, stdout, _, err = runACBuild(tmpdir, "cache", "prune", "--unused-for", "24h")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(stdout, "example.com/old") || strings.Contains(stdout, "example.com/new") {
+		t.Errorf("unexpected output from cache prune: %s", stdout)
+	}
+	if _, err := os.Stat(path.Join(storePath, "tar", oldKey)); !os.IsNotExist(err) {
+		t.Errorf("unused image wasn't pruned")
+	}
+	if _, err := os.Stat(path.Join(storePath, "expanded", newKey)); err != nil {
+		t.Errorf("recently used image was pruned: %v", err)
+	}
+
+	_, stdout, _, err = runACBuild(tmpdir, "cache", "prune", "--max-size", "1K")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stdout != "" {
+		t.Errorf("image was pruned though the store is small enough: %s", stdout)
+	}
+
+	_, stdout, _, err = runACBuild(tmpdir, "cache", "prune", "--max-size", "1")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(stdout, "example.com/new") {
+		t.Errorf("image wasn't pruned to fit in the maximum size: %s", stdout)
+	}
+}
@@ -139,9 +139,18 @@ func runACBuildNoHist(workingDir string, args ...string) error {
 // acbuild, and returns it's exit code, what it printed to stdout, what it
 // printed to stderr, and an error in the event of a non-0 exit code.
 func runACBuild(workingDir string, args ...string) (int, string, string, error) {
+	return runACBuildAs(nil, workingDir, args...)
+}
+
+// runACBuildAs is like runACBuild, running acbuild with the given credential
+// if it isn't nil.
+func runACBuildAs(cred *syscall.Credential, workingDir string, args ...string) (int, string, string, error) {
 	var stdout, stderr bytes.Buffer
 	cmd := exec.Command(acbuildBinPath, args...)
 	cmd.Dir, cmd.Stdout, cmd.Stderr = workingDir, &stdout, &stderr
+	if cred != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: cred}
+	}
 	err := cmd.Run()
 	if exitErr, ok := err.(*exec.ExitError); ok {
 		code := exitErr.Sys().(syscall.WaitStatus).ExitStatus()
@@ -240,7 +249,12 @@ func makeACI(output io.Writer, manifest schema.ImageManifest, files ...fileInfo)
 	}
 
 	for _, f := range files {
-		err := ioutil.WriteFile(path.Join(tmpexpandedaci, aci.RootfsDir, f.name), f.contents, 0644)
+		filePath := path.Join(tmpexpandedaci, aci.RootfsDir, f.name)
+		err := os.MkdirAll(path.Dir(filePath), 0755)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(filePath, f.contents, 0644)
 		if err != nil {
 			return err
 		}
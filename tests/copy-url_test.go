@@ -0,0 +1,158 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/appc/spec/aci"
+)
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func mustTarGz(files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, contents := range files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(contents)),
+			Typeflag: tar.TypeReg,
+		})
+		if err != nil {
+			panic(err)
+		}
+		_, err = tw.Write([]byte(contents))
+		if err != nil {
+			panic(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		panic(err)
+	}
+	if err := gw.Close(); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+func TestCopyURL(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	binary := []byte("#!/bin/sh\necho hello\n")
+	tarball := mustTarGz(map[string]string{"app-1.0/README": "read me"})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/releases/app":
+			w.Write(binary)
+		case "/releases/app.tar.gz":
+			w.Write(tarball)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir)
+
+	err := runACBuildNoHist(workingDir, "copy-url", "--sha256", sha256Hex(binary), "--chmod", "0755", server.URL+"/releases/app", "/usr/bin/app")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	info, err := os.Stat(path.Join(rootfs, "usr/bin/app"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if info.Mode().Perm() != 0755 {
+		t.Errorf("unexpected mode: %v", info.Mode())
+	}
+
+	// A directory as the destination keeps the name from the URL
+	err = runACBuildNoHist(workingDir, "copy-url", "--sha256", strings.ToUpper(sha256Hex(binary)), server.URL+"/releases/app", "/srv/")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	contents, err := ioutil.ReadFile(path.Join(rootfs, "srv/app"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !bytes.Equal(contents, binary) {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+
+	err = runACBuildNoHist(workingDir, "copy-url", "--sha256", sha256Hex(tarball), "--extract", server.URL+"/releases/app.tar.gz", "/opt")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	contents, err = ioutil.ReadFile(path.Join(rootfs, "opt/app-1.0/README"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if string(contents) != "read me" {
+		t.Errorf("unexpected contents: %q", contents)
+	}
+}
+
+func TestCopyURLBadDigest(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("tampered"))
+	}))
+	defer server.Close()
+
+	digest := sha256Hex([]byte("original"))
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "copy-url", "--sha256", digest, server.URL+"/app", "/app")
+	if err == nil {
+		t.Fatalf("download with the wrong digest succeeded")
+	}
+	if !strings.Contains(stderr, "expected "+digest) {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+	_, err = os.Lstat(path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir, "app"))
+	if !os.IsNotExist(err) {
+		t.Errorf("file with the wrong digest was written to the ACI")
+	}
+
+	_, _, stderr, err = runACBuild(workingDir, "--no-history", "copy-url", "--sha256", digest, server.URL+"/missing", "/app")
+	if err == nil {
+		t.Fatalf("download of a missing file succeeded")
+	}
+	if !strings.Contains(stderr, "bad HTTP status code: 404") {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+}
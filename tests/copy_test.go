@@ -21,10 +21,14 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema/types"
+	"github.com/kylelemons/godebug/pretty"
 
 	"github.com/appc/acbuild/util/fsdiffer"
 )
@@ -276,3 +280,365 @@ func testMatchingFSTree(t *testing.T, workingDir, source, dest string) {
 		t.Fatalf("Got %d changes, expected 0\n%s", len(changes), changestring)
 	}
 }
+
+func TestCopyFrom(t *testing.T) {
+	builderDir := setUpTest(t)
+	defer cleanUpTest(builderDir)
+
+	sourceDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(sourceDir)
+
+	// ACIs only store modification times to the second
+	time1 := time.Now().Truncate(time.Second)
+	files := []*buildFileInfo{
+		mkBuildFileInfoFile("file01", time1),
+		mkBuildFileInfoDir("dir01", time1),
+		mkBuildFileInfoFile("dir01/file01", time1),
+	}
+	mustBuildFS(sourceDir, files)
+
+	err = runACBuildNoHist(builderDir, "copy", sourceDir, "/src")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = os.Symlink("src", path.Join(builderDir, ".acbuild", "currentaci", aci.RootfsDir, "link"))
+	if err != nil {
+		panic(err)
+	}
+	err = runACBuildNoHist(builderDir, "set-name", "example.com/builder")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	builderACI := path.Join(builderDir, "builder.aci")
+	err = runACBuildNoHist(builderDir, "write", builderACI)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	for _, from := range []string{builderACI, builderDir} {
+		workingDir := setUpTest(t)
+		defer cleanUpTest(workingDir)
+
+		err = runACBuildNoHist(workingDir, "copy", "--from", from, "/src", dest)
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		testMatchingFSTree(t, workingDir, sourceDir, dest)
+
+		// Files behind symlinks are found in the source image's rootfs
+		err = runACBuildNoHist(workingDir, "copy-to-dir", "--from", from, "/link/dir01", "/link/file01", "/other")
+		if err != nil {
+			t.Fatalf("%v\n", err)
+		}
+		testMatchingFSTree(t, workingDir, sourceDir, "/other")
+
+		_, _, stderr, err := runACBuild(workingDir, "--no-history", "copy", "--from", from, "/missing", "/missing")
+		if err == nil {
+			t.Errorf("copying a missing file from %s succeeded", from)
+		} else if stderr != fmt.Sprintf("copy: /missing doesn't exist in %s\n", from) {
+			t.Errorf("unexpected stderr: %s", stderr)
+		}
+	}
+}
+
+func TestCopyFromLayers(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	// /dir is spread over the two layers of example.com/app, and the
+	// files of example.com/base outside its path whitelist are left out
+	baseman := emptyManifest()
+	baseman.Name = *types.MustACIdentifier("example.com/base")
+	mustAddToDepStore(workingDir, baseman,
+		fileInfo{name: "dir/base", contents: []byte("base")},
+		fileInfo{name: "dir/shared", contents: []byte("base")},
+		fileInfo{name: "dir/sub/base", contents: []byte("base")},
+		fileInfo{name: "dir/notlisted", contents: []byte("base")})
+	appman := emptyManifest()
+	appman.Name = *types.MustACIdentifier("example.com/app")
+	appman.Dependencies = types.Dependencies{{ImageName: baseman.Name}}
+	appman.PathWhitelist = []string{"/dir/base", "/dir/shared", "/dir/sub/base", "/dir/sub/app", "/dir/app"}
+	mustAddToDepStore(workingDir, appman,
+		fileInfo{name: "dir/app", contents: []byte("app")},
+		fileInfo{name: "dir/shared", contents: []byte("app")},
+		fileInfo{name: "dir/sub/app", contents: []byte("app")})
+
+	err := runACBuildNoHist(workingDir, "copy", "--from", "example.com/app", "/dir", "/copied")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	copied := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir, "copied")
+	files := make(map[string]string)
+	err = filepath.Walk(copied, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		contents, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(copied, p)
+		if err != nil {
+			return err
+		}
+		files[rel] = string(contents)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	expected := map[string]string{
+		"app":      "app",
+		"base":     "base",
+		"shared":   "app",
+		"sub/app":  "app",
+		"sub/base": "base",
+	}
+	if diff := pretty.Compare(files, expected); diff != "" {
+		t.Errorf("unexpected files copied:\n%s", diff)
+	}
+}
+
+func TestCopyChownChmod(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir)
+	err := os.MkdirAll(path.Join(rootfs, "etc"), 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(rootfs, "etc", "passwd"), []byte("app:x:1000:1000::/home/app:/bin/sh\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(rootfs, "etc", "group"), []byte("staff:x:50:app\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	sourceDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(sourceDir)
+	mustBuildFS(sourceDir, []*buildFileInfo{
+		mkBuildFileInfoDir("dir01", time.Now()),
+		mkBuildFileInfoFile("dir01/file01", time.Now()),
+	})
+
+	err = os.Chmod(sourceDir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	err = runACBuildNoHist(workingDir, "copy", "--chown", "app:staff", "--chmod", "0700", sourceDir, dest)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	// Directories keep their own mode
+	for p, mode := range map[string]os.FileMode{
+		".":            0755,
+		"dir01":        0755,
+		"dir01/file01": 0700,
+	} {
+		info, err := os.Lstat(path.Join(rootfs, dest, p))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		stat := info.Sys().(*syscall.Stat_t)
+		if stat.Uid != 1000 || stat.Gid != 50 {
+			t.Errorf("%s is owned by %d:%d, expected 1000:50", p, stat.Uid, stat.Gid)
+		}
+		if info.Mode().Perm() != mode {
+			t.Errorf("%s has mode %o, expected %o", p, info.Mode().Perm(), mode)
+		}
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "copy", "--chown", "nobody", sourceDir, "/other")
+	if err == nil {
+		t.Errorf("copy with an unknown user succeeded")
+	} else if stderr != "copy: \"nobody\" user not found\n" {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+}
+
+func TestCopyChmodSpecialBits(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	source := mustTempFile()
+	defer os.Remove(source.Name())
+	source.Close()
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir)
+	for _, tt := range []struct {
+		chmod string
+		mode  os.FileMode
+	}{
+		{"4755", os.ModeSetuid | 0755},
+		{"2755", os.ModeSetgid | 0755},
+		{"1777", os.ModeSticky | 0777},
+	} {
+		target := "/file-" + tt.chmod
+		err := runACBuildNoHist(workingDir, "copy", "--chmod", tt.chmod, source.Name(), target)
+		if err != nil {
+			t.Fatalf("--chmod %s: %v", tt.chmod, err)
+		}
+		info, err := os.Lstat(path.Join(rootfs, target))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if info.Mode() != tt.mode {
+			t.Errorf("--chmod %s gave mode %v, expected %v", tt.chmod, info.Mode(), tt.mode)
+		}
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "copy", "--chmod", "17777", source.Name(), "/other")
+	if err == nil {
+		t.Errorf("copy with an invalid mode succeeded")
+	} else if stderr != "copy: invalid mode \"17777\"\n" {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+}
+
+func TestCopyGlobExclude(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	sourceDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(sourceDir)
+
+	time1 := time.Now()
+	mustBuildFS(sourceDir, []*buildFileInfo{
+		mkBuildFileInfoFile("main.go", time1),
+		mkBuildFileInfoFile("main_test.go", time1),
+		mkBuildFileInfoFile("README", time1),
+		mkBuildFileInfoDir("pkg", time1),
+		mkBuildFileInfoFile("pkg/lib.go", time1),
+		mkBuildFileInfoFile("pkg/lib_test.go", time1),
+		mkBuildFileInfoDir("pkg/testdata", time1),
+		mkBuildFileInfoFile("pkg/testdata/input", time1),
+	})
+
+	err = runACBuildNoHist(workingDir, "copy-to-dir", "--exclude", "*_test.go", "--exclude", "pkg/testdata", path.Join(sourceDir, "*.go"), path.Join(sourceDir, "pkg"), dest)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	expectedDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(expectedDir)
+	mustBuildFS(expectedDir, []*buildFileInfo{
+		mkBuildFileInfoFile("main.go", time1),
+		mkBuildFileInfoDir("pkg", time1),
+		mkBuildFileInfoFile("pkg/lib.go", time1),
+	})
+	testMatchingFSTree(t, workingDir, expectedDir, dest)
+
+	// Files named explicitly are excluded too
+	err = runACBuildNoHist(workingDir, "copy-to-dir", "--exclude", "README", path.Join(sourceDir, "README"), path.Join(sourceDir, "main.go"), "/explicit")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", "rootfs")
+	if _, err := os.Lstat(path.Join(rootfs, "explicit", "README")); !os.IsNotExist(err) {
+		t.Errorf("excluded file was copied: %v", err)
+	}
+	if _, err := os.Lstat(path.Join(rootfs, "explicit", "main.go")); err != nil {
+		t.Errorf("file wasn't copied: %v", err)
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "copy", path.Join(sourceDir, "*.go"), "/main.go")
+	if err == nil {
+		t.Errorf("copy of a pattern matching two files succeeded")
+	} else if !strings.Contains(stderr, "matches 2 files") {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+}
+
+func TestCopyIgnoreFile(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	sourceDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(sourceDir)
+
+	time1 := time.Now().Truncate(time.Second)
+	ignoreFile := mkBuildFileInfoFile(".acbuildignore", time1)
+	ignoreFile.contents = "# Not needed in the image\n.acbuildignore\n**/*.log\ndocs\n!docs/README\n"
+	mustBuildFS(sourceDir, []*buildFileInfo{
+		ignoreFile,
+		mkBuildFileInfoFile("main.go", time1),
+		mkBuildFileInfoFile("build.log", time1),
+		mkBuildFileInfoDir("pkg", time1),
+		mkBuildFileInfoFile("pkg/lib.go", time1),
+		mkBuildFileInfoFile("pkg/test.log", time1),
+		mkBuildFileInfoDir("pkg/.acbuild", time1),
+		mkBuildFileInfoFile("pkg/.acbuild/lock", time1),
+		mkBuildFileInfoDir("docs", time1),
+		mkBuildFileInfoFile("docs/README", time1),
+		mkBuildFileInfoFile("docs/design.md", time1),
+		mkBuildFileInfoDir(".acbuild", time1),
+		mkBuildFileInfoFile(".acbuild/lock", time1),
+	})
+
+	err = runACBuildNoHist(workingDir, "copy", sourceDir, dest)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	expectedDir, err := ioutil.TempDir("", "acbuild-test-copy")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(expectedDir)
+	mustBuildFS(expectedDir, []*buildFileInfo{
+		mkBuildFileInfoFile("main.go", time1),
+		mkBuildFileInfoDir("pkg", time1),
+		mkBuildFileInfoFile("pkg/lib.go", time1),
+		mkBuildFileInfoDir("docs", time1),
+		mkBuildFileInfoFile("docs/README", time1),
+	})
+	testMatchingFSTree(t, workingDir, expectedDir, dest)
+
+	// --ignore-file replaces the directory's .acbuildignore
+	otherIgnoreFile := path.Join(workingDir, "ignore")
+	err = ioutil.WriteFile(otherIgnoreFile, []byte("pkg/\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = runACBuildNoHist(workingDir, "copy-to-dir", "--ignore-file", otherIgnoreFile, sourceDir, "/other")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	copied := path.Join(workingDir, ".acbuild", "currentaci", aci.RootfsDir, "other", filepath.Base(sourceDir))
+	for p, shouldExist := range map[string]bool{
+		"pkg":            false,
+		"build.log":      true,
+		"docs/design.md": true,
+		".acbuildignore": true,
+		".acbuild":       false,
+	} {
+		_, err := os.Lstat(path.Join(copied, p))
+		if exists := err == nil; exists != shouldExist {
+			t.Errorf("%s: exists is %v, expected %v", p, exists, shouldExist)
+		}
+	}
+}
@@ -15,8 +15,13 @@
 package tests
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/appc/spec/schema"
 	"github.com/appc/spec/schema/types"
@@ -287,3 +292,188 @@ func TestRmNonexistentDependency(t *testing.T) {
 	checkManifest(t, workingDir, emptyManifest())
 	checkEmptyRootfs(t, workingDir)
 }
+
+func TestLockDependencies(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+	os.Setenv("XDG_CACHE_HOME", workingDir)
+
+	storePath := path.Join(workingDir, "acbuild", "depstore")
+	key := "sha512-" + strings.Repeat("4", 128)
+	mustAddToStore(storePath, key, depName, time.Now())
+	err := ioutil.WriteFile(path.Join(storePath, "expanded", key, "size"), []byte(strconv.Itoa(int(depSize))), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	err = runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	err = runACBuildNoHist(workingDir, "dependency", "add", depName2, "--image-id", depImageID)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(workingDir, "--no-history", "--shared-store", "dependency", "lock")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	expected := "Locked " + depName + " to " + key[:len("sha512-")+12] + "\n" +
+		depName2 + " is already locked to " + depImageID + "\n"
+	if stdout != expected {
+		t.Errorf("unexpected output from dependency lock:\n%s", stdout)
+	}
+
+	deps := types.Dependencies{
+		types.Dependency{
+			ImageName: *types.MustACIdentifier(depName),
+			ImageID:   mustHash(key),
+			Size:      depSize,
+		},
+		types.Dependency{
+			ImageName: *types.MustACIdentifier(depName2),
+			ImageID:   mustHash(depImageID),
+		},
+	}
+
+	checkManifest(t, workingDir, manWithDeps(deps))
+	checkEmptyRootfs(t, workingDir)
+}
+
+func mustHash(s string) *types.Hash {
+	hash, err := types.NewHash(s)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// mustAddDepsToStore adds fake ACIs with the given names to the shared store
+// at storePath, each depending on the images with the names it maps to. The
+// keys of the images are returned.
+func mustAddDepsToStore(storePath string, names []string, deps map[string][]string) map[string]string {
+	keys := make(map[string]string)
+	for i, name := range names {
+		keys[name] = "sha512-" + strings.Repeat(strconv.Itoa(5+i), 128)
+	}
+	for _, name := range names {
+		man := emptyManifest()
+		man.Name = *types.MustACIdentifier(name)
+		for _, dep := range deps[name] {
+			man.Dependencies = append(man.Dependencies, types.Dependency{
+				ImageName: *types.MustACIdentifier(dep),
+			})
+		}
+		mustAddManifestToStore(storePath, keys[name], man, time.Now())
+	}
+	return keys
+}
+
+func TestDependencyTree(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+	os.Setenv("XDG_CACHE_HOME", workingDir)
+
+	storePath := path.Join(workingDir, "acbuild", "depstore")
+	keys := mustAddDepsToStore(storePath,
+		[]string{"example.com/base", "example.com/lib", depName},
+		map[string][]string{
+			"example.com/lib": {"example.com/base"},
+			depName:           {"example.com/lib", "example.com/base"},
+		})
+
+	err := runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, stdout, _, err := runACBuild(workingDir, "--no-history", "--shared-store", "dependency", "tree")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	short := func(name string) string {
+		return keys[name][:len("sha512-")+12]
+	}
+	// The fake images have the labels of an empty manifest
+	const labels = ",arch=amd64,os=linux"
+	expected := "acbuild-unnamed" + labels + "\n" +
+		"`-- " + depName + labels + " " + short(depName) + "\n" +
+		"    |-- example.com/lib" + labels + " " + short("example.com/lib") + "\n" +
+		"    |   `-- example.com/base" + labels + " " + short("example.com/base") + "\n" +
+		"    `-- example.com/base" + labels + " " + short("example.com/base") + " (duplicate)\n"
+	if stdout != expected {
+		t.Errorf("unexpected dependency tree, expected:\n%s\ngot:\n%s", expected, stdout)
+	}
+}
+
+func TestDependencyTreeCycle(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+	os.Setenv("XDG_CACHE_HOME", workingDir)
+
+	storePath := path.Join(workingDir, "acbuild", "depstore")
+	mustAddDepsToStore(storePath,
+		[]string{depName, depName2},
+		map[string][]string{
+			depName:  {depName2},
+			depName2: {depName},
+		})
+
+	err := runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, _, stderr, err := runACBuild(workingDir, "--no-history", "--shared-store", "dependency", "tree")
+	if err == nil {
+		t.Fatalf("dependency tree didn't fail on a dependency cycle")
+	}
+	expected := "dependency tree: dependency cycle: " + depName + " -> " + depName2 + " -> " + depName + "\n"
+	if stderr != expected {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+}
+
+func TestDependencyTreeHistory(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	oldCacheHome := os.Getenv("XDG_CACHE_HOME")
+	defer os.Setenv("XDG_CACHE_HOME", oldCacheHome)
+	os.Setenv("XDG_CACHE_HOME", workingDir)
+
+	storePath := path.Join(workingDir, "acbuild", "depstore")
+	mustAddDepsToStore(storePath, []string{depName}, nil)
+
+	err := runACBuildNoHist(workingDir, "dependency", "add", depName)
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	_, before, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, _, _, err = runACBuild(workingDir, "--shared-store", "dependency", "tree")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+	_, after, _, err := runACBuild(workingDir, "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v\n", err)
+	}
+
+	if before != after {
+		t.Errorf("dependency tree modified the manifest, before:\n%s\nafter:\n%s", before, after)
+	}
+}
@@ -15,12 +15,22 @@
 package tests
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/appc/spec/schema/types"
 )
 
 const goprogram = `
@@ -35,42 +45,184 @@ func main() {
 }
 `
 
+const rootlessgoprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+func main() {
+	err := ioutil.WriteFile("/created", []byte("created"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("success")
+}
+`
+
+const cachedgoprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func main() {
+	err := ioutil.WriteFile("/out", []byte(fmt.Sprint(time.Now().UnixNano())), 0644)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Remove("/todelete")
+	if err != nil {
+		panic(err)
+	}
+}
+`
+
 func TestRun(t *testing.T) {
 	if os.Getenv("ENABLE_SYSTEMD_TESTS") == "" {
 		t.Skip("skipping test; $ENABLE_SYSTEMD_TESTS not set")
 	}
 
-	// Build a statically linked test program
+	testRunWithEngine(t, "systemd-nspawn")
+}
+
+func TestRunNamespaces(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	testRunWithEngine(t, "namespaces")
+}
+
+func TestRunRootless(t *testing.T) {
+	tmprootfs := buildTestProgram(rootlessgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// Root doesn't need --rootless, so the build is handed to nobody to
+	// run the command without privileges
+	var cred *syscall.Credential
+	if os.Geteuid() == 0 {
+		cred = &syscall.Credential{Uid: 65534, Gid: 65534}
+		err := filepath.Walk(tmpdir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			return os.Lchown(p, int(cred.Uid), int(cred.Gid))
+		})
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	_, stdout, stderr, err := runACBuildAs(cred, tmpdir, "--no-history", "run", "--rootless", "/worker")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stderr != "" {
+		t.Errorf("stderr wasn't empty: %s", stderr)
+	}
+	if stdout != "success" {
+		t.Errorf("unexpected stdout: %s", stdout)
+	}
+
+	// The file is owned by the user on the host, which is root in the
+	// user namespace the command ran in, and in the written ACI
+	for _, args := range [][]string{
+		{"--no-history", "set-name", "example.com/rootless"},
+		{"--no-history", "write", "rootless.aci"},
+	} {
+		_, _, _, err := runACBuildAs(cred, tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	hdr := findACIHeader(t, path.Join(tmpdir, "rootless.aci"), "rootfs/created")
+	if hdr == nil {
+		t.Fatalf("the created file isn't in the written ACI")
+	}
+	if hdr.Uid != 0 || hdr.Gid != 0 {
+		t.Errorf("the created file is owned by %d:%d in the written ACI, expected 0:0", hdr.Uid, hdr.Gid)
+	}
+}
+
+// findACIHeader returns the header of the file with the given name in the
+// gzipped ACI at acipath, or nil if it isn't in it.
+func findACIHeader(t *testing.T, acipath, name string) *tar.Header {
+	f, err := os.Open(acipath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if path.Clean(hdr.Name) == name {
+			return hdr
+		}
+	}
+}
+
+// buildTestProgram builds a statically linked binary from the given source,
+// and places it at /worker in a new rootfs, whose path is returned.
+func buildTestProgram(source string) string {
 	tmpsourcedir := mustTempDir()
 	defer os.RemoveAll(tmpsourcedir)
 	tmpsource := path.Join(tmpsourcedir, "thing.go")
-	defer os.RemoveAll(tmpsourcedir)
-	err := ioutil.WriteFile(tmpsource, []byte(goprogram), 0644)
+	err := ioutil.WriteFile(tmpsource, []byte(source), 0644)
 	if err != nil {
 		panic(err)
 	}
 
 	tmprootfs := mustTempDir()
-	defer os.RemoveAll(tmprootfs)
 
 	cmd := exec.Command("go", "build", "-o", path.Join(tmprootfs, "worker"), "-tags", "netgo", "-ldflags", "-w", tmpsource)
-	cmd.Env = []string{"CGO_ENABLED=0", "GOOS=linux", "GOROOT=" + os.Getenv("GOROOT"), "GOPATH=" + os.Getenv("GOPATH")}
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=0", "GOOS=linux")
 	output, err := cmd.CombinedOutput()
 	if err != nil {
 		fmt.Println(string(output))
 		panic(err)
 	}
+	return tmprootfs
+}
+
+func testRunWithEngine(t *testing.T, engineName string, flags ...string) {
+	tmprootfs := buildTestProgram(goprogram)
+	defer os.RemoveAll(tmprootfs)
 
 	// Call begin on it
 	tmpdir := mustTempDir()
-	_, _, _, err = runACBuild(tmpdir, "begin", tmprootfs)
+	_, _, _, err := runACBuild(tmpdir, "begin", tmprootfs)
 	if err != nil {
 		t.Fatalf("%v\n", err)
 	}
 	defer os.RemoveAll(tmpdir)
 
 	// acbuild run the binary
-	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "/worker")
+	args := append([]string{"--no-history", "run", "--engine=" + engineName}, flags...)
+	_, stdout, stderr, err := runACBuild(tmpdir, append(args, "/worker")...)
 	if err != nil {
 		panic(err)
 	}
@@ -99,3 +251,673 @@ func TestRunBadEngine(t *testing.T) {
 		t.Errorf("unexpected message on stderr: %s", stderr)
 	}
 }
+
+func TestRunLayerCache(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(cachedgoprogram)
+	defer os.RemoveAll(tmprootfs)
+	err := ioutil.WriteFile(path.Join(tmprootfs, "todelete"), nil, 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	cacheDir := mustTempDir()
+	defer os.RemoveAll(cacheDir)
+
+	var outputs []string
+	for i := 0; i < 3; i++ {
+		tmpdir := mustTempDir()
+		defer os.RemoveAll(tmpdir)
+
+		err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+		if i == 2 {
+			// Only an extended attribute differs this time
+			err := syscall.Setxattr(path.Join(rootfs, "worker"), "user.acbuild-test", []byte("1"), 0)
+			if err == syscall.ENOTSUP {
+				break
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		_, _, stderr, err := runACBuild(tmpdir, "--debug", "--no-history", "run", "--engine=namespaces", "--layer-cache="+cacheDir, "/worker")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		usedCache := strings.Contains(stderr, "Using cached result")
+		if i != 1 && usedCache {
+			t.Errorf("run %d used the cache", i)
+		}
+		if i == 1 && !usedCache {
+			t.Errorf("second run didn't use the cache, stderr: %s", stderr)
+		}
+		if i == 2 {
+			continue
+		}
+
+		out, err := ioutil.ReadFile(path.Join(rootfs, "out"))
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		outputs = append(outputs, string(out))
+		if _, err := os.Stat(path.Join(rootfs, "todelete")); !os.IsNotExist(err) {
+			t.Errorf("deleted file exists after run %d", i)
+		}
+	}
+
+	if outputs[0] != outputs[1] {
+		t.Errorf("cached output differs: %q != %q", outputs[0], outputs[1])
+	}
+}
+
+const mountsgoprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+func main() {
+	in, err := ioutil.ReadFile("/host/in")
+	if err != nil {
+		panic(err)
+	}
+	if ioutil.WriteFile("/host/in", nil, 0644) == nil {
+		panic("wrote to a read-only mount")
+	}
+	count, _ := ioutil.ReadFile("/var/cache/thing/count")
+	count = append(count, 'x')
+	err = ioutil.WriteFile("/var/cache/thing/count", count, 0644)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s %s", in, count)
+}
+`
+
+func TestRunMounts(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	for _, engineName := range []string{"namespaces", "chroot"} {
+		testRunMountsWithEngine(t, engineName)
+	}
+}
+
+func testRunMountsWithEngine(t *testing.T, engineName string) {
+	tmprootfs := buildTestProgram(mountsgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	hostDir := mustTempDir()
+	defer os.RemoveAll(hostDir)
+	err := ioutil.WriteFile(path.Join(hostDir, "in"), []byte("hello"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err = runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, expected := range []string{"hello x", "hello xx"} {
+		_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine="+engineName,
+			"--bind", hostDir+":/host:ro", "--cache", "thing:/var/cache/thing", "/worker")
+		if err != nil {
+			t.Fatalf("%s: %v, stderr: %s", engineName, err, stderr)
+		}
+		if stdout != expected {
+			t.Errorf("%s: unexpected stdout: %q, expected %q", engineName, stdout, expected)
+		}
+	}
+
+	rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+	for _, p := range []string{"host", "var"} {
+		if _, err := os.Lstat(path.Join(rootfs, p)); !os.IsNotExist(err) {
+			t.Errorf("%s: mount point /%s was left in the rootfs", engineName, p)
+		}
+	}
+}
+
+const secretsgoprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+func main() {
+	secret, err := ioutil.ReadFile("/run/secrets/token")
+	if err != nil {
+		panic(err)
+	}
+	if ioutil.WriteFile("/run/secrets/token", nil, 0644) == nil {
+		panic("wrote to a secret")
+	}
+	fmt.Printf("%s", secret)
+}
+`
+
+func TestRunSecrets(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	for _, flag := range []string{"--engine=namespaces", "--rootless"} {
+		testRunSecrets(t, flag)
+	}
+}
+
+func testRunSecrets(t *testing.T, engineFlag string) {
+	tmprootfs := buildTestProgram(secretsgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	secretDir := mustTempDir()
+	defer os.RemoveAll(secretDir)
+	secretFile := path.Join(secretDir, "token")
+	err := ioutil.WriteFile(secretFile, []byte("hunter2"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	for _, args := range [][]string{{"begin", tmprootfs}, {"set-name", "example.com/secrets"}} {
+		err = runACBuildNoHist(tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", engineFlag, "--secret", "id=token,src="+secretFile, "/worker")
+	if err != nil {
+		t.Fatalf("%s: %v, stderr: %s", engineFlag, err, stderr)
+	}
+	if stdout != "hunter2" {
+		t.Errorf("%s: unexpected stdout: %q", engineFlag, stdout)
+	}
+
+	rootfs := path.Join(tmpdir, ".acbuild", "currentaci", "rootfs")
+	if _, err := os.Lstat(path.Join(rootfs, "run")); !os.IsNotExist(err) {
+		t.Errorf("%s: secret mount point was left in the rootfs", engineFlag)
+	}
+
+	aciPath := path.Join(tmpdir, "secrets.aci")
+	err = runACBuildNoHist(tmpdir, "write", aciPath)
+	if err != nil {
+		t.Fatalf("%s: %v", engineFlag, err)
+	}
+
+	// Write has to refuse the ACI once something is at the secret's path
+	err = runACBuildNoHist(tmpdir, "copy", secretFile, "/run/secrets/token")
+	if err != nil {
+		t.Fatalf("%s: %v", engineFlag, err)
+	}
+	_, _, stderr, err = runACBuild(tmpdir, "--no-history", "write", "--overwrite", aciPath)
+	if err == nil {
+		t.Fatalf("%s: write succeeded with a secret in the rootfs", engineFlag)
+	}
+	expected := "write: can't write ACI, secret \"token\" was left in the rootfs at /run/secrets/token\n"
+	if stderr != expected {
+		t.Errorf("%s: unexpected stderr: %q, expected %q", engineFlag, stderr, expected)
+	}
+}
+
+func TestRunSecretsLayerCache(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(secretsgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	secretDir := mustTempDir()
+	defer os.RemoveAll(secretDir)
+	secretFile := path.Join(secretDir, "token")
+	err := ioutil.WriteFile(secretFile, []byte("hunter2"), 0600)
+	if err != nil {
+		panic(err)
+	}
+
+	cacheDir := mustTempDir()
+	defer os.RemoveAll(cacheDir)
+
+	// The second build takes the result from the cache, and the secret
+	// still has to be recorded for write to check
+	for i := 0; i < 2; i++ {
+		tmpdir := mustTempDir()
+		defer os.RemoveAll(tmpdir)
+		for _, args := range [][]string{{"begin", tmprootfs}, {"set-name", "example.com/secrets"}} {
+			err = runACBuildNoHist(tmpdir, args...)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+		}
+
+		_, _, stderr, err := runACBuild(tmpdir, "--debug", "--no-history", "run", "--engine=namespaces", "--layer-cache="+cacheDir,
+			"--secret", "id=token,src="+secretFile, "/worker")
+		if err != nil {
+			t.Fatalf("%v, stderr: %s", err, stderr)
+		}
+		if usedCache := strings.Contains(stderr, "Using cached result"); usedCache != (i == 1) {
+			t.Fatalf("run %d used the cache: %v", i, usedCache)
+		}
+
+		err = runACBuildNoHist(tmpdir, "copy", secretFile, "/run/secrets/token")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		_, _, _, err = runACBuild(tmpdir, "--no-history", "write", path.Join(tmpdir, "secrets.aci"))
+		if err == nil {
+			t.Errorf("run %d: write succeeded with a secret in the rootfs", i)
+		}
+	}
+}
+
+const networkgoprogram = `
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+func main() {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		panic(err)
+	}
+	loUp, others := false, 0
+	for _, iface := range ifaces {
+		if iface.Name == "lo" {
+			loUp = iface.Flags&net.FlagUp != 0
+		} else {
+			others++
+		}
+	}
+	fmt.Printf("lo up: %v, other interfaces: %d", loUp, others)
+}
+`
+
+func TestRunNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	hostIfaces, err := net.Interfaces()
+	if err != nil {
+		panic(err)
+	}
+	expected := map[string]string{
+		"host":     fmt.Sprintf("lo up: true, other interfaces: %d", len(hostIfaces)-1),
+		"none":     "lo up: false, other interfaces: 0",
+		"loopback": "lo up: true, other interfaces: 0",
+	}
+
+	tmprootfs := buildTestProgram(networkgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err = runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, engineFlag := range []string{"--engine=namespaces", "--engine=chroot", "--rootless"} {
+		for _, network := range []string{"host", "none", "loopback"} {
+			_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "run", engineFlag, "--net="+network, "/worker")
+			if err != nil {
+				t.Fatalf("%s --net=%s: %v, stderr: %s", engineFlag, network, err, stderr)
+			}
+			if stdout != expected[network] {
+				t.Errorf("%s --net=%s: unexpected stdout: %q, expected %q", engineFlag, network, stdout, expected[network])
+			}
+		}
+	}
+}
+
+const usergoprogram = `
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	groups, err := os.Getgroups()
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%d %d %v", os.Getuid(), os.Getgid(), groups)
+}
+`
+
+func TestRunUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(usergoprogram)
+	defer os.RemoveAll(tmprootfs)
+	// The temporary directory can only be entered by root
+	err := os.Chmod(tmprootfs, 0755)
+	if err != nil {
+		panic(err)
+	}
+	err = os.Mkdir(path.Join(tmprootfs, "etc"), 0755)
+	if err != nil {
+		panic(err)
+	}
+	etcFiles := map[string]string{
+		"passwd": "root:x:0:0:root:/root:/bin/sh\nbuilder:x:1000:1000::/home/builder:/bin/sh\n",
+		"group":  "root:x:0:\nwheel:x:10:builder\nbuilder:x:1000:\n",
+	}
+	for name, contents := range etcFiles {
+		err := ioutil.WriteFile(path.Join(tmprootfs, "etc", name), []byte(contents), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	for _, args := range [][]string{{"begin", tmprootfs}, {"set-user", "builder"}, {"set-group", "builder"}} {
+		err = runACBuildNoHist(tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for _, engineName := range []string{"namespaces", "chroot"} {
+		for _, c := range []struct {
+			flags    []string
+			expected string
+		}{
+			{[]string{"--user", "builder"}, "1000 1000 [10]"},
+			{[]string{"--user", "1000", "--group", "wheel"}, "1000 10 []"},
+			{[]string{"--user", "4242"}, "4242 0 []"},
+			{[]string{"--as-app-user"}, "1000 1000 [10]"},
+		} {
+			args := append([]string{"--no-history", "run", "--engine=" + engineName}, c.flags...)
+			_, stdout, stderr, err := runACBuild(tmpdir, append(args, "/worker")...)
+			if err != nil {
+				t.Fatalf("%s %v: %v, stderr: %s", engineName, c.flags, err, stderr)
+			}
+			if stdout != c.expected {
+				t.Errorf("%s %v: unexpected stdout: %q, expected %q", engineName, c.flags, stdout, c.expected)
+			}
+		}
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "--no-history", "run", "--engine=namespaces", "--user", "nobody", "/worker")
+	if err == nil {
+		t.Errorf("run as a user missing from /etc/passwd succeeded")
+	}
+	expected := "run: couldn't resolve user \"nobody\": \"nobody\" user not found\n"
+	if stderr != expected {
+		t.Errorf("unexpected stderr: %q, expected %q", stderr, expected)
+	}
+}
+
+const timeoutMarker = "acbuild-timeout-test"
+
+const timeoutgoprogram = `
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+func main() {
+	if len(os.Args) == 1 {
+		// Start a process in a session of its own, which has to be
+		// killed too
+		cmd := exec.Command("/worker", "` + timeoutMarker + `")
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		err := cmd.Start()
+		if err != nil {
+			panic(err)
+		}
+	}
+	time.Sleep(time.Hour)
+}
+`
+
+func TestRunTimeout(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(timeoutgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, engineName := range []string{"namespaces", "chroot"} {
+		start := time.Now()
+		code, _, stderr, _ := runACBuild(tmpdir, "--no-history", "run", "--engine="+engineName, "--timeout=500ms", "/worker")
+		if code != 124 {
+			t.Errorf("%s: unexpected exit code %d, stderr: %s", engineName, code, stderr)
+		}
+		if expected := "run: the command timed out and was killed\n"; stderr != expected {
+			t.Errorf("%s: unexpected stderr: %q, expected %q", engineName, stderr, expected)
+		}
+		if elapsed := time.Since(start); elapsed > 30*time.Second {
+			t.Errorf("%s: run took %v", engineName, elapsed)
+		}
+
+		// Killed processes can take a moment to disappear
+		var running []string
+		for i := 0; i < 50; i++ {
+			running = markedProcesses()
+			if len(running) == 0 {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if len(running) != 0 {
+			t.Errorf("%s: processes started by the command are still running: %v", engineName, running)
+		}
+	}
+}
+
+// markedProcesses returns the pids of the live processes with timeoutMarker
+// on their command line.
+func markedProcesses() []string {
+	var pids []string
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, cmdline := range cmdlines {
+		blob, _ := ioutil.ReadFile(cmdline)
+		// Zombies have an empty command line
+		if strings.Contains(string(blob), timeoutMarker) {
+			pids = append(pids, filepath.Base(filepath.Dir(cmdline)))
+		}
+	}
+	return pids
+}
+
+const limitsgoprogram = `
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	blob, err := ioutil.ReadFile("/proc/self/cgroup")
+	if err != nil {
+		panic(err)
+	}
+	for _, line := range strings.Split(string(blob), "\n") {
+		if !strings.HasPrefix(line, "0::") {
+			continue
+		}
+		cgroup := filepath.Join("/cgroup", strings.TrimPrefix(line, "0::"))
+		for _, file := range []string{"memory.max", "cpu.max"} {
+			limit, err := ioutil.ReadFile(filepath.Join(cgroup, file))
+			if err != nil {
+				panic(err)
+			}
+			fmt.Print(string(limit))
+		}
+	}
+}
+`
+
+func TestRunLimits(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		// Without systemd, the commands are run below a cgroup
+		// delegated to acbuild, made here below the root cgroup
+		controllers, err := ioutil.ReadFile("/sys/fs/cgroup/cgroup.subtree_control")
+		if err != nil {
+			t.Skip("skipping test; cgroups v2 aren't mounted at /sys/fs/cgroup")
+		}
+		for _, controller := range []string{"memory", "cpu"} {
+			if !strings.Contains(" "+strings.TrimSpace(string(controllers))+" ", " "+controller+" ") {
+				t.Skipf("skipping test; the %s cgroup controller isn't enabled", controller)
+			}
+		}
+		delegated, err := ioutil.TempDir("/sys/fs/cgroup", "acbuild-test-")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		defer os.Remove(delegated)
+		err = ioutil.WriteFile(filepath.Join(delegated, "cgroup.subtree_control"), []byte("+memory +cpu"), 0644)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		oldCgroup := os.Getenv("ACBUILD_CGROUP")
+		os.Setenv("ACBUILD_CGROUP", delegated)
+		defer os.Setenv("ACBUILD_CGROUP", oldCgroup)
+	}
+
+	tmprootfs := buildTestProgram(limitsgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, engineName := range []string{"namespaces", "chroot"} {
+		_, stdout, _, err := runACBuild(tmpdir, "--no-history", "run", "--engine="+engineName,
+			"--memory=32M", "--cpus=0.5", "--bind=/sys/fs/cgroup:/cgroup:ro", "/worker")
+		if err != nil {
+			t.Fatalf("%s: %v", engineName, err)
+		}
+		if expected := "33554432\n50000 100000\n"; stdout != expected {
+			t.Errorf("%s: unexpected limits: %q, expected %q", engineName, stdout, expected)
+		}
+	}
+}
+
+const catgoprogram = `
+package main
+
+import (
+	"io/ioutil"
+	"os"
+)
+
+func main() {
+	contents, err := ioutil.ReadFile("/shared")
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(contents)
+}
+`
+
+func TestRunDependencyOrder(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(catgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	err := runACBuildNoHist(tmpdir, "begin", tmprootfs)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	// The file in the dependency hides the one in the dependency's own
+	// dependency
+	baseman := emptyManifest()
+	baseman.Name = *types.MustACIdentifier("example.com/base")
+	mustAddToDepStore(tmpdir, baseman, fileInfo{name: "shared", contents: []byte("base")})
+	libman := emptyManifest()
+	libman.Name = *types.MustACIdentifier("example.com/lib")
+	libman.Dependencies = types.Dependencies{{ImageName: baseman.Name}}
+	mustAddToDepStore(tmpdir, libman, fileInfo{name: "shared", contents: []byte("lib")})
+
+	// Running with the base image as the only dependency first renders all
+	// of its files, so that the hidden file is there when it's used
+	// beneath the other image
+	for _, step := range []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"dependency", "add", "example.com/base"}, ""},
+		{[]string{"run", "--engine=chroot", "/worker"}, "base"},
+		{[]string{"dependency", "remove", "example.com/base"}, ""},
+		{[]string{"dependency", "add", "example.com/lib"}, ""},
+		{[]string{"run", "--engine=chroot", "/worker"}, "lib"},
+	} {
+		_, stdout, _, err := runACBuild(tmpdir, append([]string{"--no-history"}, step.args...)...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if stdout != step.expected {
+			t.Errorf("%s: unexpected output %q, expected %q", strings.Join(step.args, " "), stdout, step.expected)
+		}
+	}
+
+	// Squashing the ACI keeps the same file
+	err = runACBuildNoHist(tmpdir, "set-name", "example.com/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = runACBuildNoHist(tmpdir, "write", "--squash", "image.aci")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	files, _ := readACIFiles(t, path.Join(tmpdir, "image.aci"))
+	if files["rootfs/shared"] != "lib" {
+		t.Errorf("the squashed ACI has %q in the file, expected %q", files["rootfs/shared"], "lib")
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const variablesScript = `begin
+arg VERSION 1.0
+set NAME example.com/app
+set-name ${NAME}
+label add version "v${VERSION}"
+annotation add literal '${NAME}'
+write --overwrite app.aci
+`
+
+func TestScriptVariables(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	err := ioutil.WriteFile(path.Join(tmpdir, "build.acb"), []byte(variablesScript), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, c := range []struct {
+		args    []string
+		version string
+	}{
+		{nil, "v1.0"},
+		{[]string{"--arg", "VERSION=2.0"}, "v2.0"},
+	} {
+		args := append(append([]string{"--no-history", "script"}, c.args...), "build.acb")
+		err := runACBuildNoHist(tmpdir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+
+		_, manifest, _, err := runACBuild(tmpdir, "--modify", path.Join(tmpdir, "app.aci"), "cat-manifest")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		for _, wanted := range []string{
+			`"name":"example.com/app"`,
+			`"value":"` + c.version + `"`,
+			`"value":"${NAME}"`,
+		} {
+			if !strings.Contains(manifest, wanted) {
+				t.Errorf("manifest doesn't contain %s:\n%s", wanted, manifest)
+			}
+		}
+	}
+}
+
+func TestScriptUndefinedVariable(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	err := ioutil.WriteFile(path.Join(tmpdir, "build.acb"), []byte("begin\nset-name ${NAME}\n"), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	_, _, stderr, err := runACBuild(tmpdir, "script", "build.acb")
+	if err == nil {
+		t.Fatalf("script with an undefined variable succeeded")
+	}
+	if !strings.Contains(stderr, `undefined variable "NAME"`) {
+		t.Errorf("unexpected stderr: %s", stderr)
+	}
+}
+
+func TestScriptNested(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	scripts := map[string]string{
+		"outer.acb": "begin\nset-name example.com/app\nport add a tcp 80 --count 3\nscript --arg PORT=90 inner.acb\nport add c tcp 100\nwrite --overwrite app.aci\n",
+		"inner.acb": "arg PORT\nport add b tcp ${PORT}\n",
+	}
+	for name, script := range scripts {
+		err := ioutil.WriteFile(path.Join(tmpdir, name), []byte(script), 0644)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err := runACBuildNoHist(tmpdir, "script", "outer.acb")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	_, manifest, _, err := runACBuild(tmpdir, "--modify", path.Join(tmpdir, "app.aci"), "cat-manifest")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	for _, wanted := range []string{
+		`{"name":"a","protocol":"tcp","port":80,"count":3,"socketActivated":false}`,
+		`{"name":"b","protocol":"tcp","port":90,"count":1,"socketActivated":false}`,
+		`{"name":"c","protocol":"tcp","port":100,"count":1,"socketActivated":false}`,
+	} {
+		if !strings.Contains(manifest, wanted) {
+			t.Errorf("manifest doesn't contain %s:\n%s", wanted, manifest)
+		}
+	}
+
+	// The build is cleaned up once the script is done
+	if _, err := os.Stat(path.Join(tmpdir, ".acbuild")); !os.IsNotExist(err) {
+		t.Errorf("build context left behind in %s", tmpdir)
+	}
+}
+
+func TestScriptNetwork(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test; must be run as root")
+	}
+
+	tmprootfs := buildTestProgram(networkgoprogram)
+	defer os.RemoveAll(tmprootfs)
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	script := "begin " + tmprootfs + "\n" +
+		"run --engine=namespaces -- /worker\n" +
+		"run --engine=namespaces --net=loopback -- /worker\n"
+	err := ioutil.WriteFile(path.Join(tmpdir, "build.acb"), []byte(script), 0644)
+	if err != nil {
+		panic(err)
+	}
+
+	_, stdout, stderr, err := runACBuild(tmpdir, "--no-history", "script", "--net=none", "build.acb")
+	if err != nil {
+		t.Fatalf("%v, stderr: %s", err, stderr)
+	}
+	expected := "lo up: false, other interfaces: 0" + "lo up: true, other interfaces: 0"
+	if stdout != expected {
+		t.Errorf("unexpected stdout: %q, expected %q", stdout, expected)
+	}
+}
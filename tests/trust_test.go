@@ -0,0 +1,113 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+// mustGenerateKey generates a new gpg key, and returns the path to a file
+// holding its ASCII armored public key.
+func mustGenerateKey(dir string) string {
+	homedir := path.Join(dir, "gnupg")
+	err := os.Mkdir(homedir, 0700)
+	if err != nil {
+		panic(err)
+	}
+	gpg := func(args ...string) []byte {
+		args = append([]string{"--batch", "--homedir", homedir}, args...)
+		output, err := exec.Command("gpg", args...).Output()
+		if err != nil {
+			panic(fmt.Errorf("gpg %v: %v", args, err))
+		}
+		return output
+	}
+	gpg("--passphrase", "", "--quick-gen-key", "acbuild test <test@example.com>", "default", "default", "never")
+	keyPath := path.Join(dir, "pubkey.gpg")
+	err = ioutil.WriteFile(keyPath, gpg("--armor", "--export"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	return keyPath
+}
+
+func TestTrust(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("skipping test; gpg not found")
+	}
+
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+	keyPath := mustGenerateKey(tmpdir)
+
+	oldConfigHome := os.Getenv("XDG_CONFIG_HOME")
+	defer os.Setenv("XDG_CONFIG_HOME", oldConfigHome)
+	os.Setenv("XDG_CONFIG_HOME", tmpdir)
+
+	_, stdout, _, err := runACBuild(tmpdir, "trust", "add", "--prefix", "example.com/app", keyPath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fields := strings.Fields(stdout)
+	if len(fields) < 3 {
+		t.Fatalf("unexpected output from trust add: %s", stdout)
+	}
+	fingerprint := fields[2]
+
+	keyFile := path.Join(tmpdir, "acbuild", "trustedkeys", "prefix.d", "example.com,app", fingerprint)
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Errorf("key wasn't stored in the trust store: %v", err)
+	}
+
+	_, stdout, _, err = runACBuild(tmpdir, "trust", "list")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if !strings.Contains(stdout, "example.com/app\t"+fingerprint) {
+		t.Errorf("trusted key missing from trust list: %s", stdout)
+	}
+
+	err = runACBuildNoHist(tmpdir, "trust", "remove", fingerprint)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+		t.Errorf("key still in the trust store after trust remove")
+	}
+
+	_, _, _, err = runACBuild(tmpdir, "trust", "remove", fingerprint)
+	if err == nil {
+		t.Errorf("removing a key that isn't trusted succeeded")
+	}
+}
+
+func TestTrustAddNeedsPrefixOrRoot(t *testing.T) {
+	tmpdir := mustTempDir()
+	defer os.RemoveAll(tmpdir)
+
+	_, _, stderr, err := runACBuild(tmpdir, "trust", "add", "pubkey.gpg")
+	if err == nil {
+		t.Errorf("trust add succeeded without --prefix or --root")
+	}
+	if stderr != "trust add: exactly one of --prefix and --root must be given\n" {
+		t.Errorf("unexpected message on stderr: %s", stderr)
+	}
+}
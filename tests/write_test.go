@@ -0,0 +1,373 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tests
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/appc/spec/aci"
+	"github.com/appc/spec/schema"
+	"github.com/appc/spec/schema/types"
+	"github.com/kylelemons/godebug/pretty"
+)
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Annotations map[string]string `json:"annotations"`
+}
+
+type ociImageConfig struct {
+	User         string              `json:"User"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	Env          []string            `json:"Env"`
+	Entrypoint   []string            `json:"Entrypoint"`
+	Volumes      map[string]struct{} `json:"Volumes"`
+	WorkingDir   string              `json:"WorkingDir"`
+}
+
+func readOCIBlob(t *testing.T, layout string, desc ociDescriptor, v interface{}) {
+	blob, err := ioutil.ReadFile(path.Join(layout, "blobs", strings.Replace(desc.Digest, ":", "/", 1)))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = json.Unmarshal(blob, v)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+}
+
+func TestWriteOCI(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	for _, args := range [][]string{
+		{"set-name", "example.com/app"},
+		{"label", "add", "version", "1.0"},
+		{"set-exec", "--", "/bin/app", "--flag"},
+		{"set-user", "1000"},
+		{"set-group", "100"},
+		{"set-working-directory", "/srv"},
+		{"environment", "add", "FOO", "bar"},
+		{"port", "add", "http", "tcp", "80"},
+		{"mount", "add", "data", "/data"},
+	} {
+		err := runACBuildNoHist(workingDir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	layout := path.Join(workingDir, "image")
+	err := runACBuildNoHist(workingDir, "write", "--format=oci", layout)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	blob, err := ioutil.ReadFile(path.Join(layout, "index.json"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = json.Unmarshal(blob, &index)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(index.Manifests) != 1 {
+		t.Fatalf("expected one manifest in the index, got %d", len(index.Manifests))
+	}
+	if tag := index.Manifests[0].Annotations["org.opencontainers.image.ref.name"]; tag != "1.0" {
+		t.Errorf("unexpected tag: %q", tag)
+	}
+
+	var manifest struct {
+		Config ociDescriptor   `json:"config"`
+		Layers []ociDescriptor `json:"layers"`
+	}
+	readOCIBlob(t, layout, index.Manifests[0], &manifest)
+	if len(manifest.Layers) != 1 {
+		t.Errorf("expected one layer, got %d", len(manifest.Layers))
+	}
+
+	var image struct {
+		Config ociImageConfig `json:"config"`
+	}
+	readOCIBlob(t, layout, manifest.Config, &image)
+
+	expected := ociImageConfig{
+		User:         "1000:100",
+		ExposedPorts: map[string]struct{}{"80/tcp": {}},
+		Env:          []string{"FOO=bar"},
+		Entrypoint:   []string{"/bin/app", "--flag"},
+		Volumes:      map[string]struct{}{"/data": {}},
+		WorkingDir:   "/srv",
+	}
+	if diff := pretty.Compare(expected, image.Config); diff != "" {
+		t.Errorf("unexpected image config:\n%s", diff)
+	}
+}
+
+func TestWriteOCIBundle(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	err := runACBuildNoHist(workingDir, "set-name", "example.com/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	bundle := path.Join(workingDir, "bundle")
+	_, _, _, err = runACBuild(workingDir, "--no-history", "write", "--format=oci-bundle", bundle)
+	if err == nil {
+		t.Errorf("writing a bundle without an exec command succeeded")
+	}
+	if _, err := os.Stat(bundle); !os.IsNotExist(err) {
+		t.Errorf("bundle was left behind after a failed write")
+	}
+
+	err = runACBuildNoHist(workingDir, "set-exec", "/bin/app")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = runACBuildNoHist(workingDir, "write", "--format=oci-bundle", bundle)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	var spec struct {
+		Process struct {
+			Args []string `json:"args"`
+		} `json:"process"`
+		Root struct {
+			Path string `json:"path"`
+		} `json:"root"`
+	}
+	blob, err := ioutil.ReadFile(path.Join(bundle, "config.json"))
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = json.Unmarshal(blob, &spec)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if len(spec.Process.Args) != 1 || spec.Process.Args[0] != "/bin/app" {
+		t.Errorf("unexpected process args: %v", spec.Process.Args)
+	}
+	if _, err := os.Stat(path.Join(bundle, spec.Root.Path)); err != nil {
+		t.Errorf("bundle's rootfs is missing: %v", err)
+	}
+}
+
+func TestWriteReproducible(t *testing.T) {
+	var outputs [][][]byte
+	for i := 0; i < 2; i++ {
+		if i != 0 {
+			// Make sure that every timestamp differs between the builds
+			time.Sleep(time.Second)
+		}
+
+		workingDir := setUpTest(t)
+		defer cleanUpTest(workingDir)
+
+		err := runACBuildNoHist(workingDir, "set-name", "example.com/app")
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		rootfs := path.Join(workingDir, ".acbuild", "currentaci", "rootfs")
+		err = os.Mkdir(path.Join(rootfs, "dir"), 0755)
+		if err != nil {
+			panic(err)
+		}
+		err = ioutil.WriteFile(path.Join(rootfs, "dir", "file"), []byte("contents"), 0644)
+		if err != nil {
+			panic(err)
+		}
+
+		var written [][]byte
+		for _, args := range [][]string{
+			{"write", "--reproducible", "image.aci"},
+			{"write", "--source-date-epoch=1000000000", "image2.aci"},
+			{"write", "--reproducible", "--format=oci", "image.tar"},
+		} {
+			err = runACBuildNoHist(workingDir, args...)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			blob, err := ioutil.ReadFile(path.Join(workingDir, args[len(args)-1]))
+			if err != nil {
+				panic(err)
+			}
+			written = append(written, blob)
+		}
+		outputs = append(outputs, written)
+	}
+
+	for i := range outputs[0] {
+		if !bytes.Equal(outputs[0][i], outputs[1][i]) {
+			t.Errorf("image %d differs between builds", i)
+		}
+	}
+	if bytes.Equal(outputs[0][0], outputs[0][1]) {
+		t.Errorf("images with different source date epochs are identical")
+	}
+}
+
+// readACIFiles returns the contents of the regular files in the gzipped ACI
+// at acipath, along with its manifest.
+func readACIFiles(t *testing.T, acipath string) (map[string]string, schema.ImageManifest) {
+	f, err := os.Open(acipath)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer f.Close()
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files := make(map[string]string)
+	var man schema.ImageManifest
+	tr := tar.NewReader(gzr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		blob, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+		if hdr.Name == aci.ManifestFile {
+			err = json.Unmarshal(blob, &man)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			continue
+		}
+		files[hdr.Name] = string(blob)
+	}
+	return files, man
+}
+
+// mustAddToDepStore adds an ACI with the given manifest and files to the
+// depstore of the build in workingDir, and returns its key.
+func mustAddToDepStore(workingDir string, man schema.ImageManifest, files ...fileInfo) string {
+	var depaci bytes.Buffer
+	err := makeACI(&depaci, man, files...)
+	if err != nil {
+		panic(err)
+	}
+	key := fmt.Sprintf("sha512-%x", sha512.Sum512(depaci.Bytes()))
+	depstore := path.Join(workingDir, ".acbuild", "depstore-tar")
+	expanded := path.Join(workingDir, ".acbuild", "depstore-expanded", key)
+	for _, dir := range []string{depstore, expanded} {
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			panic(err)
+		}
+	}
+	err = ioutil.WriteFile(path.Join(depstore, key), depaci.Bytes(), 0644)
+	if err != nil {
+		panic(err)
+	}
+	manblob, err := json.Marshal(man)
+	if err != nil {
+		panic(err)
+	}
+	err = ioutil.WriteFile(path.Join(expanded, aci.ManifestFile), manblob, 0644)
+	if err != nil {
+		panic(err)
+	}
+	return key
+}
+
+func TestWriteSquash(t *testing.T) {
+	workingDir := setUpTest(t)
+	defer cleanUpTest(workingDir)
+
+	// Add the dependency to the build's own depstore
+	depman := emptyManifest()
+	depman.Name = *types.MustACIdentifier("example.com/base")
+	depman.PathWhitelist = []string{"/shared", "/onlybase", "/deleted"}
+	mustAddToDepStore(workingDir, depman,
+		fileInfo{name: "shared", contents: []byte("base")},
+		fileInfo{name: "onlybase", contents: []byte("base")},
+		fileInfo{name: "deleted", contents: []byte("base")},
+		fileInfo{name: "notlisted", contents: []byte("base")})
+
+	for _, args := range [][]string{
+		{"set-name", "example.com/app"},
+		{"dependency", "add", "example.com/base"},
+	} {
+		err := runACBuildNoHist(workingDir, args...)
+		if err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	rootfs := path.Join(workingDir, ".acbuild", "currentaci", "rootfs")
+	err := ioutil.WriteFile(path.Join(rootfs, "shared"), []byte("app"), 0644)
+	if err != nil {
+		panic(err)
+	}
+	expected := map[string]string{
+		"rootfs/shared":   "app",
+		"rootfs/onlybase": "base",
+		"rootfs/deleted":  "base",
+	}
+	if os.Geteuid() == 0 {
+		// A file deleted by run in a dependency is left behind as an
+		// overlayfs whiteout
+		err = syscall.Mknod(path.Join(rootfs, "deleted"), syscall.S_IFCHR, 0)
+		if err != nil {
+			panic(err)
+		}
+		delete(expected, "rootfs/deleted")
+	}
+
+	err = runACBuildNoHist(workingDir, "write", "--squash", "image.aci")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	files, man := readACIFiles(t, path.Join(workingDir, "image.aci"))
+	if diff := pretty.Compare(files, expected); diff != "" {
+		t.Errorf("unexpected files in the squashed ACI:\n%s", diff)
+	}
+	if len(man.Dependencies) != 0 {
+		t.Errorf("squashed ACI has dependencies: %v", man.Dependencies)
+	}
+}
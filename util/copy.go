@@ -0,0 +1,150 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/coreos/rkt/pkg/fileutil"
+)
+
+// CopyTreeOptions changes how CopyTree copies files.
+type CopyTreeOptions struct {
+	// Chown gives every copied file the owner UID and group GID, instead of
+	// the owner and group of the original.
+	Chown    bool
+	UID, GID int
+
+	// Chmod gives every copied file, other than directories and symlinks,
+	// the permissions, setuid, setgid and sticky bits in Mode instead of
+	// those of the original. Directories keep their own, so that they stay
+	// traversable.
+	Chmod bool
+	Mode  os.FileMode
+
+	// Exclude, if set, is called with the path relative to src of every
+	// file under it. Files it returns true for are skipped, along with
+	// everything under them.
+	Exclude func(relpath string) bool
+}
+
+// chmodBits are the bits of a file's mode that CopyTreeOptions.Chmod sets.
+const chmodBits = os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky
+
+// CopyTree copies the file or directory at src to dest, along with everything
+// under it, keeping ownership, permissions and times unless opts says
+// otherwise.
+func CopyTree(src, dest string, opts CopyTreeOptions) error {
+	cleanSrc := filepath.Clean(src)
+	dirs := make(map[string][]syscall.Timespec)
+	copyWalker := func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relpath, err := filepath.Rel(cleanSrc, path)
+		if err != nil {
+			return err
+		}
+		if relpath != "." && opts.Exclude != nil && opts.Exclude(relpath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		target := filepath.Join(dest, relpath)
+
+		mode := info.Mode()
+		stat := info.Sys().(*syscall.Stat_t)
+		switch {
+		case mode.IsDir():
+			err := os.Mkdir(target, mode.Perm())
+			if err != nil {
+				return err
+			}
+		case mode.IsRegular():
+			err := fileutil.CopyRegularFile(path, target)
+			if err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			err := fileutil.CopySymlink(path, target)
+			if err != nil {
+				return err
+			}
+		case mode&os.ModeDevice != 0:
+			devType := uint32(syscall.S_IFBLK)
+			if mode&os.ModeCharDevice != 0 {
+				devType = syscall.S_IFCHR
+			}
+			err := syscall.Mknod(target, uint32(mode.Perm())|devType, int(stat.Rdev))
+			if err != nil {
+				return err
+			}
+		case mode&os.ModeNamedPipe != 0:
+			err := syscall.Mkfifo(target, uint32(mode.Perm()))
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported mode: %v", mode)
+		}
+
+		uid, gid := int(stat.Uid), int(stat.Gid)
+		if opts.Chown {
+			uid, gid = opts.UID, opts.GID
+		}
+		err = os.Lchown(target, uid, gid)
+		if err != nil {
+			return err
+		}
+
+		// lchown(2) can change the mode of the file, so set it afterwards
+		if mode&os.ModeSymlink == 0 {
+			if opts.Chmod && !mode.IsDir() {
+				mode = mode&^chmodBits | opts.Mode&chmodBits
+			}
+			err := os.Chmod(target, mode)
+			if err != nil {
+				return err
+			}
+		}
+
+		atime := time.Unix(int64(stat.Atim.Sec), int64(stat.Atim.Nsec))
+		ts := []syscall.Timespec{fileutil.TimeToTimespec(atime), fileutil.TimeToTimespec(info.ModTime())}
+		if mode.IsDir() {
+			dirs[target] = ts
+		}
+		return fileutil.LUtimesNano(target, ts)
+	}
+
+	err := filepath.Walk(cleanSrc, copyWalker)
+	if err != nil {
+		return err
+	}
+
+	// Copying files into a directory changes its times, so they're restored
+	// once everything has been copied
+	for dirPath, ts := range dirs {
+		err := syscall.UtimesNano(dirPath, ts)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -17,8 +17,10 @@ package util
 import (
 	"archive/tar"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/appc/spec/aci"
 	rkttar "github.com/coreos/rkt/pkg/tar"
@@ -62,15 +64,70 @@ func ExtractImage(path, dst string, fileMap map[string]struct{}) error {
 	}
 	defer dr.Close()
 
+	return ExtractTar(dr, dst, fileMap)
+}
+
+// ExtractTar will extract the uncompressed tarball read from r to the
+// directory at dst, overwriting any existing files. If fileMap is set, only
+// files in it will be extracted.
+func ExtractTar(r io.Reader, dst string, fileMap map[string]struct{}) error {
+	dst, err := filepath.Abs(dst)
+	if err != nil {
+		return err
+	}
+
 	uidRange := user.NewBlankUidRange()
 
 	if os.Geteuid() == 0 {
-		return rkttar.ExtractTar(dr, dst, true, uidRange, fileMap)
+		return rkttar.ExtractTar(r, dst, true, uidRange, fileMap)
 	}
 
 	editor, err := rkttar.NewUidShiftingFilePermEditor(uidRange)
 	if err != nil {
 		return fmt.Errorf("error determining current user: %v", err)
 	}
-	return rkttar.ExtractTarInsecure(tar.NewReader(dr), dst, true, fileMap, editor)
+	return rkttar.ExtractTarInsecure(tar.NewReader(r), dst, true, fileMap, editor)
+}
+
+// ResolveInRoot returns the path on the host of the file at p in the
+// filesystem rooted at root, resolving any symlinks in p's parent directories
+// as if root were the root of the filesystem, so that they can't lead outside
+// of it. The final component of p is not resolved.
+func ResolveInRoot(root, p string) (string, error) {
+	resolved := "/"
+	parts := strings.Split(filepath.Clean("/"+p), "/")[1:]
+	linksFollowed := 0
+	for i := 0; i < len(parts); i++ {
+		if parts[i] == "" {
+			continue
+		}
+		next := filepath.Join(resolved, parts[i])
+		if i == len(parts)-1 {
+			return filepath.Join(root, next), nil
+		}
+
+		info, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+
+		linksFollowed++
+		if linksFollowed > 255 {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", p)
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(resolved, target)
+		}
+		// Start again from the root with the link's target in place of the
+		// components walked so far
+		parts = append(strings.Split(filepath.Clean("/"+target), "/")[1:], parts[i+1:]...)
+		resolved = "/"
+		i = -1
+	}
+	return filepath.Join(root, resolved), nil
 }
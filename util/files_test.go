@@ -0,0 +1,81 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolveInRoot(t *testing.T) {
+	root, err := ioutil.TempDir("", "acbuild-resolve-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(root)
+
+	for _, dir := range []string{"usr/lib", "etc"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+	links := map[string]string{
+		"lib":      "usr/lib",
+		"abs":      "/usr",
+		"escape":   "../../../../etc",
+		"usr/up":   "..",
+		"loop":     "loop",
+		"etc/self": "/etc/self",
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	tests := []struct {
+		path     string
+		expected string
+		err      bool
+	}{
+		{"/", "/", false},
+		{"etc/passwd", "/etc/passwd", false},
+		{"/lib/libc.so", "/usr/lib/libc.so", false},
+		{"abs/lib/x", "/usr/lib/x", false},
+		{"escape/passwd", "/etc/passwd", false},
+		{"../../etc/passwd", "/etc/passwd", false},
+		{"usr/up/usr/up/etc/shadow", "/etc/shadow", false},
+		{"lib", "/lib", false},
+		{"loop/x", "", true},
+	}
+	for _, test := range tests {
+		resolved, err := ResolveInRoot(root, test.path)
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.path)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.path, err)
+			continue
+		}
+		if resolved != filepath.Join(root, test.expected) {
+			t.Errorf("%s: expected %s, got %s", test.path, filepath.Join(root, test.expected), resolved)
+		}
+	}
+}
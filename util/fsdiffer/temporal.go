@@ -14,7 +14,9 @@
 package fsdiffer
 
 import (
+	"os"
 	"path/filepath"
+	"syscall"
 )
 
 // TemporalFSDiffer is used to generate changes in a given directory
@@ -42,7 +44,8 @@ func NewTemporalFSDiffer(dir string) (*TemporalFSDiffer, error) {
 // since Start was called.
 //
 // To detect if a file was changed it checks the file's size and mtime (like
-// rsync does by default if no --checksum options is used)
+// rsync does by default if no --checksum options is used), along with its
+// mode and ownership.
 func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	changes := FSChanges{}
 	after := make(map[string]fileInfo)
@@ -57,7 +60,8 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 		if !ok {
 			changes = append(changes, &FSChange{Path: relpath, ChangeType: Added})
 		} else {
-			if sourceInfo.Size() != afterInfo.Size() || sourceInfo.ModTime().Before(afterInfo.ModTime()) {
+			if sourceInfo.Size() != afterInfo.Size() || sourceInfo.ModTime().Before(afterInfo.ModTime()) ||
+				sourceInfo.Mode() != afterInfo.Mode() || !sameOwner(sourceInfo, afterInfo) {
 				changes = append(changes, &FSChange{Path: relpath, ChangeType: Modified})
 			}
 		}
@@ -71,3 +75,14 @@ func (t *TemporalFSDiffer) Diff() (FSChanges, error) {
 	}
 	return changes, nil
 }
+
+// sameOwner returns whether or not the two files are owned by the same user
+// and group. Changing either doesn't update a file's mtime.
+func sameOwner(a, b os.FileInfo) bool {
+	aStat, aOk := a.Sys().(*syscall.Stat_t)
+	bStat, bOk := b.Sys().(*syscall.Stat_t)
+	if !aOk || !bOk {
+		return true
+	}
+	return aStat.Uid == bStat.Uid && aStat.Gid == bStat.Gid
+}
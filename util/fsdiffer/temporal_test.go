@@ -68,6 +68,17 @@ func TestTemporalFSDiffer(t *testing.T) {
 			},
 			expectedChanges: FSChangesMap{"file01": Modified},
 		},
+		{
+			sourceFiles: sourceFiles,
+
+			// file01 mode changed
+			destFiles: []*buildFileInfo{
+				&buildFileInfo{path: "file01", typeflag: tar.TypeReg, mode: 0755, atime: time1, mtime: time1, contents: "hello"},
+				&buildFileInfo{path: "dir01", typeflag: tar.TypeDir, mode: 0755, atime: time1, mtime: time1},
+				&buildFileInfo{path: "dir01/file01", typeflag: tar.TypeReg, mode: 0644, atime: time1, mtime: time1, contents: "hello"},
+			},
+			expectedChanges: FSChangesMap{"file01": Modified},
+		},
 		{
 			sourceFiles: sourceFiles,
 			// new dir and file dir02/file01, dir01/file01 removed
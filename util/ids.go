@@ -0,0 +1,48 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"strconv"
+
+	"github.com/coreos/rkt/pkg/group"
+	"github.com/coreos/rkt/pkg/passwd"
+)
+
+// LookupUID returns the uid of user in the filesystem at rootfs. user can be
+// either a uid, or the name of a user in the filesystem's /etc/passwd.
+func LookupUID(rootfs, user string) (int, error) {
+	if uid, err := strconv.Atoi(user); err == nil {
+		return uid, nil
+	}
+	passwdPath, err := ResolveInRoot(rootfs, "/etc/passwd")
+	if err != nil {
+		return -1, err
+	}
+	return passwd.LookupUidFromFile(user, passwdPath)
+}
+
+// LookupGID returns the gid of group in the filesystem at rootfs. group can be
+// either a gid, or the name of a group in the filesystem's /etc/group.
+func LookupGID(rootfs, groupName string) (int, error) {
+	if gid, err := strconv.Atoi(groupName); err == nil {
+		return gid, nil
+	}
+	groupPath, err := ResolveInRoot(rootfs, "/etc/group")
+	if err != nil {
+		return -1, err
+	}
+	return group.LookupGidFromFile(groupName, groupPath)
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLookupIDs(t *testing.T) {
+	root, err := ioutil.TempDir("", "acbuild-ids-test")
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	defer os.RemoveAll(root)
+
+	// /etc is a symlink, which must be resolved within the root
+	if err := os.MkdirAll(filepath.Join(root, "usr/etc"), 0755); err != nil {
+		t.Fatalf("%v", err)
+	}
+	if err := os.Symlink("/usr/etc", filepath.Join(root, "etc")); err != nil {
+		t.Fatalf("%v", err)
+	}
+	files := map[string]string{
+		"usr/etc/passwd": "root:x:0:0::/root:/bin/sh\napp:x:1000:100::/home/app:/bin/sh\n",
+		"usr/etc/group":  "root:x:0:\nusers:x:100:app\n",
+	}
+	for name, contents := range files {
+		if err := ioutil.WriteFile(filepath.Join(root, name), []byte(contents), 0644); err != nil {
+			t.Fatalf("%v", err)
+		}
+	}
+
+	for user, expected := range map[string]int{"app": 1000, "root": 0, "42": 42} {
+		uid, err := LookupUID(root, user)
+		if err != nil || uid != expected {
+			t.Errorf("LookupUID(%q) = %d, %v, expected %d", user, uid, err, expected)
+		}
+	}
+	for group, expected := range map[string]int{"users": 100, "7": 7} {
+		gid, err := LookupGID(root, group)
+		if err != nil || gid != expected {
+			t.Errorf("LookupGID(%q) = %d, %v, expected %d", group, gid, err, expected)
+		}
+	}
+	if _, err := LookupUID(root, "missing"); err == nil {
+		t.Errorf("expected an error looking up a missing user")
+	}
+	if _, err := LookupGID(root, "missing"); err == nil {
+		t.Errorf("expected an error looking up a missing group")
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// IgnoreMatcher decides which files to leave out of a copy, using patterns
+// written like those of a .dockerignore file. Each pattern is matched against
+// paths relative to the directory being copied, with * and ? not matching
+// slashes and ** matching any number of directories. A path is ignored if the
+// last pattern matching it or one of its parent directories doesn't start
+// with !, which re-includes files ignored by the patterns before it.
+type IgnoreMatcher struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	text    string
+	re      *regexp.Regexp
+	exclude bool
+}
+
+// NewIgnoreMatcher returns an IgnoreMatcher for the given patterns.
+func NewIgnoreMatcher(patterns []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	for _, pattern := range patterns {
+		exclude := true
+		if strings.HasPrefix(pattern, "!") {
+			exclude = false
+			pattern = strings.TrimSpace(pattern[1:])
+		}
+		pattern = strings.TrimPrefix(filepath.Clean("/"+pattern), "/")
+		if pattern == "" {
+			continue
+		}
+		re, err := ignorePatternRegexp(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %v", pattern, err)
+		}
+		m.patterns = append(m.patterns, ignorePattern{pattern, re, exclude})
+	}
+	return m, nil
+}
+
+// ReadIgnoreFile returns an IgnoreMatcher for the patterns in the file at
+// path, which holds one pattern per line. Blank lines and lines starting with
+// # are skipped.
+func ReadIgnoreFile(path string) (*IgnoreMatcher, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return NewIgnoreMatcher(patterns)
+}
+
+// Matches returns whether the file at relpath is ignored.
+func (m *IgnoreMatcher) Matches(relpath string) bool {
+	relpath = filepath.Clean(relpath)
+	ignored := false
+	for _, p := range m.patterns {
+		if p.exclude == ignored {
+			// This pattern can't change the result
+			continue
+		}
+		if p.matches(relpath) {
+			ignored = p.exclude
+		}
+	}
+	return ignored
+}
+
+// MayIncludeUnder returns whether a pattern could re-include files under the
+// directory at relpath, even though the directory itself is ignored.
+func (m *IgnoreMatcher) MayIncludeUnder(relpath string) bool {
+	relpath = filepath.Clean(relpath)
+	for _, p := range m.patterns {
+		if p.exclude {
+			continue
+		}
+		if strings.Contains(p.text, "**") || strings.HasPrefix(p.text, relpath+"/") {
+			return true
+		}
+		// The pattern's leading elements may be patterns matching relpath
+		parts := strings.Split(p.text, "/")
+		n := strings.Count(relpath, "/") + 1
+		if len(parts) > n {
+			if matched, _ := filepath.Match(strings.Join(parts[:n], "/"), relpath); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches returns whether the pattern matches relpath or one of its parents.
+func (p ignorePattern) matches(relpath string) bool {
+	for {
+		if p.re.MatchString(relpath) {
+			return true
+		}
+		parent := filepath.Dir(relpath)
+		if parent == "." || parent == relpath {
+			return false
+		}
+		relpath = parent
+	}
+}
+
+// ignorePatternRegexp translates a pattern into a regexp matching whole paths.
+func ignorePatternRegexp(pattern string) (*regexp.Regexp, error) {
+	// Check that the pattern is one filepath.Match understands
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/"):
+			buf.WriteString("(.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			buf.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteString("$")
+	return regexp.Compile(buf.String())
+}
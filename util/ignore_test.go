@@ -0,0 +1,70 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	patterns := []string{
+		"*.log",
+		"/build",
+		"**/testdata",
+		"docs/",
+		"!docs/README*",
+		"vendor/*/.git",
+		"a?c",
+	}
+	m, err := NewIgnoreMatcher(patterns)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+
+	for _, tt := range []struct {
+		path       string
+		ignored    bool
+		mayInclude bool
+	}{
+		{"out.log", true, false},
+		{"pkg/out.log", false, false},
+		{"build", true, false},
+		{"build/bin/app", true, false},
+		{"pkg/build", false, false},
+		{"testdata", true, false},
+		{"pkg/x/testdata/input", true, false},
+		{"docs", true, true},
+		{"docs/README.md", false, false},
+		{"docs/design.md", true, false},
+		{"vendor/lib/.git/config", true, false},
+		{"vendor/lib/src", false, false},
+		{"abc", true, false},
+		{"abbc", false, false},
+		{"a/c", false, false},
+	} {
+		if ignored := m.Matches(tt.path); ignored != tt.ignored {
+			t.Errorf("%s: ignored is %v, expected %v", tt.path, ignored, tt.ignored)
+		}
+		if tt.ignored {
+			if mayInclude := m.MayIncludeUnder(tt.path); mayInclude != tt.mayInclude {
+				t.Errorf("%s: may include is %v, expected %v", tt.path, mayInclude, tt.mayInclude)
+			}
+		}
+	}
+
+	if _, err := NewIgnoreMatcher([]string{"[a-"}); err == nil {
+		t.Errorf("bad pattern was accepted")
+	}
+}
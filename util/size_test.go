@@ -0,0 +1,40 @@
+// Copyright 2016 The appc Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package util
+
+import (
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		size int64
+		ok   bool
+	}{
+		{"100", 100, true},
+		{"512K", 512 << 10, true},
+		{"10G", 10 << 30, true},
+		{"10gib", 10 << 30, true},
+		{"1.5G", 0, false},
+		{"0", 0, false},
+		{"G", 0, false},
+	} {
+		size, err := ParseSize(tt.in)
+		if ok := err == nil; ok != tt.ok || size != tt.size {
+			t.Errorf("ParseSize(%q) = %d, %v", tt.in, size, err)
+		}
+	}
+}